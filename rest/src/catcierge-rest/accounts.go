@@ -4,8 +4,6 @@ import (
 	"context"
 	"net/http"
 
-	"labix.org/v2/mgo"
-
 	restful "github.com/emicklei/go-restful"
 	bson "labix.org/v2/mgo/bson"
 )
@@ -28,8 +26,6 @@ type AccountListResponse struct {
 	Items []Account `json:"items"`
 }
 
-var accountsKey key
-
 // FromAccountsContext returns the CatEventResource in ctx, if any.
 func FromAccountsContext(ctx context.Context) (*AccountsResource, bool) {
 	ev, ok := ctx.Value(accountsKey).(*AccountsResource)
@@ -42,8 +38,8 @@ func (ac *AccountsResource) AddContext(c *context.Context) context.Context {
 }
 
 // NewAccountResource create a new AccountsResource
-func NewAccountResource(session *mgo.Session, settings *CatSettings) *AccountsResource {
-	return &AccountsResource{CatciergeResource{session: session, settings: settings}}
+func NewAccountResource(store CatciergeStore, settings *CatSettings) *AccountsResource {
+	return &AccountsResource{CatciergeResource{store: store, settings: settings}}
 }
 
 // Register AccountsResource resource end points.
@@ -9,20 +9,100 @@ import (
 
 	restful "github.com/emicklei/go-restful"
 	"github.com/satori/go.uuid"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
 // AuthenticationState is used to store Authentication state for
 // a single HTTP request. If the request is authenticated and if
 // so what user is logged in (our owns the token that was used to login).
+// Devices logging in with their credential have no user.
 type AuthenticationState struct {
 	IsAuthenticated bool     // If this request is authenticated.
 	User            *User    // The logged in user if any.
-	Account         *Account // The account the user is logged in to.
+	Account         *Account // The account the user (or device) is logged in to.
+	Device          *Device  // The logged in device if any.
 }
 
-var authStateKey key
+// EventDeviceID Returns the ID of the device an event is uploaded from, given the one
+// asked for by the request. Devices logged in with their credential always upload
+// as themselves, and don't have to say which device they are.
+func (at *AuthenticationState) EventDeviceID(requested string) (string, error) {
+	if at.Device == nil {
+		return requested, nil
+	}
+
+	if requested != "" && requested != at.Device.ID {
+		return "", ErrWrongDevice
+	}
+	return at.Device.ID, nil
+}
+
+// CanSeeEvent Checks if the logged in user is allowed to see an event. Events are
+// visible to the members of the account that uploaded them, events uploaded
+// without an account are visible to everyone that is logged in.
+func (at *AuthenticationState) CanSeeEvent(accounts AccountStore, e *CatEvent) bool {
+	if !at.IsAuthenticated {
+		return false
+	}
+
+	if e.AccountID == "" || (at.Account != nil && at.Account.ID == e.AccountID) {
+		return true
+	}
+
+	if at.User == nil {
+		return false
+	}
+
+	account, err := accounts.GetAccount(e.AccountID)
+	if err != nil {
+		return false
+	}
+
+	for _, u := range account.Users {
+		if u == at.User.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanChangeEvent Checks if the logged in user is allowed to change or delete an event. Only
+// the members of the account that uploaded an event can, events uploaded without an account
+// are visible to everyone that is logged in, but don't belong to anyone.
+func (at *AuthenticationState) CanChangeEvent(accounts AccountStore, e *CatEvent) bool {
+	return e.AccountID != "" && at.CanSeeEvent(accounts, e)
+}
+
+// VisibleAccounts Returns the accounts whose events the logged in user (or device) can see,
+// the same ones as CanSeeEvent allows. Events without an account are visible as well.
+func (at *AuthenticationState) VisibleAccounts(accounts AccountStore) ([]bson.ObjectId, error) {
+	ids := []bson.ObjectId{}
+	if !at.IsAuthenticated {
+		return ids, nil
+	}
+
+	if at.Account != nil {
+		ids = append(ids, at.Account.ID)
+	}
+
+	if at.User == nil {
+		return ids, nil
+	}
+
+	userAccounts, err := accounts.ListUserAccounts(at.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range userAccounts {
+		if at.Account == nil || a.ID != at.Account.ID {
+			ids = append(ids, a.ID)
+		}
+	}
+
+	return ids, nil
+}
 
 // FromAuthStateContext returns the CatEventResource in ctx, if any.
 func FromAuthStateContext(ctx context.Context) (*AuthenticationState, bool) {
@@ -75,8 +155,6 @@ type AccessTokenListResponse struct {
 	Items []AccessTokenPublic `json:"items"`
 }
 
-var accessTokenKey key
-
 // FromAcessTokenContext returns the CatEventResource in ctx, if any.
 func FromAcessTokenContext(ctx context.Context) (*AccessTokenResource, bool) {
 	ev, ok := ctx.Value(accessTokenKey).(*AccessTokenResource)
@@ -89,8 +167,8 @@ func (at *AccessTokenResource) AddContext(c *context.Context) context.Context {
 }
 
 // NewAccessTokensResource create a new AccessTokenResource
-func NewAccessTokensResource(session *mgo.Session, settings *CatSettings) *AccessTokenResource {
-	return &AccessTokenResource{CatciergeResource{session: session, settings: settings}}
+func NewAccessTokensResource(store CatciergeStore, settings *CatSettings) *AccessTokenResource {
+	return &AccessTokenResource{CatciergeResource{store: store, settings: settings}}
 }
 
 // Register AccountsResource resource end points.
@@ -164,11 +242,16 @@ func (at *AccessTokenResource) listAccessTokens(request *restful.Request, respon
 	var l = AccessTokenListResponse{}
 	l.getListResponseParams(request)
 
-	// TODO: Copy db session.
 	// TODO: We can only list access tokens for the currently logged in user.
-	err = at.session.DB("catcierge").C("tokens").Find(nil).Skip(l.Offset).Limit(l.Limit).All(&l.Items)
+	tokens, err := at.store.ListTokens(l.Offset, l.Limit)
 	if err != nil {
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, fmt.Sprintf("Failed to list Access Tokens"))
+		return
+	}
+
+	l.Items = make([]AccessTokenPublic, len(tokens))
+	for i, t := range tokens {
+		l.Items[i] = AccessTokenPublic{Name: t.Name, Token: t.Token}
 	}
 
 	response.WriteEntity(l)
@@ -183,16 +266,14 @@ func (at *AccessTokenResource) getAccessToken(request *restful.Request, response
 
 	name := request.PathParameter("name")
 
-	var token AccessTokenPublic
-
-	err = at.session.DB("catcierge").C("tokens").Find(bson.M{"name": name}).One(&token)
+	token, err := at.store.GetTokenByName(name)
 	if err != nil {
 		WriteCatciergeErrorString(response, http.StatusNotFound,
 			fmt.Sprintf("No access token with name '%s' found", name))
 		return
 	}
 
-	response.WriteEntity(&token)
+	response.WriteEntity(&AccessTokenPublic{Name: token.Name, Token: token.Token})
 }
 
 func (at *AccessTokenResource) createAccessToken(request *restful.Request, response *restful.Response) {
@@ -212,22 +293,22 @@ func (at *AccessTokenResource) createAccessToken(request *restful.Request, respo
 	tokenStr := uuid.NewV4().String()
 
 	token := AccessToken{
+		ID:        bson.NewObjectId(),
 		Name:      name,
-		Token:     tokenStr, // TODO: Force to be unique in the database.
+		Token:     tokenStr,
 		UserID:    authState.User.ID,
 		AccountID: authState.Account.ID}
 
-	// TODO: Retry below if mgo.IsDup(err) on the Token.
-	if err := at.session.DB("catcierge").C("tokens").Insert(&token); err != nil {
-		if mgo.IsDup(err) {
-			nameCount, _ := at.session.DB("catcierge").C("tokens").Find(bson.M{"name": name}).Count()
-			if nameCount == 0 {
-				// TODO: Retry adding using a newly generated token
-			}
+	// TODO: Retry below if the duplicate is the Token and not the name.
+	if err := at.store.InsertToken(&token); err != nil {
+		if err == ErrDuplicate {
 			WriteCatciergeErrorString(response, http.StatusConflict,
 				fmt.Sprintf("A token with the name '%s' already exists", name))
-			return
+		} else {
+			log.Printf("Failed to insert access token: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
 		}
+		return
 	}
 
 	response.WriteEntity(AccessTokenPublic{Name: name, Token: tokenStr})
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestAuthenticationStateEventAccess(t *testing.T) {
+	store := NewMemoryStore()
+
+	alice := &User{ID: bson.NewObjectId(), Name: "alice"}
+	bob := &User{ID: bson.NewObjectId(), Name: "bob"}
+	home := &Account{ID: bson.NewObjectId(), Name: "Home", Users: []bson.ObjectId{alice.ID}}
+	cabin := &Account{ID: bson.NewObjectId(), Name: "Cabin", Users: []bson.ObjectId{alice.ID, bob.ID}}
+	for _, a := range []*Account{home, cabin} {
+		if err := store.InsertAccount(a); err != nil {
+			t.Fatalf("Failed to insert account: %s", err)
+		}
+	}
+
+	homeEvent := &CatEvent{ID: bson.NewObjectId(), AccountID: home.ID}
+	cabinEvent := &CatEvent{ID: bson.NewObjectId(), AccountID: cabin.ID}
+	anonymousEvent := &CatEvent{ID: bson.NewObjectId()}
+
+	aliceInCabin := &AuthenticationState{IsAuthenticated: true, User: alice, Account: cabin}
+	bobInCabin := &AuthenticationState{IsAuthenticated: true, User: bob, Account: cabin}
+	homeDevice := &AuthenticationState{IsAuthenticated: true, Account: home, Device: &Device{ID: "door"}}
+	anonymous := NewAuthenticationState(false, nil)
+
+	tests := []struct {
+		name      string
+		authState *AuthenticationState
+		event     *CatEvent
+		see       bool
+		change    bool
+	}{
+		{"member logged in to another account", aliceInCabin, homeEvent, true, true},
+		{"member of the account", bobInCabin, cabinEvent, true, true},
+		{"not a member", bobInCabin, homeEvent, false, false},
+		{"device of the account", homeDevice, homeEvent, true, true},
+		{"device of another account", homeDevice, cabinEvent, false, false},
+		{"no account", bobInCabin, anonymousEvent, true, false},
+		{"not logged in", anonymous, homeEvent, false, false},
+		{"not logged in, no account", anonymous, anonymousEvent, false, false},
+	}
+
+	for _, tc := range tests {
+		if see := tc.authState.CanSeeEvent(store, tc.event); see != tc.see {
+			t.Errorf("%s: Expected CanSeeEvent %v, got %v", tc.name, tc.see, see)
+		}
+		if change := tc.authState.CanChangeEvent(store, tc.event); change != tc.change {
+			t.Errorf("%s: Expected CanChangeEvent %v, got %v", tc.name, tc.change, change)
+		}
+	}
+}
@@ -0,0 +1,980 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"labix.org/v2/mgo/bson"
+)
+
+// Bolt buckets, the items are stored as BSON keyed by their raw ObjectId.
+var (
+	boltEventsBucket              = []byte("events")
+	boltEventsByStartBucket       = []byte("events_by_start") // Index: start time + ID -> ID.
+	boltUsersBucket               = []byte("users")
+	boltAccountsBucket            = []byte("accounts")
+	boltTokensBucket              = []byte("tokens")
+	boltTokensByTokenBucket       = []byte("tokens_by_token") // Index: token string -> ID.
+	boltTokensByNameBucket        = []byte("tokens_by_name")  // Index: token name -> ID.
+	boltWebhooksBucket            = []byte("webhooks")
+	boltWebhooksByAccountBucket   = []byte("webhooks_by_account")   // Index: account + webhook ID -> webhook ID.
+	boltDeliveriesBucket          = []byte("webhook_deliveries")    // Keyed by webhook ID + delivery ID.
+	boltDevicesBucket             = []byte("devices")               // Keyed by device key.
+	boltDevicesByCredentialBucket = []byte("devices_by_credential") // Index: credential hash -> device key.
+	boltTransitionsBucket         = []byte("device_transitions")    // Keyed by device key + 0 + transition ID.
+	boltCommandsBucket            = []byte("device_commands")       // Keyed by device key + 0 + command ID.
+	boltOpenCommandsBucket        = []byte("device_commands_open")  // Index: command ID + device key -> command key.
+	boltPairingBucket             = []byte("pairing_codes")
+)
+
+// BoltStore A CatciergeStore backed by an embedded Bolt database file.
+// Use this for small installs where running MongoDB is too heavy.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore Opens (or creates) a Bolt database file at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{
+			boltEventsBucket, boltEventsByStartBucket,
+			boltUsersBucket, boltAccountsBucket,
+			boltTokensBucket, boltTokensByTokenBucket, boltTokensByNameBucket,
+			boltWebhooksBucket, boltWebhooksByAccountBucket, boltDeliveriesBucket,
+			boltDevicesBucket, boltDevicesByCredentialBucket, boltTransitionsBucket,
+			boltCommandsBucket, boltOpenCommandsBucket, boltPairingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Close Closes the Bolt database file.
+func (b *BoltStore) Close() {
+	b.db.Close()
+}
+
+// boltTimeKey Encodes a time so that the byte order matches the time order.
+// A zero time sorts first, the same as a missing date does in MongoDB.
+func boltTimeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	if !t.IsZero() {
+		// Flip the sign bit so negative times sort before positive.
+		binary.BigEndian.PutUint64(k, uint64(t.UnixNano())^(1<<63))
+	}
+	return k
+}
+
+// boltEventStartKey Returns the key for an event in the start time index.
+func boltEventStartKey(e *CatEvent) []byte {
+	return append(boltTimeKey(e.Data.Start.Time), []byte(e.ID)...)
+}
+
+// boltGet Decodes the item with the given key in a bucket.
+func boltGet(tx *bolt.Tx, bucket []byte, key []byte, result interface{}) error {
+	v := tx.Bucket(bucket).Get(key)
+	if v == nil {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(v, result)
+}
+
+// boltInsert Encodes and inserts a new item in a bucket.
+func boltInsert(tx *bolt.Tx, bucket []byte, key []byte, item interface{}) error {
+	b := tx.Bucket(bucket)
+	if b.Get(key) != nil {
+		return ErrDuplicate
+	}
+
+	v, err := bson.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
+}
+
+// boltPage Calls fn for each value in a page of a bucket, in key order.
+func boltPage(tx *bolt.Tx, bucket []byte, offset int, limit int, fn func(v []byte) error) error {
+	c := tx.Bucket(bucket).Cursor()
+	i := 0
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if i >= offset {
+			if limit > 0 && i >= offset+limit {
+				break
+			}
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		i++
+	}
+	return nil
+}
+
+// count Counts the items in a bucket.
+func (b *BoltStore) count(bucket []byte) (int, error) {
+	var count int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// eachEvent Calls fn for each event matching the query filters in start time order,
+// until fn returns false.
+func (b *BoltStore) eachEvent(query *EventQuery, fn func(e *CatEvent) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltEventsByStartBucket).Cursor()
+		for k, id := c.First(); k != nil; k, id = c.Next() {
+			var e CatEvent
+			if err := boltGet(tx, boltEventsBucket, id, &e); err != nil {
+				return err
+			}
+			if query.Match(&e) && !fn(&e) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// CountEvents Counts the events matching the query filters. Without filters
+// the events don't have to be read at all.
+func (b *BoltStore) CountEvents(query *EventQuery) (int, error) {
+	if !query.HasFilters() {
+		return b.count(boltEventsBucket)
+	}
+
+	count := 0
+	err := b.eachEvent(query, func(e *CatEvent) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// ListEvents Lists a page of events matching the query. The events are read in
+// start time order, so for the default order reading stops at the end of the page.
+func (b *BoltStore) ListEvents(query *EventQuery) ([]CatEvent, error) {
+	inOrder := len(query.Sort) == 1 && query.Sort[0] == DefaultEventSort
+
+	var all []*CatEvent
+	err := b.eachEvent(query, func(e *CatEvent) bool {
+		all = append(all, e)
+		return !inOrder || query.Limit <= 0 || len(all) < query.Offset+query.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !inOrder {
+		query.SortEvents(all)
+	}
+
+	start, end := pageBounds(len(all), query.Offset, query.Limit)
+	events := make([]CatEvent, 0, end-start)
+	for _, e := range all[start:end] {
+		events = append(events, *e)
+	}
+	return events, nil
+}
+
+// GetEvent Gets a single event.
+func (b *BoltStore) GetEvent(id bson.ObjectId) (*CatEvent, error) {
+	var event CatEvent
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltEventsBucket, []byte(id), &event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// InsertEvent Inserts a new event.
+func (b *BoltStore) InsertEvent(event *CatEvent) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := boltInsert(tx, boltEventsBucket, []byte(event.ID), event); err != nil {
+			return err
+		}
+		return tx.Bucket(boltEventsByStartBucket).Put(boltEventStartKey(event), []byte(event.ID))
+	})
+}
+
+// UpdateEvent Replaces an existing event.
+func (b *BoltStore) UpdateEvent(event *CatEvent) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old CatEvent
+		if err := boltGet(tx, boltEventsBucket, []byte(event.ID), &old); err != nil {
+			return err
+		}
+
+		v, err := bson.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltEventsBucket).Put([]byte(event.ID), v); err != nil {
+			return err
+		}
+
+		index := tx.Bucket(boltEventsByStartBucket)
+		if err := index.Delete(boltEventStartKey(&old)); err != nil {
+			return err
+		}
+		return index.Put(boltEventStartKey(event), []byte(event.ID))
+	})
+}
+
+// DeleteEvent Deletes an event.
+func (b *BoltStore) DeleteEvent(id bson.ObjectId) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old CatEvent
+		if err := boltGet(tx, boltEventsBucket, []byte(id), &old); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltEventsByStartBucket).Delete(boltEventStartKey(&old)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltEventsBucket).Delete([]byte(id))
+	})
+}
+
+// CountUsers Counts all users.
+func (b *BoltStore) CountUsers() (int, error) {
+	return b.count(boltUsersBucket)
+}
+
+// ListUsers Lists a page of users ordered by ID.
+func (b *BoltStore) ListUsers(offset int, limit int) ([]User, error) {
+	users := []User{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltPage(tx, boltUsersBucket, offset, limit, func(v []byte) error {
+			var u User
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// GetUser Gets a single user.
+func (b *BoltStore) GetUser(id bson.ObjectId) (*User, error) {
+	var user User
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltUsersBucket, []byte(id), &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// InsertUser Inserts a new user.
+func (b *BoltStore) InsertUser(user *User) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltInsert(tx, boltUsersBucket, []byte(user.ID), user)
+	})
+}
+
+// CountAccounts Counts all accounts.
+func (b *BoltStore) CountAccounts() (int, error) {
+	return b.count(boltAccountsBucket)
+}
+
+// ListAccounts Lists a page of accounts ordered by ID.
+func (b *BoltStore) ListAccounts(offset int, limit int) ([]Account, error) {
+	accounts := []Account{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltPage(tx, boltAccountsBucket, offset, limit, func(v []byte) error {
+			var a Account
+			if err := bson.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			accounts = append(accounts, a)
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+// GetAccount Gets a single account.
+func (b *BoltStore) GetAccount(id bson.ObjectId) (*Account, error) {
+	var account Account
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltAccountsBucket, []byte(id), &account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ListUserAccounts Lists the accounts a user is a member of, ordered by ID.
+func (b *BoltStore) ListUserAccounts(userID bson.ObjectId) ([]Account, error) {
+	accounts := []Account{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltPage(tx, boltAccountsBucket, 0, 0, func(v []byte) error {
+			var a Account
+			if err := bson.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			for _, u := range a.Users {
+				if u == userID {
+					accounts = append(accounts, a)
+					break
+				}
+			}
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+// InsertAccount Inserts a new account.
+func (b *BoltStore) InsertAccount(account *Account) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltInsert(tx, boltAccountsBucket, []byte(account.ID), account)
+	})
+}
+
+// CountTokens Counts all access tokens.
+func (b *BoltStore) CountTokens() (int, error) {
+	return b.count(boltTokensBucket)
+}
+
+// ListTokens Lists a page of access tokens ordered by ID.
+func (b *BoltStore) ListTokens(offset int, limit int) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltPage(tx, boltTokensBucket, offset, limit, func(v []byte) error {
+			var t AccessToken
+			if err := bson.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// getTokenBy Gets an access token using one of the token indexes.
+func (b *BoltStore) getTokenBy(index []byte, key string) (*AccessToken, error) {
+	var token AccessToken
+	err := b.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(index).Get([]byte(key))
+		if id == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx, boltTokensBucket, id, &token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetToken Gets an access token by its token string.
+func (b *BoltStore) GetToken(token string) (*AccessToken, error) {
+	return b.getTokenBy(boltTokensByTokenBucket, token)
+}
+
+// GetTokenByName Gets an access token by its name.
+func (b *BoltStore) GetTokenByName(name string) (*AccessToken, error) {
+	return b.getTokenBy(boltTokensByNameBucket, name)
+}
+
+// InsertToken Inserts a new access token. Both the token string and name must be unique.
+func (b *BoltStore) InsertToken(token *AccessToken) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		byToken := tx.Bucket(boltTokensByTokenBucket)
+		byName := tx.Bucket(boltTokensByNameBucket)
+
+		if byToken.Get([]byte(token.Token)) != nil || byName.Get([]byte(token.Name)) != nil {
+			return ErrDuplicate
+		}
+
+		if err := boltInsert(tx, boltTokensBucket, []byte(token.ID), token); err != nil {
+			return err
+		}
+
+		if err := byToken.Put([]byte(token.Token), []byte(token.ID)); err != nil {
+			return err
+		}
+		return byName.Put([]byte(token.Name), []byte(token.ID))
+	})
+}
+
+// boltWebhookAccountPrefix Returns the key prefix for the webhooks of an account in the account index.
+// The separator makes sure an empty account ID doesn't match every account.
+func boltWebhookAccountPrefix(accountID bson.ObjectId) []byte {
+	return []byte(accountID.Hex() + "/")
+}
+
+// indexWebhookAccount Replaces the account index entry of a webhook.
+func indexWebhookAccount(tx *bolt.Tx, old *Webhook, webhook *Webhook) error {
+	index := tx.Bucket(boltWebhooksByAccountBucket)
+	if old != nil {
+		if err := index.Delete(append(boltWebhookAccountPrefix(old.AccountID), []byte(old.ID)...)); err != nil {
+			return err
+		}
+	}
+	if webhook != nil {
+		return index.Put(append(boltWebhookAccountPrefix(webhook.AccountID), []byte(webhook.ID)...), []byte(webhook.ID))
+	}
+	return nil
+}
+
+// queryWebhooks Returns the webhooks of an account ordered by ID, using the account index.
+func (b *BoltStore) queryWebhooks(accountID bson.ObjectId) ([]Webhook, error) {
+	prefix := boltWebhookAccountPrefix(accountID)
+
+	webhooks := []Webhook{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltWebhooksByAccountBucket).Cursor()
+		for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = c.Next() {
+			var w Webhook
+			if err := boltGet(tx, boltWebhooksBucket, id, &w); err != nil {
+				return err
+			}
+			webhooks = append(webhooks, w)
+		}
+		return nil
+	})
+	return webhooks, err
+}
+
+// CountWebhooks Counts the webhooks of an account.
+func (b *BoltStore) CountWebhooks(accountID bson.ObjectId) (int, error) {
+	webhooks, err := b.queryWebhooks(accountID)
+	return len(webhooks), err
+}
+
+// ListWebhooks Lists a page of the webhooks of an account ordered by ID.
+func (b *BoltStore) ListWebhooks(accountID bson.ObjectId, offset int, limit int) ([]Webhook, error) {
+	all, err := b.queryWebhooks(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], nil
+}
+
+// GetWebhook Gets a single webhook.
+func (b *BoltStore) GetWebhook(id bson.ObjectId) (*Webhook, error) {
+	var webhook Webhook
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltWebhooksBucket, []byte(id), &webhook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// InsertWebhook Inserts a new webhook.
+func (b *BoltStore) InsertWebhook(webhook *Webhook) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := boltInsert(tx, boltWebhooksBucket, []byte(webhook.ID), webhook); err != nil {
+			return err
+		}
+		return indexWebhookAccount(tx, nil, webhook)
+	})
+}
+
+// UpdateWebhook Replaces an existing webhook.
+func (b *BoltStore) UpdateWebhook(webhook *Webhook) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old Webhook
+		if err := boltGet(tx, boltWebhooksBucket, []byte(webhook.ID), &old); err != nil {
+			return err
+		}
+
+		v, err := bson.Marshal(webhook)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltWebhooksBucket).Put([]byte(webhook.ID), v); err != nil {
+			return err
+		}
+		return indexWebhookAccount(tx, &old, webhook)
+	})
+}
+
+// DeleteWebhook Deletes a webhook and its delivery log.
+func (b *BoltStore) DeleteWebhook(id bson.ObjectId) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old Webhook
+		if err := boltGet(tx, boltWebhooksBucket, []byte(id), &old); err != nil {
+			return err
+		}
+
+		if err := indexWebhookAccount(tx, &old, nil); err != nil {
+			return err
+		}
+		if err := boltDeletePrefix(tx, boltDeliveriesBucket, []byte(id)); err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltWebhooksBucket).Delete([]byte(id))
+	})
+}
+
+// eachLogEntry Calls fn for each value in a log bucket with the key prefix, newest
+// (highest key) first. Log entries are keyed by a prefix followed by their ObjectId.
+func (b *BoltStore) eachLogEntry(bucket []byte, prefix []byte, fn func(v []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+
+		// Find the last key with the prefix by seeking past all of them.
+		end := append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, 12)...)
+		k, v := c.Seek(end)
+		if k == nil {
+			k, v = c.Last()
+		} else if !bytes.Equal(k, end) {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// countLog Counts the entries in a log bucket with the key prefix.
+func (b *BoltStore) countLog(bucket []byte, prefix []byte) (int, error) {
+	count := 0
+	err := b.eachLogEntry(bucket, prefix, func(v []byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// pageLog Calls fn for each value in a page of a log bucket with the key prefix, newest first.
+func (b *BoltStore) pageLog(bucket []byte, prefix []byte, offset int, limit int, fn func(v []byte) error) error {
+	i := 0
+	return b.eachLogEntry(bucket, prefix, func(v []byte) error {
+		defer func() { i++ }()
+		if i < offset || (limit > 0 && i >= offset+limit) {
+			return nil
+		}
+		return fn(v)
+	})
+}
+
+// CountWebhookDeliveries Counts the logged deliveries of a webhook.
+func (b *BoltStore) CountWebhookDeliveries(webhookID bson.ObjectId) (int, error) {
+	return b.countLog(boltDeliveriesBucket, []byte(webhookID))
+}
+
+// ListWebhookDeliveries Lists a page of the logged deliveries of a webhook, newest first.
+func (b *BoltStore) ListWebhookDeliveries(webhookID bson.ObjectId, offset int, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := b.pageLog(boltDeliveriesBucket, []byte(webhookID), offset, limit, func(v []byte) error {
+		var d WebhookDelivery
+		if err := bson.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	return deliveries, err
+}
+
+// InsertWebhookDelivery Logs a delivery of a webhook.
+func (b *BoltStore) InsertWebhookDelivery(delivery *WebhookDelivery) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltWebhooksBucket).Get([]byte(delivery.WebhookID)) == nil {
+			return ErrNotFound
+		}
+
+		key := append([]byte(delivery.WebhookID), []byte(delivery.ID)...)
+		return boltInsert(tx, boltDeliveriesBucket, key, delivery)
+	})
+}
+
+// boltDeviceLogPrefix Returns the key prefix for the log entries of a device. Device keys
+// can have different lengths, the 0 byte makes sure one key isn't the prefix of another.
+func boltDeviceLogPrefix(deviceKey string) []byte {
+	return append([]byte(deviceKey), 0)
+}
+
+// queryDevices Returns the devices of an account ordered by ID, or of all accounts ordered
+// by account and ID. Device keys start with the account, so only its devices are read.
+func (b *BoltStore) queryDevices(accountID bson.ObjectId) ([]Device, error) {
+	var prefix []byte
+	if accountID != "" {
+		prefix = []byte(DeviceKey(accountID, ""))
+	}
+
+	devices := []Device{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltDevicesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var d Device
+			if err := bson.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			devices = append(devices, d)
+		}
+		return nil
+	})
+	return devices, err
+}
+
+// CountDevices Counts the devices of an account.
+func (b *BoltStore) CountDevices(accountID bson.ObjectId) (int, error) {
+	devices, err := b.queryDevices(accountID)
+	return len(devices), err
+}
+
+// ListDevices Lists a page of the devices of an account ordered by ID.
+func (b *BoltStore) ListDevices(accountID bson.ObjectId, offset int, limit int) ([]Device, error) {
+	all, err := b.queryDevices(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], nil
+}
+
+// GetDevice Gets a single device.
+func (b *BoltStore) GetDevice(key string) (*Device, error) {
+	var device Device
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltDevicesBucket, []byte(key), &device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// GetDeviceByCredential Gets the device that was issued a credential, by the hash of the credential.
+func (b *BoltStore) GetDeviceByCredential(credentialHash string) (*Device, error) {
+	var device Device
+	err := b.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(boltDevicesByCredentialBucket).Get([]byte(credentialHash))
+		if key == nil || credentialHash == "" {
+			return ErrNotFound
+		}
+		return boltGet(tx, boltDevicesBucket, key, &device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// indexDeviceCredential Replaces the credential index entry of a device.
+func indexDeviceCredential(tx *bolt.Tx, old *Device, device *Device) error {
+	index := tx.Bucket(boltDevicesByCredentialBucket)
+	if old != nil && old.CredentialHash != "" {
+		if err := index.Delete([]byte(old.CredentialHash)); err != nil {
+			return err
+		}
+	}
+	if device != nil && device.CredentialHash != "" {
+		return index.Put([]byte(device.CredentialHash), []byte(device.Key))
+	}
+	return nil
+}
+
+// InsertDevice Inserts a new device.
+func (b *BoltStore) InsertDevice(device *Device) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := boltInsert(tx, boltDevicesBucket, []byte(device.Key), device); err != nil {
+			return err
+		}
+		return indexDeviceCredential(tx, nil, device)
+	})
+}
+
+// UpdateDevice Replaces an existing device.
+func (b *BoltStore) UpdateDevice(device *Device) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old Device
+		if err := boltGet(tx, boltDevicesBucket, []byte(device.Key), &old); err != nil {
+			return err
+		}
+
+		v, err := bson.Marshal(device)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltDevicesBucket).Put([]byte(device.Key), v); err != nil {
+			return err
+		}
+		return indexDeviceCredential(tx, &old, device)
+	})
+}
+
+// boltDeletePrefix Deletes all the keys in a bucket with the prefix.
+func boltDeletePrefix(tx *bolt.Tx, bucket []byte, prefix []byte) error {
+	var keys [][]byte
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err := tx.Bucket(bucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDevice Deletes a device, its logged transitions and its commands.
+func (b *BoltStore) DeleteDevice(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var old Device
+		if err := boltGet(tx, boltDevicesBucket, []byte(key), &old); err != nil {
+			return err
+		}
+
+		if err := indexDeviceCredential(tx, &old, nil); err != nil {
+			return err
+		}
+
+		var open [][]byte
+		c := tx.Bucket(boltOpenCommandsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if bytes.HasPrefix(v, boltDeviceLogPrefix(key)) {
+				open = append(open, k)
+			}
+		}
+		for _, k := range open {
+			if err := tx.Bucket(boltOpenCommandsBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for _, logBucket := range [][]byte{boltTransitionsBucket, boltCommandsBucket} {
+			if err := boltDeletePrefix(tx, logBucket, boltDeviceLogPrefix(key)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(boltDevicesBucket).Delete([]byte(key))
+	})
+}
+
+// CountDeviceTransitions Counts the logged transitions of a device.
+func (b *BoltStore) CountDeviceTransitions(deviceKey string) (int, error) {
+	return b.countLog(boltTransitionsBucket, boltDeviceLogPrefix(deviceKey))
+}
+
+// ListDeviceTransitions Lists a page of the logged transitions of a device, newest first.
+func (b *BoltStore) ListDeviceTransitions(deviceKey string, offset int, limit int) ([]DeviceTransition, error) {
+	transitions := []DeviceTransition{}
+	err := b.pageLog(boltTransitionsBucket, boltDeviceLogPrefix(deviceKey), offset, limit, func(v []byte) error {
+		var t DeviceTransition
+		if err := bson.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		transitions = append(transitions, t)
+		return nil
+	})
+	return transitions, err
+}
+
+// InsertDeviceTransition Logs a transition of a device.
+func (b *BoltStore) InsertDeviceTransition(transition *DeviceTransition) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltDevicesBucket).Get([]byte(transition.DeviceKey)) == nil {
+			return ErrNotFound
+		}
+
+		key := append(boltDeviceLogPrefix(transition.DeviceKey), []byte(transition.ID)...)
+		return boltInsert(tx, boltTransitionsBucket, key, transition)
+	})
+}
+
+// boltDeviceCommandKey Returns the key of a command, after the other commands of its device.
+func boltDeviceCommandKey(deviceKey string, id bson.ObjectId) []byte {
+	return append(boltDeviceLogPrefix(deviceKey), []byte(id)...)
+}
+
+// CountDeviceCommands Counts the commands of a device.
+func (b *BoltStore) CountDeviceCommands(deviceKey string) (int, error) {
+	return b.countLog(boltCommandsBucket, boltDeviceLogPrefix(deviceKey))
+}
+
+// ListDeviceCommands Lists a page of the commands of a device, newest first.
+func (b *BoltStore) ListDeviceCommands(deviceKey string, offset int, limit int) ([]DeviceCommand, error) {
+	commands := []DeviceCommand{}
+	err := b.pageLog(boltCommandsBucket, boltDeviceLogPrefix(deviceKey), offset, limit, func(v []byte) error {
+		var c DeviceCommand
+		if err := bson.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		commands = append(commands, c)
+		return nil
+	})
+	return commands, err
+}
+
+// indexOpenDeviceCommand Adds a command to the open commands index while it is queued
+// or delivered, and removes it once it is done.
+func indexOpenDeviceCommand(tx *bolt.Tx, command *DeviceCommand) error {
+	index := tx.Bucket(boltOpenCommandsBucket)
+	key := append([]byte(command.ID), []byte(command.DeviceKey)...)
+	if command.IsOpen() {
+		return index.Put(key, boltDeviceCommandKey(command.DeviceKey, command.ID))
+	}
+	return index.Delete(key)
+}
+
+// ListOpenDeviceCommands Lists the commands of a device that are queued or delivered, oldest first.
+// An empty device key lists the open commands of all devices. Only the open commands index is
+// read, so this doesn't get slower as the finished commands pile up.
+func (b *BoltStore) ListOpenDeviceCommands(deviceKey string) ([]DeviceCommand, error) {
+	var prefix []byte
+	if deviceKey != "" {
+		prefix = boltDeviceLogPrefix(deviceKey)
+	}
+
+	commands := []DeviceCommand{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltOpenCommandsBucket).Cursor()
+		for k, key := c.First(); k != nil; k, key = c.Next() {
+			if !bytes.HasPrefix(key, prefix) {
+				continue
+			}
+
+			var command DeviceCommand
+			if err := boltGet(tx, boltCommandsBucket, key, &command); err != nil {
+				return err
+			}
+			commands = append(commands, command)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// GetDeviceCommand Gets a single command of a device.
+func (b *BoltStore) GetDeviceCommand(deviceKey string, id bson.ObjectId) (*DeviceCommand, error) {
+	var command DeviceCommand
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltCommandsBucket, boltDeviceCommandKey(deviceKey, id), &command)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+// InsertDeviceCommand Queues a new command for a device.
+func (b *BoltStore) InsertDeviceCommand(command *DeviceCommand) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltDevicesBucket).Get([]byte(command.DeviceKey)) == nil {
+			return ErrNotFound
+		}
+
+		if err := boltInsert(tx, boltCommandsBucket, boltDeviceCommandKey(command.DeviceKey, command.ID), command); err != nil {
+			return err
+		}
+		return indexOpenDeviceCommand(tx, command)
+	})
+}
+
+// UpdateDeviceCommand Replaces an existing command.
+func (b *BoltStore) UpdateDeviceCommand(command *DeviceCommand) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		key := boltDeviceCommandKey(command.DeviceKey, command.ID)
+		bucket := tx.Bucket(boltCommandsBucket)
+		if bucket.Get(key) == nil {
+			return ErrNotFound
+		}
+
+		v, err := bson.Marshal(command)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(key, v); err != nil {
+			return err
+		}
+		return indexOpenDeviceCommand(tx, command)
+	})
+}
+
+// InsertPairingCode Inserts a new pairing code.
+func (b *BoltStore) InsertPairingCode(code *DevicePairingCode) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltInsert(tx, boltPairingBucket, []byte(code.Code), code)
+	})
+}
+
+// TakePairingCode Gets and deletes a pairing code.
+func (b *BoltStore) TakePairingCode(code string) (*DevicePairingCode, error) {
+	var c DevicePairingCode
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := boltGet(tx, boltPairingBucket, []byte(code), &c); err != nil {
+			return err
+		}
+		return tx.Bucket(boltPairingBucket).Delete([]byte(code))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// DeleteExpiredPairingCodes Deletes the pairing codes that have expired.
+func (b *BoltStore) DeleteExpiredPairingCodes(now time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(boltPairingBucket).ForEach(func(k []byte, v []byte) error {
+			var c DevicePairingCode
+			if err := bson.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if !now.Before(c.Expires) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := tx.Bucket(boltPairingBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
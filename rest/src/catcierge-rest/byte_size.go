@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // ByteSize represents a byte size.
 type ByteSize float64
@@ -39,3 +43,43 @@ func (b ByteSize) String() string {
 	}
 	return fmt.Sprintf("%.2fB", b)
 }
+
+// byteSizeUnits Units accepted by ParseByteSize, longest suffix first.
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"YB", YB}, {"ZB", ZB}, {"EB", EB}, {"PB", PB},
+	{"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB}, {"B", 1},
+}
+
+// ParseByteSize Parses a byte size such as "512KB" or "2.5MB". Plain numbers are bytes.
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	unit := ByteSize(1)
+
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid byte size '%s'", s)
+	}
+
+	return ByteSize(n) * unit, nil
+}
+
+// Set Sets the byte size from a string, so it can be used as a command line flag value.
+func (b *ByteSize) Set(s string) error {
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
@@ -2,14 +2,12 @@ package main
 
 import (
 	"context"
-
-	"labix.org/v2/mgo"
 )
 
 // CatciergeResource base resource for the entire API.
 type CatciergeResource struct {
-	// MongoDB session.
-	session  *mgo.Session
+	// Storage backend.
+	store    CatciergeStore
 	settings *CatSettings
 }
 
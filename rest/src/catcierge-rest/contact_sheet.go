@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"strconv"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// Cell widths for contact sheets, in pixels.
+const (
+	DefaultContactSheetCellWidth = 200
+	MinContactSheetCellWidth     = 64
+	MaxContactSheetCellWidth     = 640
+)
+
+// contactSheetMargin Space between the cells of a contact sheet.
+const contactSheetMargin = 8
+
+// Limits on the size of contact sheets. The matches and steps come from the uploaded
+// event, so the sheet is capped instead of growing with whatever the event claims.
+// Catcierge itself never has more than a handful of matches and steps.
+const (
+	MaxContactSheetMatches = 16                                      // Rows, the matches after these are left out.
+	MaxContactSheetColumns = 16                                      // The match image and its steps, the steps after these are left out.
+	MaxContactSheetPixels  = MaxResizeDimension * MaxResizeDimension // The cells are made smaller to fit within this.
+)
+
+// Colors used on contact sheets.
+var (
+	contactSheetBackground = color.RGBA{32, 32, 32, 255}
+	contactSheetCell       = color.RGBA{64, 64, 64, 255}
+	contactSheetText       = color.RGBA{255, 255, 255, 255}
+	contactSheetDimText    = color.RGBA{170, 170, 170, 255}
+	colorSuccess           = color.RGBA{0, 200, 0, 255}
+	colorFailure           = color.RGBA{220, 0, 0, 255}
+	colorFalsePositive     = color.RGBA{255, 165, 0, 255}
+)
+
+// ParseContactSheetCellWidth Gets the cell width of a contact sheet from the request query parameters.
+func ParseContactSheetCellWidth(request *restful.Request) (int, error) {
+	s := request.QueryParameter("cell")
+	if s == "" {
+		return DefaultContactSheetCellWidth, nil
+	}
+
+	w, err := strconv.Atoi(s)
+	if err != nil || w < MinContactSheetCellWidth || w > MaxContactSheetCellWidth {
+		return 0, fmt.Errorf("Invalid cell width '%s', expected %d to %d", s, MinContactSheetCellWidth, MaxContactSheetCellWidth)
+	}
+	return w, nil
+}
+
+// ContactSheetCacheName Returns the file name a contact sheet is cached under. Since the
+// labels come from the event, which can change, a hash of the event is part of the name.
+func ContactSheetCacheName(e *CatEvent, cellWidth int) string {
+	h := fnv.New32a()
+	fmt.Fprint(h, e.Name, e.Data.Start, e.Data.Matches)
+	return fmt.Sprintf("contact-sheet-%d-%08x.png", cellWidth, h.Sum32())
+}
+
+// ContactSheetFiles Returns the paths of all match and step images of an event.
+func ContactSheetFiles(eventDir string, e *CatEvent) []string {
+	var files []string
+
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		if f, err := EventFilePath(eventDir, cleanArchiveName(p)); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	for _, m := range e.Data.Matches {
+		add(m.Path)
+		for _, s := range m.Steps {
+			add(s.Path)
+		}
+	}
+
+	return files
+}
+
+// matchSummary A one line summary of a match for labels.
+func matchSummary(m *CatEventMatchV1) string {
+	success := "FAIL"
+	if m.Success != 0 {
+		success = "OK"
+	}
+
+	direction := m.Directon
+	if direction == "" {
+		direction = "unknown"
+	}
+
+	s := fmt.Sprintf("Match %s: %s, %s, result %.3f", m.ID, direction, success, m.Result)
+	if m.IsFalsePositive {
+		s += ", FALSE POSITIVE"
+	}
+	return s
+}
+
+// matchColor The color used to show the outcome of a match.
+func matchColor(m *CatEventMatchV1) color.Color {
+	switch {
+	case m.IsFalsePositive:
+		return colorFalsePositive
+	case m.Success != 0:
+		return colorSuccess
+	}
+	return colorFailure
+}
+
+// drawContactSheetCell Draws an image scaled to fit the box, or a placeholder if it can't be loaded.
+func drawContactSheetCell(sheet *image.RGBA, box image.Rectangle, eventDir string, p string) {
+	draw.Draw(sheet, box, image.NewUniform(contactSheetCell), image.ZP, draw.Src)
+
+	var img image.Image
+	name, err := EventFilePath(eventDir, cleanArchiveName(p))
+	if err == nil && p != "" {
+		img, err = decodeImageFile(name)
+	}
+
+	if err != nil || p == "" {
+		if p != "" {
+			log.Printf("Contact sheet is missing image %s: %s", p, err)
+		}
+		DrawText(sheet, box.Min.X+4, box.Min.Y+4, "missing", 1, contactSheetDimText)
+		return
+	}
+
+	scaled := ResizeImage(img, &ImageResizeOptions{Width: box.Dx(), Height: box.Dy(), Fit: FitContain})
+	b := scaled.Bounds()
+	at := box.Min.Add(image.Pt((box.Dx()-b.Dx())/2, (box.Dy()-b.Dy())/2))
+	draw.Draw(sheet, image.Rectangle{at, at.Add(b.Size())}, scaled, b.Min, draw.Src)
+}
+
+// contactSheetSize Returns the width and height of a contact sheet with the given number of
+// rows and columns of cells.
+func contactSheetSize(rows int, columns int, cellWidth int) (int, int) {
+	cellHeight := cellWidth * 3 / 4
+	lineHeight := TextHeight(1) + 3
+	headerHeight := TextHeight(2) + 2*contactSheetMargin
+
+	rowHeight := headerHeight + cellHeight + 2*lineHeight + contactSheetMargin
+	width := contactSheetMargin + columns*(cellWidth+contactSheetMargin)
+	height := headerHeight + rows*rowHeight + contactSheetMargin
+	return width, height
+}
+
+// BuildContactSheet Renders an overview of an event, one row per match with the
+// match image followed by all its step images, labeled with the step names and
+// descriptions and the result, direction and success of the match. At most
+// MaxContactSheetMatches rows of MaxContactSheetColumns cells are drawn, and the
+// cells are made smaller if the sheet would have more than MaxContactSheetPixels.
+func BuildContactSheet(eventDir string, e *CatEvent, cellWidth int) *image.RGBA {
+	matches := e.Data.Matches
+	if len(matches) > MaxContactSheetMatches {
+		matches = matches[:MaxContactSheetMatches]
+	}
+
+	columns := 1
+	for _, m := range matches {
+		if len(m.Steps)+1 > columns {
+			columns = len(m.Steps) + 1
+		}
+	}
+	if columns > MaxContactSheetColumns {
+		columns = MaxContactSheetColumns
+	}
+
+	width, height := contactSheetSize(len(matches), columns, cellWidth)
+	for width*height > MaxContactSheetPixels && cellWidth > MinContactSheetCellWidth {
+		cellWidth -= cellWidth / 8
+		if cellWidth < MinContactSheetCellWidth {
+			cellWidth = MinContactSheetCellWidth
+		}
+		width, height = contactSheetSize(len(matches), columns, cellWidth)
+	}
+
+	cellHeight := cellWidth * 3 / 4
+	lineHeight := TextHeight(1) + 3
+	headerHeight := TextHeight(2) + 2*contactSheetMargin
+
+	if minWidth := TextWidth(e.ID.Hex(), 2) + 2*contactSheetMargin; width < minWidth {
+		width = minWidth
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactSheetBackground), image.ZP, draw.Src)
+
+	title := fmt.Sprintf("Event %s", e.ID.Hex())
+	if e.Name != "" {
+		title += " " + e.Name
+	}
+	if !e.Data.Start.IsZero() {
+		title += " " + e.Data.Start.Format("2006-01-02 15:04:05")
+	}
+	if len(matches) < len(e.Data.Matches) {
+		title += fmt.Sprintf(" (first %d of %d matches)", len(matches), len(e.Data.Matches))
+	}
+	DrawText(sheet, contactSheetMargin, contactSheetMargin, TruncateText(title, width-2*contactSheetMargin, 2), 2, contactSheetText)
+
+	textWidth := cellWidth
+	y := headerHeight
+
+	for mi := range matches {
+		m := &matches[mi]
+
+		// The match header, with a bar in the color of the outcome.
+		draw.Draw(sheet, image.Rect(contactSheetMargin, y+contactSheetMargin/2, width-contactSheetMargin, y+contactSheetMargin/2+2),
+			image.NewUniform(matchColor(m)), image.ZP, draw.Src)
+		summary := matchSummary(m)
+		if len(m.Steps)+1 > columns {
+			summary += fmt.Sprintf(", first %d of %d steps", columns-1, len(m.Steps))
+		}
+		DrawText(sheet, contactSheetMargin, y+contactSheetMargin,
+			TruncateText(summary, width-2*contactSheetMargin, 2), 2, matchColor(m))
+		y += headerHeight
+
+		x := contactSheetMargin
+		cell := func(p string, name string, description string) {
+			drawContactSheetCell(sheet, image.Rect(x, y, x+cellWidth, y+cellHeight), eventDir, p)
+			DrawText(sheet, x, y+cellHeight+3, TruncateText(name, textWidth, 1), 1, contactSheetText)
+			DrawText(sheet, x, y+cellHeight+3+lineHeight, TruncateText(description, textWidth, 1), 1, contactSheetDimText)
+			x += cellWidth + contactSheetMargin
+		}
+
+		cell(m.Path, "match", m.Description)
+		for si, s := range m.Steps {
+			if si+1 >= columns {
+				break
+			}
+			cell(s.Path, s.Name, s.Description)
+		}
+
+		y += cellHeight + 2*lineHeight + contactSheetMargin
+	}
+
+	return sheet
+}
+
+// WriteContactSheet Renders a contact sheet and writes it to dst, unless dst is already up to date.
+func WriteContactSheet(eventDir string, e *CatEvent, cellWidth int, dst string) error {
+	if isCacheFresh(dst, ContactSheetFiles(eventDir, e)...) {
+		return nil
+	}
+
+	sheet := BuildContactSheet(eventDir, e, cellWidth)
+
+	return writeCacheFile(dst, func(w io.Writer) error {
+		return png.Encode(w, sheet)
+	})
+}
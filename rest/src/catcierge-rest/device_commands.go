@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// Commands that can be sent to a device.
+const (
+	DeviceCommandLock    = "lock"
+	DeviceCommandUnlock  = "unlock"
+	DeviceCommandLockout = "lockout" // Lock out for a number of minutes.
+	DeviceCommandReboot  = "reboot"
+)
+
+// DeviceCommandTypes All the commands that can be sent to a device.
+var DeviceCommandTypes = []string{DeviceCommandLock, DeviceCommandUnlock, DeviceCommandLockout, DeviceCommandReboot}
+
+// The states of a device command. A command is queued until the device fetches it, and is
+// then delivered until the device acknowledges it or reports that it failed. Commands that
+// are not acknowledged in time expire. A delivered command is delivered again the next time
+// the device fetches its commands, since it might never have gotten it.
+const (
+	DeviceCommandQueued    = "queued"
+	DeviceCommandDelivered = "delivered"
+	DeviceCommandAcked     = "acked"
+	DeviceCommandFailed    = "failed"
+	DeviceCommandExpired   = "expired"
+)
+
+// Limits for device commands.
+const (
+	DefaultDeviceCommandTTL   = time.Hour
+	maxDeviceCommandTTL       = 7 * 24 * time.Hour
+	maxLockoutMinutes         = 24 * 60
+	defaultDeviceCommandWait  = 30 * time.Second
+	maxDeviceCommandWait      = 60 * time.Second
+	maxDeviceCommandResultLen = 1024
+)
+
+// DeviceCommandStateChange An entry in the state history of a command.
+type DeviceCommandStateChange struct {
+	State   string    `json:"state" bson:"state"`
+	Time    time.Time `json:"time" bson:"time"`
+	Message string    `json:"message,omitempty" bson:"message,omitempty"`
+}
+
+// DeviceCommand A command queued for a device.
+type DeviceCommand struct {
+	ID        bson.ObjectId              `json:"id" bson:"_id"`
+	DeviceKey string                     `json:"-" xml:"-" bson:"device_key"`
+	DeviceID  string                     `json:"device_id" bson:"device_id"`
+	Type      string                     `json:"type" bson:"type"`
+	Minutes   int                        `json:"minutes,omitempty" bson:"minutes,omitempty"` // How long to lock out for.
+	UserID    bson.ObjectId              `json:"user_id,omitempty" bson:"user_id,omitempty"` // The user that queued the command.
+	State     string                     `json:"state" bson:"state"`                         // The current state.
+	Result    string                     `json:"result,omitempty" bson:"result,omitempty"`   // Reported by the device when acknowledging.
+	Error     string                     `json:"error,omitempty" bson:"error,omitempty"`     // Reported by the device when it failed.
+	History   []DeviceCommandStateChange `json:"history" bson:"history"`                     // Every state the command has been in, oldest first.
+	Expires   time.Time                  `json:"expires" bson:"expires"`                     // When the command expires unless it was acknowledged.
+	Created   time.Time                  `json:"created" bson:"created"`
+}
+
+// IsOpen Checks if the command is still waiting to be delivered or acknowledged.
+func (c *DeviceCommand) IsOpen() bool {
+	return c.State == DeviceCommandQueued || c.State == DeviceCommandDelivered
+}
+
+// setState Moves the command to a new state, adding it to the history.
+func (c *DeviceCommand) setState(state string, now time.Time, message string) {
+	c.State = state
+	c.History = append(c.History, DeviceCommandStateChange{State: state, Time: now, Message: message})
+}
+
+// DeviceCommandRequest The body used to queue a command.
+type DeviceCommandRequest struct {
+	Type      string `json:"type"`
+	Minutes   int    `json:"minutes"`    // Required for lockout.
+	ExpiresIn int    `json:"expires_in"` // Seconds, the command expires if not acknowledged within this time.
+}
+
+// Validate Returns the problems with a command request, if any.
+func (r *DeviceCommandRequest) Validate() []string {
+	var problems []string
+
+	valid := false
+	for _, t := range DeviceCommandTypes {
+		valid = valid || r.Type == t
+	}
+	if !valid {
+		problems = append(problems, fmt.Sprintf("Invalid command type '%s', expected one of: %s",
+			r.Type, strings.Join(DeviceCommandTypes, ", ")))
+	}
+
+	if r.Type == DeviceCommandLockout && (r.Minutes <= 0 || r.Minutes > maxLockoutMinutes) {
+		problems = append(problems, fmt.Sprintf("A lockout needs 'minutes' between 1 and %d", maxLockoutMinutes))
+	} else if r.Type != DeviceCommandLockout && r.Minutes != 0 {
+		problems = append(problems, "Only a lockout takes 'minutes'")
+	}
+
+	if r.ExpiresIn < 0 || time.Duration(r.ExpiresIn)*time.Second > maxDeviceCommandTTL {
+		problems = append(problems, fmt.Sprintf("The 'expires_in' must be at most %d seconds", int(maxDeviceCommandTTL/time.Second)))
+	}
+
+	return problems
+}
+
+// DeviceCommandAck The body sent by a device when it has carried out a command,
+// or with an error if it failed to.
+type DeviceCommandAck struct {
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+// DeviceCommandListResponse A response returned when listing the commands of a device.
+type DeviceCommandListResponse struct {
+	ListResponseHeader
+	Items []DeviceCommand `json:"items"`
+}
+
+// waitForCommands Returns a channel that is signalled when a command is queued
+// for a device, and a function that must be called when done waiting.
+func (dv *DevicesResource) waitForCommands(deviceKey string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	dv.waitersMutex.Lock()
+	if dv.waiters[deviceKey] == nil {
+		dv.waiters[deviceKey] = make(map[chan struct{}]bool)
+	}
+	dv.waiters[deviceKey][ch] = true
+	dv.waitersMutex.Unlock()
+
+	return ch, func() {
+		dv.waitersMutex.Lock()
+		delete(dv.waiters[deviceKey], ch)
+		if len(dv.waiters[deviceKey]) == 0 {
+			delete(dv.waiters, deviceKey)
+		}
+		dv.waitersMutex.Unlock()
+	}
+}
+
+// wakeCommandWaiters Tells everyone waiting for commands for a device that one was queued.
+func (dv *DevicesResource) wakeCommandWaiters(deviceKey string) {
+	dv.waitersMutex.Lock()
+	defer dv.waitersMutex.Unlock()
+
+	for ch := range dv.waiters[deviceKey] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliverCommands Marks the queued commands of a device as delivered and returns them,
+// oldest first. With redeliver the commands that were delivered but not yet acknowledged are
+// returned as well, since writing a response can succeed without the device ever reading it.
+// Use it when the device connects, the device skips the commands it has already carried out.
+func (dv *DevicesResource) deliverCommands(deviceKey string, now time.Time, redeliver bool) ([]DeviceCommand, error) {
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	open, err := dv.store.ListOpenDeviceCommands(deviceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	delivered := []DeviceCommand{}
+	for i := range open {
+		c := &open[i]
+		if c.State != DeviceCommandQueued && !(redeliver && c.State == DeviceCommandDelivered) {
+			continue
+		}
+
+		switch {
+		case !now.Before(c.Expires) && c.State == DeviceCommandQueued:
+			c.setState(DeviceCommandExpired, now, "Expired before it was delivered")
+		case !now.Before(c.Expires):
+			c.setState(DeviceCommandExpired, now, "Expired before it was acknowledged")
+		case c.State == DeviceCommandDelivered:
+			c.setState(DeviceCommandDelivered, now, "Delivered again")
+		default:
+			c.setState(DeviceCommandDelivered, now, "")
+		}
+
+		if err := dv.store.UpdateDeviceCommand(c); err != nil {
+			return delivered, err
+		}
+
+		if c.State == DeviceCommandDelivered {
+			delivered = append(delivered, *c)
+		}
+	}
+
+	return delivered, nil
+}
+
+// ExpireCommands Expires the commands that were not acknowledged in time.
+func (dv *DevicesResource) ExpireCommands(now time.Time) error {
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	open, err := dv.store.ListOpenDeviceCommands("")
+	if err != nil {
+		return err
+	}
+
+	for i := range open {
+		c := &open[i]
+		if now.Before(c.Expires) {
+			continue
+		}
+
+		msg := "Expired before it was acknowledged"
+		if c.State == DeviceCommandQueued {
+			msg = "Expired before it was delivered"
+		}
+		c.setState(DeviceCommandExpired, now, msg)
+
+		if err := dv.store.UpdateDeviceCommand(c); err != nil {
+			log.Printf("Failed to expire command %s for device %s: %s", c.ID.Hex(), c.DeviceID, err)
+		}
+	}
+
+	return nil
+}
+
+// getRequestDeviceCommand Gets the command given by the command-id path parameter
+// of a device, writing an error response if it can't be found.
+func (dv *DevicesResource) getRequestDeviceCommand(request *restful.Request, response *restful.Response, device *Device) (*DeviceCommand, bool) {
+	id := request.PathParameter("command-id")
+
+	var command *DeviceCommand
+	err := ErrNotFound
+	if bson.IsObjectIdHex(id) {
+		command, err = dv.store.GetDeviceCommand(device.Key, bson.ObjectIdHex(id))
+	}
+
+	if err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Command '%s' could not be found", id))
+		} else {
+			log.Printf("Failed to get command %s for device %s: %s", id, device.ID, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return nil, false
+	}
+
+	return command, true
+}
+
+// isRequestDevice Checks that the request is made by the device itself, logged in with its
+// credential, writing an error response if not. Users can only queue and look at commands,
+// fetching and acknowledging them is left to the device so that they are carried out.
+func isRequestDevice(response *restful.Response, authState *AuthenticationState, device *Device) bool {
+	if authState.Device == nil || authState.Device.Key != device.Key {
+		WriteCatciergeErrorString(response, http.StatusForbidden,
+			fmt.Sprintf("Only device '%s' can fetch and acknowledge its commands", device.ID))
+		return false
+	}
+	return true
+}
+
+// parseCommandWait Gets how long to wait for commands from the wait query parameter.
+func parseCommandWait(request *restful.Request) (time.Duration, error) {
+	s := request.QueryParameter("wait")
+	if s == "" {
+		return defaultDeviceCommandWait, nil
+	}
+
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Invalid 'wait' %s, expected a number of seconds", s)
+	}
+
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxDeviceCommandWait {
+		wait = maxDeviceCommandWait
+	}
+	return wait, nil
+}
+
+func (dv *DevicesResource) listDeviceCommands(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	var l = DeviceCommandListResponse{}
+	l.getListResponseParams(request)
+
+	if l.Count, err = dv.store.CountDeviceCommands(device.Key); err != nil {
+		log.Printf("Failed to count device commands: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to get command count")
+		return
+	}
+
+	if l.Items, err = dv.store.ListDeviceCommands(device.Key, l.Offset, l.Limit); err != nil {
+		log.Printf("Failed to list device commands: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list commands")
+		return
+	}
+
+	response.WriteEntity(l)
+}
+
+func (dv *DevicesResource) createDeviceCommand(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	var r DeviceCommandRequest
+	if err := request.ReadEntity(&r); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid command: %s", err))
+		return
+	}
+
+	if problems := r.Validate(); len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid command", problems)
+		return
+	}
+
+	ttl := DefaultDeviceCommandTTL
+	if r.ExpiresIn > 0 {
+		ttl = time.Duration(r.ExpiresIn) * time.Second
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	command := DeviceCommand{
+		ID:        bson.NewObjectId(),
+		DeviceKey: device.Key,
+		DeviceID:  device.ID,
+		Type:      r.Type,
+		Minutes:   r.Minutes,
+		Expires:   now.Add(ttl),
+		Created:   now}
+
+	if authState.User != nil {
+		command.UserID = authState.User.ID
+	}
+
+	command.setState(DeviceCommandQueued, now, "")
+
+	if err := dv.store.InsertDeviceCommand(&command); err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Device '%s' could not be found", device.ID))
+		} else {
+			log.Printf("Failed to queue command for device %s: %s", device.ID, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	dv.wakeCommandWaiters(device.Key)
+
+	log.Printf("Queued %s command %s for device %s\n", command.Type, command.ID.Hex(), device.ID)
+	response.WriteHeaderAndEntity(http.StatusCreated, command)
+}
+
+func (dv *DevicesResource) getDeviceCommand(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	command, ok := dv.getRequestDeviceCommand(request, response, device)
+	if !ok {
+		return
+	}
+
+	response.WriteEntity(command)
+}
+
+func (dv *DevicesResource) pollDeviceCommands(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	wait, err := parseCommandWait(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok || !isRequestDevice(response, authState, device) {
+		return
+	}
+
+	// Start waiting before looking, so a command queued in between isn't missed.
+	wake, done := dv.waitForCommands(device.Key)
+	defer done()
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	var l = DeviceCommandListResponse{}
+
+	for {
+		if l.Items, err = dv.deliverCommands(device.Key, time.Now().UTC().Truncate(time.Millisecond), true); err != nil {
+			log.Printf("Failed to deliver commands to device %s: %s", device.ID, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+			return
+		}
+
+		if len(l.Items) > 0 {
+			break
+		}
+
+		select {
+		case <-wake:
+			continue
+		case <-timeout.C:
+		case <-request.Request.Context().Done():
+		}
+		break
+	}
+
+	l.Count = len(l.Items)
+	response.WriteEntity(l)
+}
+
+func (dv *DevicesResource) streamDeviceCommands(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok || !isRequestDevice(response, authState, device) {
+		return
+	}
+
+	flusher, ok := response.ResponseWriter.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming is not supported by the response writer")
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	wake, done := dv.waitForCommands(device.Key)
+	defer done()
+
+	header := response.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(response, "retry: %d\n\n", 5000)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	// The commands delivered but not acknowledged before are sent again when the device
+	// connects, after that only the newly queued ones are sent on this connection.
+	for redeliver := true; ; redeliver = false {
+		commands, err := dv.deliverCommands(device.Key, time.Now().UTC().Truncate(time.Millisecond), redeliver)
+		if err != nil {
+			log.Printf("Failed to deliver commands to device %s: %s", device.ID, err)
+			return
+		}
+
+		for i := range commands {
+			content, err := json.Marshal(&commands[i])
+			if err != nil {
+				log.Printf("Failed to encode command %s: %s", commands[i].ID.Hex(), err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(response, "id: %s\nevent: command\ndata: %s\n\n", commands[i].ID.Hex(), content); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		// Wait until more commands are queued.
+		for waiting := true; waiting; {
+			select {
+			case <-wake:
+				waiting = false
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-request.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func (dv *DevicesResource) ackDeviceCommand(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	// An acknowledgement without a body means the command was carried out.
+	var ack DeviceCommandAck
+	if err := json.NewDecoder(request.Request.Body).Decode(&ack); err != nil && err != io.EOF {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid acknowledgement: %s", err))
+		return
+	}
+
+	if len(ack.Result) > maxDeviceCommandResultLen || len(ack.Error) > maxDeviceCommandResultLen {
+		WriteCatciergeErrorString(response, http.StatusBadRequest,
+			fmt.Sprintf("The 'result' and 'error' can be at most %d characters", maxDeviceCommandResultLen))
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok || !isRequestDevice(response, authState, device) {
+		return
+	}
+
+	command, ok := dv.getRequestDeviceCommand(request, response, device)
+	if !ok {
+		return
+	}
+
+	if command.State != DeviceCommandDelivered {
+		WriteCatciergeErrorString(response, http.StatusConflict,
+			fmt.Sprintf("Command '%s' is %s, only delivered commands can be acknowledged", command.ID.Hex(), command.State))
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if ack.Error != "" {
+		command.Error = ack.Error
+		command.setState(DeviceCommandFailed, now, ack.Error)
+	} else {
+		command.Result = ack.Result
+		command.setState(DeviceCommandAcked, now, ack.Result)
+	}
+
+	if err := dv.store.UpdateDeviceCommand(command); err != nil {
+		log.Printf("Failed to update command %s for device %s: %s", command.ID.Hex(), device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	response.WriteEntity(command)
+}
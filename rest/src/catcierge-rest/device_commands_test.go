@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// testDevicesContainer Returns a container with the devices resource, where every
+// request is made with the given authentication state.
+func testDevicesContainer(dv *DevicesResource, authState *AuthenticationState) *restful.Container {
+	container := restful.NewContainer()
+	container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		ctx := req.Request.Context()
+		req.Request = req.Request.WithContext(authState.AddContext(&ctx))
+		chain.ProcessFilter(req, resp)
+	})
+	dv.Register(container)
+	return container
+}
+
+// testQueueCommand Queues a command for a device, expiring after the ttl.
+func testQueueCommand(t *testing.T, store CatciergeStore, device *Device, now time.Time, ttl time.Duration) *DeviceCommand {
+	c := &DeviceCommand{ID: bson.NewObjectId(), DeviceKey: device.Key, DeviceID: device.ID,
+		Type: DeviceCommandLock, Expires: now.Add(ttl), Created: now}
+	c.setState(DeviceCommandQueued, now, "")
+	if err := store.InsertDeviceCommand(c); err != nil {
+		t.Fatalf("Failed to queue command: %s", err)
+	}
+	return c
+}
+
+func commandIDs(commands []DeviceCommand) []string {
+	ids := []string{}
+	for _, c := range commands {
+		ids = append(ids, c.ID.Hex())
+	}
+	return ids
+}
+
+func TestDeliverCommands(t *testing.T) {
+	store := NewMemoryStore()
+	dv := NewDevicesResource(store, &CatSettings{})
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	device := newDevice(bson.NewObjectId(), "door", now)
+	if err := store.InsertDevice(device); err != nil {
+		t.Fatalf("Failed to insert device: %s", err)
+	}
+
+	first := testQueueCommand(t, store, device, now, time.Hour)
+	expired := testQueueCommand(t, store, device, now.Add(-time.Hour), time.Minute)
+
+	delivered, err := dv.deliverCommands(device.Key, now, false)
+	if err != nil || len(delivered) != 1 || delivered[0].ID != first.ID {
+		t.Fatalf("Expected only %s to be delivered, got %v: %v", first.ID.Hex(), commandIDs(delivered), err)
+	}
+	if c, _ := store.GetDeviceCommand(device.Key, expired.ID); c.State != DeviceCommandExpired {
+		t.Errorf("Expected the expired command to be %s, got %s", DeviceCommandExpired, c.State)
+	}
+
+	// Without redelivering, a command is only delivered once.
+	second := testQueueCommand(t, store, device, now, time.Hour)
+	if delivered, _ = dv.deliverCommands(device.Key, now, false); len(delivered) != 1 || delivered[0].ID != second.ID {
+		t.Errorf("Expected only %s to be delivered, got %v", second.ID.Hex(), commandIDs(delivered))
+	}
+
+	// When the device connects again the unacknowledged commands are delivered again, oldest first.
+	delivered, _ = dv.deliverCommands(device.Key, now.Add(time.Minute), true)
+	if ids := commandIDs(delivered); strings.Join(ids, ",") != first.ID.Hex()+","+second.ID.Hex() {
+		t.Errorf("Expected both commands to be delivered again, got %v", ids)
+	}
+	for _, c := range delivered {
+		if c.State != DeviceCommandDelivered || c.History[len(c.History)-1].Message != "Delivered again" {
+			t.Errorf("Expected %s to be delivered again, got %+v", c.ID.Hex(), c.History)
+		}
+	}
+
+	// Unless they have expired in the meantime.
+	if delivered, _ = dv.deliverCommands(device.Key, now.Add(2*time.Hour), true); len(delivered) != 0 {
+		t.Errorf("Expected no commands once they expired, got %v", commandIDs(delivered))
+	}
+	if c, _ := store.GetDeviceCommand(device.Key, first.ID); c.State != DeviceCommandExpired {
+		t.Errorf("Expected the command to be %s, got %s", DeviceCommandExpired, c.State)
+	}
+}
+
+func TestPollDeviceCommandsRedelivers(t *testing.T) {
+	store := NewMemoryStore()
+	dv := NewDevicesResource(store, &CatSettings{})
+	now := time.Now().UTC()
+
+	account := &Account{ID: bson.NewObjectId(), Name: "Home"}
+	device := newDevice(account.ID, "door", now)
+	if err := store.InsertDevice(device); err != nil {
+		t.Fatalf("Failed to insert device: %s", err)
+	}
+	command := testQueueCommand(t, store, device, now, time.Hour)
+
+	container := testDevicesContainer(dv, &AuthenticationState{IsAuthenticated: true, Account: account, Device: device})
+
+	poll := func() []DeviceCommand {
+		w := httptest.NewRecorder()
+		container.ServeHTTP(w, httptest.NewRequest("GET", "/devices/door/commands/pending?wait=0", nil))
+		var l DeviceCommandListResponse
+		if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+			t.Fatalf("Failed to decode commands (%d): %s", w.Code, err)
+		}
+		return l.Items
+	}
+
+	// The response might be lost, so the command is delivered until acknowledged.
+	for i := 0; i < 2; i++ {
+		if items := poll(); len(items) != 1 || items[0].ID != command.ID {
+			t.Fatalf("Poll %d: Expected %s, got %v", i, command.ID.Hex(), commandIDs(items))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/devices/door/commands/"+command.ID.Hex()+"/ack", strings.NewReader(`{"result": "locked"}`))
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	container.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the ack to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if items := poll(); len(items) != 0 {
+		t.Errorf("Expected no commands after the ack, got %v", commandIDs(items))
+	}
+}
+
+func TestStreamDeviceCommandsRedelivers(t *testing.T) {
+	store := NewMemoryStore()
+	dv := NewDevicesResource(store, &CatSettings{})
+	now := time.Now().UTC()
+
+	account := &Account{ID: bson.NewObjectId(), Name: "Home"}
+	device := newDevice(account.ID, "door", now)
+	if err := store.InsertDevice(device); err != nil {
+		t.Fatalf("Failed to insert device: %s", err)
+	}
+	command := testQueueCommand(t, store, device, now, time.Hour)
+
+	server := httptest.NewServer(testDevicesContainer(dv, &AuthenticationState{IsAuthenticated: true, Account: account, Device: device}))
+	defer server.Close()
+
+	// readCommandID Connects to the stream and returns the ID of the first command.
+	readCommandID := func() string {
+		resp, err := http.Get(server.URL + "/devices/door/commands/stream")
+		if err != nil {
+			t.Fatalf("Failed to connect to the stream: %s", err)
+		}
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "id: ") {
+				return strings.TrimPrefix(line, "id: ")
+			}
+		}
+		t.Fatalf("The stream ended without a command: %v", scanner.Err())
+		return ""
+	}
+
+	// The device disconnects without acknowledging, so it gets the command again.
+	for i := 0; i < 2; i++ {
+		if id := readCommandID(); id != command.ID.Hex() {
+			t.Errorf("Connection %d: Expected command %s, got %s", i, command.ID.Hex(), id)
+		}
+	}
+}
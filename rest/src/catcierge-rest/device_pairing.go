@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// DefaultDevicePairingTTL How long a pairing code can be used by default.
+const DefaultDevicePairingTTL = 10 * time.Minute
+
+// DeviceCredentialPrefix Starts every device credential, so they can be told apart from access tokens.
+const DeviceCredentialPrefix = "device-"
+
+// Pairing codes are typed in by hand, so they are short and leave out characters that look alike.
+const (
+	pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	pairingCodeLen      = 8
+)
+
+// ErrWrongDevice A device credential was used to act as another device.
+var ErrWrongDevice = errors.New("Device credentials can only be used for their own device")
+
+// DevicePairingCode A short lived code created by a member of an account,
+// which a catcierge unit trades for a device credential.
+type DevicePairingCode struct {
+	Code      string        `json:"code" bson:"_id"`
+	AccountID bson.ObjectId `json:"account_id" bson:"account_id"` // The account the device is paired with.
+	Created   time.Time     `json:"created" bson:"created"`
+	Expires   time.Time     `json:"expires" bson:"expires"`
+}
+
+// DevicePairRequest The body sent by a device to trade a pairing code for a credential.
+type DevicePairRequest struct {
+	Code     string `json:"code"`
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"` // Only used if the device is new.
+}
+
+// DeviceCredential A credential that lets a device upload events, send heartbeats, receive
+// commands and fetch its settings, used as an access token. It is only shown when the device is paired.
+type DeviceCredential struct {
+	DeviceID  string        `json:"device_id"`
+	AccountID bson.ObjectId `json:"account_id"`
+	Token     string        `json:"token"`
+}
+
+// newPairingCode Returns a new random pairing code.
+func newPairingCode() (string, error) {
+	b := make([]byte, pairingCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = pairingCodeAlphabet[int(b[i])%len(pairingCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// normalizePairingCode Makes a typed in pairing code comparable, ignoring case, spaces and dashes.
+func normalizePairingCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newDeviceCredential Returns a new random device credential.
+func newDeviceCredential() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return DeviceCredentialPrefix + hex.EncodeToString(b), nil
+}
+
+// HashDeviceCredential Returns the hash of a device credential, only the hash is stored.
+func HashDeviceCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeviceCredentialAllows Checks if a device credential can be used for a request, devices can only
+// upload events (directly or resumable), and send heartbeats, receive commands and fetch settings for themselves.
+// The upload handlers check that a resumable upload was created by the same device.
+func DeviceCredentialAllows(method string, urlPath string, deviceID string) bool {
+	p := path.Clean("/" + urlPath)
+	commands := "/devices/" + deviceID + "/commands/"
+
+	switch {
+	case p == "/events":
+		return method == "POST"
+	case p == "/uploads":
+		return method == "POST" || method == "OPTIONS"
+	case strings.HasPrefix(p, "/uploads/") && !strings.Contains(p[len("/uploads/"):], "/"):
+		return method == "HEAD" || method == "GET" || method == "PATCH" || method == "DELETE"
+	case p == "/devices/"+deviceID+"/heartbeat":
+		return method == "POST"
+	case p == "/devices/"+deviceID+"/settings":
+		return method == "GET"
+	case p == commands+"pending" || p == commands+"stream":
+		return method == "GET"
+	case strings.HasPrefix(p, commands) && strings.Count(p[len(commands):], "/") == 1 && strings.HasSuffix(p, "/ack"):
+		return method == "POST"
+	}
+
+	return false
+}
+
+// IsAuthorizedToPairDevices Checks if the request has the correct authorization to create
+// pairing codes, only the members of an account can, not its devices. Accounts don't have
+// roles yet, so every member is allowed to, this is the place to check for an admin role.
+func IsAuthorizedToPairDevices(request *restful.Request, response *restful.Response) (*AuthenticationState, error) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		return authState, err
+	}
+
+	if authState.User == nil {
+		WriteCatciergeErrorString(response, http.StatusForbidden,
+			"You must be logged in as a user to pair devices")
+		return authState, errors.New("Not logged in as a user")
+	}
+
+	return authState, nil
+}
+
+func (dv *DevicesResource) createPairingCode(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedToPairDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	code := DevicePairingCode{
+		AccountID: authState.Account.ID,
+		Created:   now,
+		Expires:   now.Add(dv.settings.devicePairingTTL)}
+
+	// Try again in the unlikely case the code is already in use.
+	for attempt := 0; attempt < 3; attempt++ {
+		if code.Code, err = newPairingCode(); err != nil {
+			break
+		}
+		if err = dv.store.InsertPairingCode(&code); err != ErrDuplicate {
+			break
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed to create pairing code: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusCreated, code)
+}
+
+func (dv *DevicesResource) pairDevice(request *restful.Request, response *restful.Response) {
+	var r DevicePairRequest
+	if err := request.ReadEntity(&r); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid pairing request: %s", err))
+		return
+	}
+
+	var problems []string
+	if r.Code == "" {
+		problems = append(problems, "Missing 'code'")
+	}
+	problems = append(problems, (&DeviceRequest{ID: r.DeviceID, Name: r.Name}).Validate(true)...)
+
+	if len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid pairing request", problems)
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	// The code is used up even if pairing fails, so it can't be guessed at.
+	code, err := dv.store.TakePairingCode(normalizePairingCode(r.Code))
+	if err == nil && !now.Before(code.Expires) {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusUnauthorized, "Invalid or expired pairing code")
+		} else {
+			log.Printf("Failed to get pairing code: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	device, created, err := dv.getOrCreateDevice(code.AccountID, r.DeviceID, now)
+	if created {
+		device.Name = r.Name
+	}
+
+	if err != nil {
+		log.Printf("Failed to get device %s: %s", r.DeviceID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Pairing again replaces the old credential.
+	credential, err := newDeviceCredential()
+	if err != nil {
+		log.Printf("Failed to create credential for device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	device.CredentialHash = HashDeviceCredential(credential)
+	device.Paired = now
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		log.Printf("Failed to update device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	log.Printf("Paired device %s\n", device.ID)
+	response.WriteHeaderAndEntity(http.StatusCreated, DeviceCredential{
+		DeviceID:  device.ID,
+		AccountID: device.AccountID,
+		Token:     credential})
+}
+
+func (dv *DevicesResource) revokeDeviceCredential(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedToPairDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	device.CredentialHash = ""
+	device.Paired = time.Time{}
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		log.Printf("Failed to update device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	log.Printf("Revoked the credential of device %s\n", device.ID)
+	response.WriteHeader(http.StatusNoContent)
+}
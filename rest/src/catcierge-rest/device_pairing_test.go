@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestDeviceCredentialAllows(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		allows bool
+	}{
+		{"POST", "/events", true},
+		{"GET", "/events", false},
+		{"POST", "/uploads", true},
+		{"OPTIONS", "/uploads", true},
+		{"GET", "/uploads", false},
+		{"PATCH", "/uploads/abc", true},
+		{"HEAD", "/uploads/abc", true},
+		{"DELETE", "/uploads/abc", true},
+		{"POST", "/uploads/abc", false},
+		{"GET", "/uploads/abc/data", false},
+		{"POST", "/devices/door/heartbeat", true},
+		{"POST", "/devices/window/heartbeat", false},
+		{"GET", "/devices/door/settings", true},
+		{"PUT", "/devices/door/settings", false},
+		{"GET", "/devices/door/commands/pending", true},
+		{"GET", "/devices/door/commands/stream", true},
+		{"GET", "/devices/door/commands", false},
+		{"POST", "/devices/door/commands", false},
+		{"POST", "/devices/door/commands/123/ack", true},
+		{"POST", "/devices/door/commands/123/456/ack", false},
+		{"POST", "/devices/window/commands/123/ack", false},
+		{"POST", "/devices/door/../window/heartbeat", false},
+		{"GET", "/devices/door", false},
+		{"GET", "/accounts", false},
+	}
+
+	for _, tc := range tests {
+		if allows := DeviceCredentialAllows(tc.method, tc.path, "door"); allows != tc.allows {
+			t.Errorf("Expected %s %s to be allowed: %v, got %v", tc.method, tc.path, tc.allows, allows)
+		}
+	}
+}
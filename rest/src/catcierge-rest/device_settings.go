@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// How the settings reported by a device compare to its desired settings.
+const (
+	DeviceSettingsInSync  = "in_sync"
+	DeviceSettingsDrifted = "drifted"
+)
+
+// Values accepted by catcierge for some of the settings.
+var (
+	deviceSettingsMatchers       = []string{"template", "haar"}
+	deviceSettingsDirections     = []string{"left", "right"}
+	deviceSettingsPreyMethods    = []string{"adaptive", "normal"}
+	deviceSettingsLockoutMethods = []int{1, 2, 3} // Obstruct then timer, obstruct or timer, timer only.
+)
+
+// maxOkMatchesNeeded The most matches catcierge makes in a match group.
+const maxOkMatchesNeeded = 4
+
+// DeviceSettings The desired settings of a device, and how the settings it
+// last reported compare to them.
+type DeviceSettings struct {
+	DeviceID string              `json:"device_id"`
+	Desired  *CatEventSettingsV1 `json:"desired"`  // Null if none are set.
+	Reported *CatEventSettingsV1 `json:"reported"` // As of the last event, null until one is uploaded.
+	Status   string              `json:"status,omitempty"`
+	Drift    []string            `json:"drift,omitempty"`
+	Changed  time.Time           `json:"changed"` // When the desired settings were last changed.
+}
+
+// settingsFieldNames Returns the JSON names of the fields of a settings struct.
+func settingsFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return names
+}
+
+// checkSettingsFields Returns the problems with the fields in a settings JSON object, all
+// known fields must be given and no others. Nested settings are checked the same way.
+func checkSettingsFields(t reflect.Type, fields map[string]json.RawMessage, prefix string) []string {
+	var problems []string
+
+	known := make(map[string]bool)
+	for i, name := range settingsFieldNames(t) {
+		known[name] = true
+
+		raw, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("Missing '%s%s'", prefix, name))
+			continue
+		}
+
+		if ft := t.Field(i).Type; ft.Kind() == reflect.Struct {
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &nested); err != nil {
+				problems = append(problems, fmt.Sprintf("Expected '%s%s' to be an object", prefix, name))
+				continue
+			}
+			problems = append(problems, checkSettingsFields(ft, nested, prefix+name+".")...)
+		}
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("Unknown setting '%s%s'", prefix, name))
+	}
+
+	return problems
+}
+
+// validateSettings Returns the problems with the values of settings, if any.
+func validateSettings(s *CatEventSettingsV1) []string {
+	var problems []string
+
+	oneOf := func(name string, value string, valid []string) {
+		for _, v := range valid {
+			if value == v {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("Invalid '%s' '%s', expected one of: %s", name, value, strings.Join(valid, ", ")))
+	}
+
+	atLeast := func(name string, value float64, min float64) {
+		if value < min {
+			problems = append(problems, fmt.Sprintf("The '%s' must be at least %v", name, min))
+		}
+	}
+
+	flag := func(name string, value int) {
+		if value != 0 && value != 1 {
+			problems = append(problems, fmt.Sprintf("The '%s' must be 0 or 1", name))
+		}
+	}
+
+	oneOf("matcher", s.Matcher, deviceSettingsMatchers)
+
+	validMethod := false
+	for _, m := range deviceSettingsLockoutMethods {
+		validMethod = validMethod || s.LockoutMethod == m
+	}
+	if !validMethod {
+		problems = append(problems, fmt.Sprintf("Invalid 'lockout_method' %d, expected 1, 2 or 3", s.LockoutMethod))
+	}
+
+	if s.OkMatchesNeeded < 1 || s.OkMatchesNeeded > maxOkMatchesNeeded {
+		problems = append(problems, fmt.Sprintf("The 'ok_matches_needed' must be between 1 and %d", maxOkMatchesNeeded))
+	}
+
+	atLeast("lockout_error", float64(s.LockoutError), 0)
+	atLeast("lockout_error_delay", float64(s.LockoutErrorDelay), 0)
+	atLeast("lockout_time", float64(s.LockoutTime), 0)
+	atLeast("matchtime", float64(s.Matchtime), 0)
+	flag("no_final_decision", s.NoFinalDecision)
+
+	// The haar matcher settings are only used by the haar matcher, but are still
+	// reported by the template matcher, so they are always checked.
+	h := &s.HaarMatcher
+	if s.Matcher == "haar" && h.Cascade == "" {
+		problems = append(problems, "The haar matcher needs a 'haar_matcher.cascade'")
+	}
+	oneOf("haar_matcher.in_direction", h.InDirection, deviceSettingsDirections)
+	oneOf("haar_matcher.prey_method", h.PreyMethod, deviceSettingsPreyMethods)
+	atLeast("haar_matcher.min_size_width", float64(h.MinSizeWidth), 1)
+	atLeast("haar_matcher.min_size_height", float64(h.MinSizeHeight), 1)
+	atLeast("haar_matcher.prey_steps", float64(h.PreySteps), 1)
+	flag("haar_matcher.eq_histogram", h.EqHistogram)
+	flag("haar_matcher.no_match_is_fail", h.NoMatchIsFail)
+
+	return problems
+}
+
+// settingsDrift Returns the names of the settings that differ between two settings structs.
+func settingsDrift(desired reflect.Value, reported reflect.Value, prefix string) []string {
+	var drift []string
+
+	names := settingsFieldNames(desired.Type())
+	for i, name := range names {
+		d, r := desired.Field(i), reported.Field(i)
+		if d.Kind() == reflect.Struct {
+			drift = append(drift, settingsDrift(d, r, prefix+name+".")...)
+		} else if d.Interface() != r.Interface() {
+			drift = append(drift, prefix+name)
+		}
+	}
+
+	return drift
+}
+
+// checkSettings Compares the settings the device reported to its desired settings. The
+// status is empty if there are no desired settings, or nothing has been reported yet.
+func (d *Device) checkSettings() {
+	d.SettingsStatus = ""
+	d.SettingsDrift = nil
+
+	if d.DesiredSettings == nil || d.Settings == nil {
+		return
+	}
+
+	d.SettingsDrift = settingsDrift(reflect.ValueOf(*d.DesiredSettings), reflect.ValueOf(*d.Settings), "")
+	if len(d.SettingsDrift) > 0 {
+		d.SettingsStatus = DeviceSettingsDrifted
+	} else {
+		d.SettingsStatus = DeviceSettingsInSync
+	}
+}
+
+// deviceSettings Returns the settings view of a device.
+func deviceSettings(d *Device) *DeviceSettings {
+	return &DeviceSettings{
+		DeviceID: d.ID,
+		Desired:  d.DesiredSettings,
+		Reported: d.Settings,
+		Status:   d.SettingsStatus,
+		Drift:    d.SettingsDrift,
+		Changed:  d.DesiredSettingsChanged}
+}
+
+// readDesiredSettings Reads and validates the settings in the request body, writing an error response if they are invalid.
+func readDesiredSettings(request *restful.Request, response *restful.Response) (*CatEventSettingsV1, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(request.Request.Body).Decode(&fields); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid settings: %s", err))
+		return nil, false
+	}
+
+	if problems := checkSettingsFields(reflect.TypeOf(CatEventSettingsV1{}), fields, ""); len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid settings", problems)
+		return nil, false
+	}
+
+	// Only the types are left to check, the fields are known to be right.
+	b, _ := json.Marshal(fields)
+
+	var s CatEventSettingsV1
+	if err := json.Unmarshal(b, &s); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid settings: %s", err))
+		return nil, false
+	}
+
+	if problems := validateSettings(&s); len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid settings", problems)
+		return nil, false
+	}
+
+	return &s, true
+}
+
+func (dv *DevicesResource) getDeviceSettings(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	response.WriteEntity(deviceSettings(device))
+}
+
+func (dv *DevicesResource) updateDeviceSettings(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	settings, ok := readDesiredSettings(request, response)
+	if !ok {
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	device.DesiredSettings = settings
+	device.DesiredSettingsChanged = time.Now().UTC().Truncate(time.Millisecond)
+	device.checkSettings()
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		log.Printf("Failed to update device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	log.Printf("Changed the desired settings of device %s\n", device.ID)
+	response.WriteEntity(deviceSettings(device))
+}
+
+func (dv *DevicesResource) deleteDeviceSettings(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	device.DesiredSettings = nil
+	device.DesiredSettingsChanged = time.Now().UTC().Truncate(time.Millisecond)
+	device.checkSettings()
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		log.Printf("Failed to update device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
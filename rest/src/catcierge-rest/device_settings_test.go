@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testSettings Returns valid settings for the haar matcher.
+func testSettings() CatEventSettingsV1 {
+	return CatEventSettingsV1{
+		HaarMatcher: CatEventHaarMatcherSettingsV1{
+			Cascade:       "/etc/catcierge/catcierge.xml",
+			InDirection:   "right",
+			MinSizeHeight: 80,
+			MinSizeWidth:  80,
+			PreyMethod:    "adaptive",
+			PreySteps:     2,
+		},
+		LockoutMethod:   1,
+		LockoutTime:     30,
+		Matcher:         "haar",
+		Matchtime:       10,
+		OkMatchesNeeded: 2,
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(s *CatEventSettingsV1)
+		problems int
+	}{
+		{"valid", func(s *CatEventSettingsV1) {}, 0},
+		{"template without cascade", func(s *CatEventSettingsV1) { s.Matcher = "template"; s.HaarMatcher.Cascade = "" }, 0},
+		{"haar without cascade", func(s *CatEventSettingsV1) { s.HaarMatcher.Cascade = "" }, 1},
+		{"unknown matcher", func(s *CatEventSettingsV1) { s.Matcher = "magic" }, 1},
+		{"lockout method", func(s *CatEventSettingsV1) { s.LockoutMethod = 4 }, 1},
+		{"too few ok matches", func(s *CatEventSettingsV1) { s.OkMatchesNeeded = 0 }, 1},
+		{"too many ok matches", func(s *CatEventSettingsV1) { s.OkMatchesNeeded = 5 }, 1},
+		{"negative lockout time", func(s *CatEventSettingsV1) { s.LockoutTime = -1 }, 1},
+		{"flag", func(s *CatEventSettingsV1) { s.NoFinalDecision = 2 }, 1},
+		{"in direction", func(s *CatEventSettingsV1) { s.HaarMatcher.InDirection = "up" }, 1},
+		{"prey method", func(s *CatEventSettingsV1) { s.HaarMatcher.PreyMethod = "guess" }, 1},
+		{"min size", func(s *CatEventSettingsV1) { s.HaarMatcher.MinSizeWidth = 0; s.HaarMatcher.MinSizeHeight = 0 }, 2},
+		{"empty", func(s *CatEventSettingsV1) { *s = CatEventSettingsV1{} }, 8},
+	}
+
+	for _, tc := range tests {
+		s := testSettings()
+		tc.change(&s)
+
+		if problems := validateSettings(&s); len(problems) != tc.problems {
+			t.Errorf("%s: Expected %d problems, got %d: %v", tc.name, tc.problems, len(problems), problems)
+		}
+	}
+}
+
+func TestSettingsDrift(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *CatEventSettingsV1)
+		drift  []string
+	}{
+		{"in sync", func(s *CatEventSettingsV1) {}, nil},
+		{"top level", func(s *CatEventSettingsV1) { s.LockoutTime = 60 }, []string{"lockout_time"}},
+		{"nested", func(s *CatEventSettingsV1) { s.HaarMatcher.Cascade = "other.xml" }, []string{"haar_matcher.cascade"}},
+		{"both", func(s *CatEventSettingsV1) { s.Matcher = "template"; s.HaarMatcher.PreySteps = 3 },
+			[]string{"haar_matcher.prey_steps", "matcher"}},
+	}
+
+	for _, tc := range tests {
+		desired, reported := testSettings(), testSettings()
+		tc.change(&reported)
+
+		drift := settingsDrift(reflect.ValueOf(desired), reflect.ValueOf(reported), "")
+		if !reflect.DeepEqual(drift, tc.drift) {
+			t.Errorf("%s: Expected drift %v, got %v", tc.name, tc.drift, drift)
+		}
+	}
+}
+
+func TestCheckSettingsFields(t *testing.T) {
+	valid, err := json.Marshal(testSettings())
+	if err != nil {
+		t.Fatalf("Failed to encode settings: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(fields map[string]interface{})
+		problems []string
+	}{
+		{"valid", func(fields map[string]interface{}) {}, nil},
+		{"missing", func(fields map[string]interface{}) {
+			delete(fields, "matcher")
+		}, []string{"Missing 'matcher'"}},
+		{"unknown", func(fields map[string]interface{}) {
+			fields["zzz"] = 1
+			fields["aaa"] = 2
+		}, []string{"Unknown setting 'aaa'", "Unknown setting 'zzz'"}},
+		{"nested", func(fields map[string]interface{}) {
+			haar := fields["haar_matcher"].(map[string]interface{})
+			delete(haar, "cascade")
+			haar["extra"] = true
+		}, []string{"Missing 'haar_matcher.cascade'", "Unknown setting 'haar_matcher.extra'"}},
+		{"not an object", func(fields map[string]interface{}) {
+			fields["haar_matcher"] = "haar"
+		}, []string{"Expected 'haar_matcher' to be an object"}},
+	}
+
+	for _, tc := range tests {
+		var fields map[string]interface{}
+		json.Unmarshal(valid, &fields)
+		tc.change(fields)
+
+		b, _ := json.Marshal(fields)
+		var raw map[string]json.RawMessage
+		json.Unmarshal(b, &raw)
+
+		if problems := checkSettingsFields(reflect.TypeOf(CatEventSettingsV1{}), raw, ""); !reflect.DeepEqual(problems, tc.problems) {
+			t.Errorf("%s: Expected %v, got %v", tc.name, tc.problems, problems)
+		}
+	}
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// Device status transitions, these are also the webhook event types sent for them.
+const (
+	DeviceOffline = "device_offline"
+	DeviceOnline  = "device_online"
+)
+
+// DefaultDeviceGracePeriod How long a device can go without a heartbeat before it is offline.
+const DefaultDeviceGracePeriod = 5 * time.Minute
+
+// maxDeviceNameLen The longest name a device can be given.
+const maxDeviceNameLen = 128
+
+// deviceIDPattern What a device ID may look like, it is chosen by the device.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Device A catcierge unit. It is registered explicitly, or created the first
+// time it sends a heartbeat or uploads an event. The ID is chosen by the device,
+// so it is only unique within the account that owns the device.
+type Device struct {
+	Key           string              `json:"-" xml:"-" bson:"_id"` // The key it is stored under, see DeviceKey.
+	ID            string              `json:"id" bson:"device_id"`
+	AccountID     bson.ObjectId       `json:"account_id,omitempty" bson:"account_id,omitempty"` // The account that owns the device.
+	Name          string              `json:"name" bson:"name"`
+	Version       string              `json:"version" bson:"version"` // Catcierge version, as last reported in a heartbeat or event.
+	GitHash       string              `json:"git_hash" bson:"git_hash"`
+	GitHashShort  string              `json:"git_hash_short" bson:"git_hash_short"`
+	GitTainted    int                 `json:"git_tainted" bson:"git_tainted"`
+	CatciergeType string              `json:"catcierge_type" bson:"catcierge_type"`
+	Settings      *CatEventSettingsV1 `json:"settings,omitempty" bson:"settings,omitempty"` // As of the last event.
+	EventCount    int                 `json:"event_count" bson:"event_count"`               // Number of events uploaded by the device.
+	Uptime        int64               `json:"uptime" bson:"uptime"`                         // Seconds, as of the last heartbeat.
+	FirstSeen     time.Time           `json:"first_seen" bson:"first_seen"`                 // The first heartbeat or event, zero until then.
+	LastSeen      time.Time           `json:"last_seen" bson:"last_seen"`
+	LastHeartbeat time.Time           `json:"last_heartbeat" bson:"last_heartbeat"`
+	Online        bool                `json:"online" bson:"online"`
+	StatusChanged time.Time           `json:"status_changed" bson:"status_changed"` // When the device last went offline or online.
+	Paired        time.Time           `json:"paired" bson:"paired"`                 // When the device credential was issued, zero if it has none.
+	Created       time.Time           `json:"created" bson:"created"`
+
+	DesiredSettings        *CatEventSettingsV1 `json:"desired_settings,omitempty" bson:"desired_settings,omitempty"`
+	DesiredSettingsChanged time.Time           `json:"desired_settings_changed" bson:"desired_settings_changed"`
+	SettingsStatus         string              `json:"settings_status,omitempty" bson:"settings_status,omitempty"` // If the reported settings are in sync with the desired ones.
+	SettingsDrift          []string            `json:"settings_drift,omitempty" bson:"settings_drift,omitempty"`   // The settings that differ from the desired ones.
+
+	CredentialHash string `json:"-" xml:"-" bson:"credential_hash,omitempty"` // Hash of the device credential.
+}
+
+// DeviceKey Returns the key a device of an account is stored under.
+func DeviceKey(accountID bson.ObjectId, id string) string {
+	return accountID.Hex() + "/" + id
+}
+
+// newDevice Creates a new device owned by an account.
+func newDevice(accountID bson.ObjectId, id string, now time.Time) *Device {
+	return &Device{
+		Key:           DeviceKey(accountID, id),
+		ID:            id,
+		AccountID:     accountID,
+		StatusChanged: now,
+		Created:       now}
+}
+
+// seen Records that the device was heard from.
+func (d *Device) seen(now time.Time) {
+	if d.FirstSeen.IsZero() {
+		d.FirstSeen = now
+	}
+	d.LastSeen = now
+}
+
+// DeviceRequest The body used to register or rename a device.
+type DeviceRequest struct {
+	ID   string `json:"id"` // Only used when registering.
+	Name string `json:"name"`
+}
+
+// Validate Returns the problems with a device request, if any.
+func (r *DeviceRequest) Validate(register bool) []string {
+	var problems []string
+
+	if register && !deviceIDPattern.MatchString(r.ID) {
+		problems = append(problems, invalidDeviceIDMessage(r.ID))
+	}
+
+	if len(r.Name) > maxDeviceNameLen {
+		problems = append(problems, fmt.Sprintf("The 'name' can be at most %d characters", maxDeviceNameLen))
+	}
+
+	return problems
+}
+
+// invalidDeviceIDMessage Returns the error message for an invalid device ID.
+func invalidDeviceIDMessage(id string) string {
+	return fmt.Sprintf("Invalid device ID '%s', expected up to 64 letters, digits, '_', '.' or '-'", id)
+}
+
+// DeviceListResponse A response returned when listing devices.
+type DeviceListResponse struct {
+	ListResponseHeader
+	Items []Device `json:"items"`
+}
+
+// DeviceTransition A logged change of a device going offline or coming back online.
+type DeviceTransition struct {
+	ID            bson.ObjectId `json:"id" bson:"_id"`
+	DeviceKey     string        `json:"-" xml:"-" bson:"device_key"`
+	DeviceID      string        `json:"device_id" bson:"device_id"`
+	Type          string        `json:"type" bson:"type"`
+	Time          time.Time     `json:"time" bson:"time"`
+	LastHeartbeat time.Time     `json:"last_heartbeat" bson:"last_heartbeat"`
+}
+
+// DeviceHeartbeat The body of a heartbeat sent by a device.
+type DeviceHeartbeat struct {
+	Uptime  int64  `json:"uptime"` // Seconds since the device started.
+	Version string `json:"version"`
+}
+
+// DeviceTransitionListResponse A response returned when listing the transitions of a device.
+type DeviceTransitionListResponse struct {
+	ListResponseHeader
+	Items []DeviceTransition `json:"items"`
+}
+
+// DevicesResource The catcierge units that send events and heartbeats.
+type DevicesResource struct {
+	CatciergeResource
+	mutex    sync.Mutex         // Serializes changes to devices and their commands.
+	webhooks *WebhookDispatcher // Notified about status changes, if set.
+
+	waitersMutex sync.Mutex
+	waiters      map[string]map[chan struct{}]bool // Device key -> requests waiting for commands.
+}
+
+// FromDevicesContext returns the DevicesResource in ctx, if any.
+func FromDevicesContext(ctx context.Context) (*DevicesResource, bool) {
+	dv, ok := ctx.Value(devicesKey).(*DevicesResource)
+	return dv, ok
+}
+
+// AddContext add DevicesResource to the context.
+func (dv *DevicesResource) AddContext(c *context.Context) context.Context {
+	return context.WithValue(*c, devicesKey, dv)
+}
+
+// NewDevicesResource create a new DevicesResource
+func NewDevicesResource(store CatciergeStore, settings *CatSettings) *DevicesResource {
+	return &DevicesResource{
+		CatciergeResource: CatciergeResource{store: store, settings: settings},
+		waiters:           make(map[string]map[chan struct{}]bool)}
+}
+
+// Register DevicesResource resource end points.
+func (dv *DevicesResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	deviceID := ws.PathParameter("device-id", "Device ID").DataType("string")
+	commandID := ws.PathParameter("command-id", "Command ID").DataType("string")
+
+	ws.Path("/devices").
+		Doc("Manage catcierge devices").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON, restful.MIME_XML)
+
+	ws.Route(ws.GET("/").To(dv.listDevices).
+		Doc("List the devices of the account").
+		Do(AddListRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", DeviceListResponse{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceListResponse{}))
+
+	ws.Route(ws.POST("").To(dv.createDevice).
+		Doc("Register a device with the account, devices are also created on their first heartbeat or upload").
+		Reads(DeviceRequest{}).
+		Do(ReturnsStatus(http.StatusCreated, "", Device{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusConflict),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.POST("/pairing/codes").To(dv.createPairingCode).
+		Doc(fmt.Sprintf("Create a pairing code that a device can trade for a credential, it can be used once within %s by default",
+			DefaultDevicePairingTTL)).
+		Do(ReturnsStatus(http.StatusCreated, "", DevicePairingCode{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.POST("/pairing/credentials").To(dv.pairDevice).
+		Doc("Trade a pairing code for a device credential, used by the device without logging in. "+
+			"The device is created if it doesn't exist, and its old credential is replaced. "+
+			"The credential can only be used to upload events, send heartbeats, receive commands and fetch its settings").
+		Reads(DevicePairRequest{}).
+		Do(ReturnsStatus(http.StatusCreated, "", DeviceCredential{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{device-id}").To(dv.getDevice).
+		Doc("Get a device, including if it is online").
+		Param(deviceID).
+		Do(ReturnsStatus(http.StatusOK, "", Device{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(Device{}))
+
+	ws.Route(ws.PUT("/{device-id}").To(dv.updateDevice).
+		Doc("Rename a device").
+		Param(deviceID).
+		Reads(DeviceRequest{}).
+		Do(ReturnsStatus(http.StatusOK, "", Device{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.DELETE("/{device-id}").To(dv.deleteDevice).
+		Doc("Delete a device and its transition log, its events are kept").
+		Param(deviceID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.DELETE("/{device-id}/credential").To(dv.revokeDeviceCredential).
+		Doc("Revoke the credential of a device, it has to be paired again").
+		Param(deviceID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.POST("/{device-id}/heartbeat").To(dv.heartbeat).
+		Doc(fmt.Sprintf("Tell that a device is running, the device is created on its first heartbeat. "+
+			"Devices that miss heartbeats for longer than the grace period (%s by default) go offline",
+			DefaultDeviceGracePeriod)).
+		Param(deviceID).
+		Reads(DeviceHeartbeat{}).
+		Do(ReturnsStatus(http.StatusOK, "", Device{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{device-id}/transitions").To(dv.listDeviceTransitions).
+		Doc("List when a device went offline and came back online, newest first").
+		Param(deviceID).
+		Do(AddListRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", DeviceTransitionListResponse{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceTransitionListResponse{}))
+
+	ws.Route(ws.GET("/{device-id}/settings").To(dv.getDeviceSettings).
+		Doc("Get the desired settings of a device and if the settings it reported in its last event are in sync with them, "+
+			"also used by the device to fetch its desired settings").
+		Param(deviceID).
+		Do(ReturnsStatus(http.StatusOK, "", DeviceSettings{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceSettings{}))
+
+	ws.Route(ws.PUT("/{device-id}/settings").To(dv.updateDeviceSettings).
+		Doc("Set the desired settings of a device, all the settings of an event must be given. "+
+			"The settings reported in each event are then compared to them").
+		Param(deviceID).
+		Reads(CatEventSettingsV1{}).
+		Do(ReturnsStatus(http.StatusOK, "", DeviceSettings{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.DELETE("/{device-id}/settings").To(dv.deleteDeviceSettings).
+		Doc("Remove the desired settings of a device, its settings are no longer checked").
+		Param(deviceID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{device-id}/commands").To(dv.listDeviceCommands).
+		Doc("List the commands queued for a device and what became of them, newest first").
+		Param(deviceID).
+		Do(AddListRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", DeviceCommandListResponse{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceCommandListResponse{}))
+
+	ws.Route(ws.POST("/{device-id}/commands").To(dv.createDeviceCommand).
+		Doc(fmt.Sprintf("Queue a command for a device: %s. A lockout takes the number of minutes. "+
+			"The command expires unless it is acknowledged within %s by default",
+			strings.Join(DeviceCommandTypes, ", "), DefaultDeviceCommandTTL)).
+		Param(deviceID).
+		Reads(DeviceCommandRequest{}).
+		Do(ReturnsStatus(http.StatusCreated, "", DeviceCommand{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{device-id}/commands/pending").To(dv.pollDeviceCommands).
+		Doc("Fetch the queued commands of a device, only the device itself can do this using its credential. "+
+			"Waits for a command to be queued if there are none. The commands must be acknowledged, until then they are delivered again each time they are fetched, "+
+			"so skip the ones already carried out").
+		Param(deviceID).
+		Param(ws.QueryParameter("wait", fmt.Sprintf("Seconds to wait for a command, at most %d",
+			int(maxDeviceCommandWait/time.Second))).DataType("integer").DefaultValue(strconv.Itoa(int(defaultDeviceCommandWait/time.Second)))).
+		Do(ReturnsStatus(http.StatusOK, "", DeviceCommandListResponse{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceCommandListResponse{}))
+
+	ws.Route(ws.GET("/{device-id}/commands/stream").To(dv.streamDeviceCommands).
+		Doc("Get the commands of a device as they are queued, as Server-Sent Events of type 'command'. "+
+			"Used by the device instead of polling, using its credential. The commands must be acknowledged, "+
+			"until then they are sent again each time the device connects, so skip the ones already carried out").
+		Param(deviceID).
+		Produces("text/event-stream").
+		Do(ReturnsStatus(http.StatusOK, "", DeviceCommand{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{device-id}/commands/{command-id}").To(dv.getDeviceCommand).
+		Doc("Get a command, including its state history").
+		Param(deviceID).
+		Param(commandID).
+		Do(ReturnsStatus(http.StatusOK, "", DeviceCommand{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(DeviceCommand{}))
+
+	ws.Route(ws.POST("/{device-id}/commands/{command-id}/ack").To(dv.ackDeviceCommand).
+		Doc("Acknowledge that a delivered command was carried out, only the device itself can do this using its credential. "+
+			"Giving an error marks the command as failed").
+		Param(deviceID).
+		Param(commandID).
+		Reads(DeviceCommandAck{}).
+		Do(ReturnsStatus(http.StatusOK, "", DeviceCommand{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusConflict),
+			ReturnsError(http.StatusInternalServerError)))
+
+	container.Add(ws)
+}
+
+// IsAuthorizedForDevices Checks if the request has the correct authorization to handle devices.
+func IsAuthorizedForDevices(request *restful.Request, response *restful.Response) (*AuthenticationState, error) {
+	authState, ok := FromAuthStateContext(request.Request.Context())
+	if !ok {
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return nil, errors.New("Failed to get authentication state from request context")
+	}
+
+	if !authState.IsAuthenticated {
+		WriteCatciergeErrorString(response, http.StatusUnauthorized,
+			"You must be logged in to manage devices")
+		return authState, errors.New("Unauthenticated user")
+	}
+
+	if authState.Account == nil {
+		WriteCatciergeErrorString(response, http.StatusUnauthorized,
+			"You must be logged in to an account to manage devices")
+		return authState, errors.New("User not member of any account")
+	}
+
+	return authState, nil
+}
+
+// getRequestDevice Gets the device of the account given by the device-id path
+// parameter, writing an error response if it can't be found.
+func (dv *DevicesResource) getRequestDevice(request *restful.Request, response *restful.Response, authState *AuthenticationState) (*Device, bool) {
+	id := request.PathParameter("device-id")
+
+	device, err := dv.store.GetDevice(DeviceKey(authState.Account.ID, id))
+	if err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Device '%s' could not be found", id))
+		} else {
+			log.Printf("Failed to get device %s: %s", id, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return nil, false
+	}
+
+	return device, true
+}
+
+// readDeviceRequest Reads and validates the device in the request body, writing an error response if it is invalid.
+func readDeviceRequest(request *restful.Request, response *restful.Response, register bool) (*DeviceRequest, bool) {
+	var r DeviceRequest
+	if err := request.ReadEntity(&r); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid device: %s", err))
+		return nil, false
+	}
+
+	if problems := r.Validate(register); len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid device", problems)
+		return nil, false
+	}
+
+	return &r, true
+}
+
+// CheckEventDevice Checks that an event can be uploaded from a device, writing an error
+// response if not. Devices belong to an account, so an account is needed to upload from
+// one. Devices that don't exist yet are created when the event is recorded.
+func CheckEventDevice(response *restful.Response, deviceID string, accountID bson.ObjectId) bool {
+	if !deviceIDPattern.MatchString(deviceID) {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, invalidDeviceIDMessage(deviceID))
+		return false
+	}
+
+	if accountID == "" {
+		WriteCatciergeErrorString(response, http.StatusBadRequest,
+			"You must be logged in to an account to upload events from a device")
+		return false
+	}
+
+	return true
+}
+
+// getOrCreateDevice Gets a device of an account, creating it if it doesn't exist. Must hold the lock.
+func (dv *DevicesResource) getOrCreateDevice(accountID bson.ObjectId, id string, now time.Time) (*Device, bool, error) {
+	device, err := dv.store.GetDevice(DeviceKey(accountID, id))
+	if err != ErrNotFound {
+		return device, false, err
+	}
+
+	device = newDevice(accountID, id, now)
+	if err = dv.store.InsertDevice(device); err == ErrDuplicate {
+		// Registered at the same time, which doesn't hold the lock.
+		device, err = dv.store.GetDevice(device.Key)
+		return device, false, err
+	}
+	return device, err == nil, err
+}
+
+// RecordEvent Updates the device an event was uploaded from with the firmware and
+// settings it reported, and checks if the settings are as desired. The device is
+// created for the uploading account if needed.
+func (dv *DevicesResource) RecordEvent(e *CatEvent) error {
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, created, err := dv.getOrCreateDevice(e.AccountID, e.DeviceID, e.Created)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("Created device %s on its first upload", device.ID)
+	}
+
+	d := &e.Data
+	settings := d.Settings
+
+	device.Version = d.Version
+	device.GitHash = d.GitHash
+	device.GitHashShort = d.GitHashShort
+	device.GitTainted = d.GitTainted
+	device.CatciergeType = d.CatciergeType
+	device.Settings = &settings
+	device.EventCount++
+	device.seen(e.Created)
+
+	status := device.SettingsStatus
+	device.checkSettings()
+	if device.SettingsStatus != status && device.SettingsStatus != "" {
+		log.Printf("Settings of device %s are now %s %v", device.ID, device.SettingsStatus, device.SettingsDrift)
+	}
+
+	return dv.store.UpdateDevice(device)
+}
+
+// setStatus Marks a device as online or offline, logs the transition and notifies the
+// webhooks. Does nothing if the device already has that status. Must hold the lock.
+func (dv *DevicesResource) setStatus(device *Device, online bool, now time.Time) error {
+	if device.Online == online {
+		return nil
+	}
+
+	transition := DeviceTransition{
+		ID:            bson.NewObjectId(),
+		DeviceKey:     device.Key,
+		DeviceID:      device.ID,
+		Type:          DeviceOffline,
+		Time:          now,
+		LastHeartbeat: device.LastHeartbeat}
+
+	if online {
+		transition.Type = DeviceOnline
+	}
+
+	device.Online = online
+	device.StatusChanged = now
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		return err
+	}
+
+	if err := dv.store.InsertDeviceTransition(&transition); err != nil {
+		log.Printf("Failed to log device %s going %s: %s", device.ID, transition.Type, err)
+	}
+
+	log.Printf("Device %s is now %s", device.ID, transition.Type)
+
+	if dv.webhooks != nil {
+		d := *device
+		dv.webhooks.Notify(device.AccountID, &WebhookPayload{Type: transition.Type, Time: now, Device: &d})
+	}
+
+	return nil
+}
+
+// CheckOffline Marks the devices that have missed their heartbeats for longer than the grace period as offline.
+func (dv *DevicesResource) CheckOffline(now time.Time) error {
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	devices, err := dv.store.ListDevices("", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for i := range devices {
+		d := &devices[i]
+		if d.Online && now.Sub(d.LastHeartbeat) > dv.settings.deviceGracePeriod {
+			if err := dv.setStatus(d, false, now); err != nil {
+				log.Printf("Failed to mark device %s as offline: %s", d.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartOfflineChecker Starts checking for devices that have gone offline, the webhooks are notified
+// when they do. Expired commands and pairing codes are cleaned up at the same time.
+func (dv *DevicesResource) StartOfflineChecker(webhooks *WebhookDispatcher) {
+	dv.webhooks = webhooks
+
+	// Check often enough that a device is flagged soon after its grace period ends.
+	interval := dv.settings.deviceGracePeriod / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		for now := range time.Tick(interval) {
+			if err := dv.CheckOffline(now.UTC()); err != nil {
+				log.Printf("Failed to check for offline devices: %s", err)
+			}
+			if err := dv.ExpireCommands(now.UTC()); err != nil {
+				log.Printf("Failed to expire device commands: %s", err)
+			}
+			if err := dv.store.DeleteExpiredPairingCodes(now.UTC()); err != nil {
+				log.Printf("Failed to delete expired pairing codes: %s", err)
+			}
+		}
+	}()
+}
+
+func (dv *DevicesResource) listDevices(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	var l = DeviceListResponse{}
+	l.getListResponseParams(request)
+
+	if l.Count, err = dv.store.CountDevices(authState.Account.ID); err != nil {
+		log.Printf("Failed to count devices: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to get device count")
+		return
+	}
+
+	if l.Items, err = dv.store.ListDevices(authState.Account.ID, l.Offset, l.Limit); err != nil {
+		log.Printf("Failed to list devices: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list devices")
+		return
+	}
+
+	response.WriteEntity(l)
+}
+
+func (dv *DevicesResource) createDevice(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	r, ok := readDeviceRequest(request, response, true)
+	if !ok {
+		return
+	}
+
+	device := newDevice(authState.Account.ID, r.ID, time.Now().UTC().Truncate(time.Millisecond))
+	device.Name = r.Name
+
+	if err := dv.store.InsertDevice(device); err != nil {
+		if err == ErrDuplicate {
+			WriteCatciergeErrorString(response, http.StatusConflict, fmt.Sprintf("A device with this ID already exists: %s", r.ID))
+		} else {
+			log.Printf("Failed to insert device: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	log.Printf("Registered device %s\n", device.ID)
+	response.WriteHeaderAndEntity(http.StatusCreated, device)
+}
+
+func (dv *DevicesResource) getDevice(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	response.WriteEntity(device)
+}
+
+func (dv *DevicesResource) updateDevice(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	r, ok := readDeviceRequest(request, response, false)
+	if !ok {
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	device.Name = r.Name
+
+	if err := dv.store.UpdateDevice(device); err != nil {
+		log.Printf("Failed to update device %s: %s", device.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	response.WriteEntity(device)
+}
+
+func (dv *DevicesResource) deleteDevice(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	if err := dv.store.DeleteDevice(device.Key); err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Device '%s' could not be found", device.ID))
+		} else {
+			log.Printf("Failed to delete device %s: %s", device.ID, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	log.Printf("Deleted device %s\n", device.ID)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (dv *DevicesResource) heartbeat(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	id := request.PathParameter("device-id")
+	if !deviceIDPattern.MatchString(id) {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, invalidDeviceIDMessage(id))
+		return
+	}
+
+	// A heartbeat without a body is fine, the device is still alive.
+	var hb DeviceHeartbeat
+	if err := json.NewDecoder(request.Request.Body).Decode(&hb); err != nil && err != io.EOF {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid heartbeat: %s", err))
+		return
+	}
+
+	dv.mutex.Lock()
+	defer dv.mutex.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	device, _, err := dv.getOrCreateDevice(authState.Account.ID, id, now)
+	if err != nil {
+		log.Printf("Failed to get device %s: %s", id, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	device.Uptime = hb.Uptime
+	device.Version = hb.Version
+	device.LastHeartbeat = now
+	device.seen(now)
+
+	if device.Online {
+		err = dv.store.UpdateDevice(device)
+	} else {
+		err = dv.setStatus(device, true, now)
+	}
+
+	if err != nil {
+		log.Printf("Failed to update device %s: %s", id, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	response.WriteEntity(device)
+}
+
+func (dv *DevicesResource) listDeviceTransitions(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForDevices(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	device, ok := dv.getRequestDevice(request, response, authState)
+	if !ok {
+		return
+	}
+
+	var l = DeviceTransitionListResponse{}
+	l.getListResponseParams(request)
+
+	if l.Count, err = dv.store.CountDeviceTransitions(device.Key); err != nil {
+		log.Printf("Failed to count device transitions: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to get transition count")
+		return
+	}
+
+	if l.Items, err = dv.store.ListDeviceTransitions(device.Key, l.Offset, l.Limit); err != nil {
+		log.Printf("Failed to list device transitions: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list transitions")
+		return
+	}
+
+	response.WriteEntity(l)
+}
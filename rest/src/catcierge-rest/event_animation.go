@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// Frame delays for event animations, in milliseconds.
+const (
+	DefaultAnimationDelay = 500
+	MinAnimationDelay     = 20
+	MaxAnimationDelay     = 10000
+)
+
+// ErrNoAnimationFrames The event has no match images to animate.
+var ErrNoAnimationFrames = errors.New("The event has no match images")
+
+// grayPalette A palette with all 256 shades of gray. The catcierge images are
+// usually grayscale, which look a lot better with this than a general palette.
+var grayPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{uint8(i)}
+	}
+	return p
+}()
+
+// EventAnimationOptions How an event animation is made.
+type EventAnimationOptions struct {
+	Delay  int                 // Delay between frames in milliseconds.
+	Resize *ImageResizeOptions // Size of the frames, nil to keep the size of the images.
+}
+
+// ParseEventAnimationOptions Gets the animation options from the request query parameters.
+func ParseEventAnimationOptions(request *restful.Request) (*EventAnimationOptions, error) {
+	var err error
+	o := &EventAnimationOptions{Delay: DefaultAnimationDelay}
+
+	if s := request.QueryParameter("delay"); s != "" {
+		if o.Delay, err = strconv.Atoi(s); err != nil || o.Delay < MinAnimationDelay || o.Delay > MaxAnimationDelay {
+			return nil, fmt.Errorf("Invalid delay '%s', expected %d to %d milliseconds", s, MinAnimationDelay, MaxAnimationDelay)
+		}
+	}
+
+	if o.Resize, err = ParseImageResizeOptions(request); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// AddEventAnimationRequestParams Sets the query parameters for event animations.
+func AddEventAnimationRequestParams(ws *restful.WebService) func(b *restful.RouteBuilder) {
+	return func(b *restful.RouteBuilder) {
+		b.Param(ws.QueryParameter("delay", fmt.Sprintf("Delay between frames in milliseconds, %d to %d",
+			MinAnimationDelay, MaxAnimationDelay)).
+			DataType("int").DefaultValue(strconv.Itoa(DefaultAnimationDelay)))
+
+		AddImageResizeRequestParams(ws)(b)
+	}
+}
+
+// CacheName Returns the file name an animation is cached under.
+func (o *EventAnimationOptions) CacheName() string {
+	size := "full"
+	if o.Resize != nil {
+		size = fmt.Sprintf("%dx%d-%s", o.Resize.Width, o.Resize.Height, o.Resize.Fit)
+	}
+	return fmt.Sprintf("animation-%d-%s.gif", o.Delay, size)
+}
+
+// EventAnimationFrames Returns the paths of the match images of an event in time order.
+func EventAnimationFrames(eventDir string, e *CatEvent) ([]string, error) {
+	matches := make([]CatEventMatchV1, len(e.Data.Matches))
+	copy(matches, e.Data.Matches)
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Time.Before(matches[j].Time.Time)
+	})
+
+	var frames []string
+	for _, m := range matches {
+		if m.Path == "" || !isResizableImage(m.Path) {
+			continue
+		}
+
+		p, err := EventFilePath(eventDir, cleanArchiveName(m.Path))
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, p)
+	}
+
+	if len(frames) == 0 {
+		return nil, ErrNoAnimationFrames
+	}
+
+	return frames, nil
+}
+
+// isGrayImage Checks if all pixels of an image are gray.
+func isGrayImage(img *image.RGBA) bool {
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != img.Pix[i+1] || img.Pix[i] != img.Pix[i+2] {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildEventAnimation Builds an animated GIF from the given frame images.
+// All frames get the size of the first one.
+func BuildEventAnimation(frames []string, o *EventAnimationOptions) (*gif.GIF, error) {
+	anim := &gif.GIF{}
+	var frameSize *ImageResizeOptions
+
+	for _, name := range frames {
+		img, err := decodeImageFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode frame %s: %s", filepath.Base(name), err)
+		}
+
+		var rgba *image.RGBA
+
+		if frameSize == nil {
+			if o.Resize != nil {
+				img = ResizeImage(img, o.Resize)
+			}
+
+			b := img.Bounds()
+			rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+			frameSize = &ImageResizeOptions{Width: b.Dx(), Height: b.Dy(), Fit: FitCover}
+		} else {
+			w, h, src := frameSize.targetRects(img.Bounds())
+			rgba = scaleImage(img, src, w, h)
+		}
+
+		p := color.Palette(palette.Plan9)
+		if isGrayImage(rgba) {
+			p = grayPalette
+		}
+
+		frame := image.NewPaletted(rgba.Bounds(), p)
+		draw.FloydSteinberg.Draw(frame, frame.Bounds(), rgba, image.ZP)
+
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, o.Delay/10) // GIF delays are in 1/100s.
+	}
+
+	anim.Config = image.Config{
+		ColorModel: anim.Image[0].Palette,
+		Width:      frameSize.Width,
+		Height:     frameSize.Height}
+
+	return anim, nil
+}
+
+// WriteEventAnimation Builds an animated GIF of the frames and writes it to dst,
+// unless dst is already up to date.
+func WriteEventAnimation(frames []string, dst string, o *EventAnimationOptions) error {
+	if isCacheFresh(dst, frames...) {
+		return nil
+	}
+
+	anim, err := BuildEventAnimation(frames, o)
+	if err != nil {
+		return err
+	}
+
+	return writeCacheFile(dst, func(w io.Writer) error {
+		return gif.EncodeAll(w, anim)
+	})
+}
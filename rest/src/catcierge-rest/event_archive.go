@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CatArchiveError Lists the problems found when validating an event archive.
+type CatArchiveError struct {
+	Problems []string
+}
+
+func (e *CatArchiveError) Error() string {
+	return fmt.Sprintf("Invalid event archive: %s", strings.Join(e.Problems, "; "))
+}
+
+// CatArchiveTooLargeError Indicates that an event archive unpacks to more than the allowed size.
+type CatArchiveTooLargeError struct {
+	error
+}
+
+// CatArchiveLimitError Indicates that an event archive breaks one of the
+// EventArchiveLimits other than the size, such as the number of entries.
+type CatArchiveLimitError struct {
+	error
+}
+
+// Default limits for unpacking event archives.
+const (
+	DefaultMaxUnpackedEventSize     = 50 * MB
+	DefaultMaxEventEntries          = 1000
+	DefaultMaxEventCompressionRatio = 100
+	DefaultEventExtensions          = ".json,.png,.jpg,.jpeg"
+)
+
+// compressionRatioGrace Files smaller than this are never rejected because of their
+// compression ratio, a small JSON file can easily compress 100 times.
+const compressionRatioGrace = 64 * KB
+
+// EventArchiveLimits Limits for what we accept when unpacking an event archive,
+// so that a broken or malicious archive can't fill the disk. Zero means no limit.
+type EventArchiveLimits struct {
+	MaxUnpackedSize     ByteSize // Max total size of all files once unpacked.
+	MaxEntries          int      // Max number of files and directories.
+	MaxCompressionRatio float64  // Max uncompressed/compressed size ratio of a single file.
+	AllowedExtensions   []string // Allowed file extensions such as ".png", all are allowed if empty.
+}
+
+// NewEventArchiveLimits Creates limits using a comma separated list of allowed extensions.
+func NewEventArchiveLimits(maxUnpackedSize ByteSize, maxEntries int, maxCompressionRatio float64, extensions string) *EventArchiveLimits {
+	l := &EventArchiveLimits{
+		MaxUnpackedSize:     maxUnpackedSize,
+		MaxEntries:          maxEntries,
+		MaxCompressionRatio: maxCompressionRatio}
+
+	for _, ext := range strings.Split(extensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			l.AllowedExtensions = append(l.AllowedExtensions, ext)
+		}
+	}
+
+	return l
+}
+
+// CheckEntryCount Checks the number of entries in an archive.
+func (l *EventArchiveLimits) CheckEntryCount(count int) error {
+	if l.MaxEntries > 0 && count > l.MaxEntries {
+		return &CatArchiveLimitError{fmt.Errorf("The archive has %d entries but at most %d are allowed", count, l.MaxEntries)}
+	}
+	return nil
+}
+
+// ExtensionProblem Checks that a file has one of the allowed extensions.
+func (l *EventArchiveLimits) ExtensionProblem(name string) string {
+	if len(l.AllowedExtensions) == 0 {
+		return ""
+	}
+
+	ext := strings.ToLower(path.Ext(cleanArchiveName(name)))
+	for _, e := range l.AllowedExtensions {
+		if ext == e {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("'%s' does not have an allowed extension (%s)", name, strings.Join(l.AllowedExtensions, ", "))
+}
+
+// eventEntryReader Enforces the EventArchiveLimits while reading an archive entry.
+type eventEntryReader struct {
+	r        io.Reader
+	name     string
+	read     int64
+	maxRead  int64  // Max for this entry based on the compression ratio, 0 for no limit.
+	total    *int64 // Shared between all entries of an archive.
+	maxTotal int64
+}
+
+// NewEntryReader Wraps the reader for an archive entry so that reading fails as soon
+// as a limit is exceeded, instead of trusting the sizes in the archive headers.
+// The total is shared between all entries, pass a negative compressed size if unknown.
+func (l *EventArchiveLimits) NewEntryReader(r io.Reader, name string, compressedSize int64, total *int64) io.Reader {
+	er := &eventEntryReader{r: r, name: name, total: total, maxTotal: int64(l.MaxUnpackedSize)}
+
+	if l.MaxCompressionRatio > 0 && compressedSize >= 0 {
+		er.maxRead = int64(float64(compressedSize) * l.MaxCompressionRatio)
+		if er.maxRead < int64(compressionRatioGrace) {
+			er.maxRead = int64(compressionRatioGrace)
+		}
+	}
+
+	return er
+}
+
+func (er *eventEntryReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	er.read += int64(n)
+	*er.total += int64(n)
+
+	if er.maxTotal > 0 && *er.total > er.maxTotal {
+		return n, &CatArchiveTooLargeError{fmt.Errorf("The archive unpacks to more than the allowed %s", ByteSize(er.maxTotal))}
+	}
+
+	if er.maxRead > 0 && er.read > er.maxRead {
+		return n, &CatArchiveLimitError{fmt.Errorf("'%s' is compressed more than the allowed ratio, it might be a zip bomb", er.name)}
+	}
+
+	// A corrupt entry is a problem with the archive, not with the server.
+	if err != nil && err != io.EOF {
+		return n, &CatArchiveError{[]string{fmt.Sprintf("Failed to read '%s': %s", er.name, err)}}
+	}
+
+	return n, err
+}
+
+// cleanArchiveName Cleans an archive entry name so it can be compared and validated.
+// Backslashes are treated as separators since some ZIP tools on Windows use them.
+func cleanArchiveName(name string) string {
+	return path.Clean(strings.Replace(name, "\\", "/", -1))
+}
+
+// isEscapingPath Checks if a cleaned path is absolute or points outside of its root.
+func isEscapingPath(p string) bool {
+	return path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// EventArchivePrefix Returns the path prefix of an event archive, the directory
+// of the event JSON. All other entries are relative to this.
+func EventArchivePrefix(jsonName string) (string, error) {
+	prefix := path.Dir(cleanArchiveName(jsonName))
+	if isEscapingPath(prefix) {
+		return "", &CatArchiveError{[]string{fmt.Sprintf("Event JSON '%s' is outside of the archive", jsonName)}}
+	}
+	return prefix, nil
+}
+
+// EventArchivePath Returns the path of an archive entry relative to the path prefix.
+// Directories above the prefix are skipped, everything else that is outside the
+// prefix (including absolute paths and '..' tricks) is a problem.
+func EventArchivePath(name string, isDir bool, prefix string) (rel string, skip bool, problem string) {
+	cleaned := cleanArchiveName(name)
+
+	if isEscapingPath(cleaned) {
+		return "", false, fmt.Sprintf("'%s' points outside of the archive", name)
+	}
+
+	if prefix == "." {
+		return cleaned, false, ""
+	}
+
+	if isDir && (cleaned == prefix || strings.HasPrefix(prefix, cleaned+"/")) {
+		return "", true, ""
+	}
+
+	if !strings.HasPrefix(cleaned, prefix+"/") {
+		return "", false, fmt.Sprintf("'%s' is outside of the event directory '%s'", name, prefix)
+	}
+
+	return strings.TrimPrefix(cleaned, prefix+"/"), false, ""
+}
+
+// EventArchiveModeProblem Checks that an archive entry is a plain file or directory.
+func EventArchiveModeProblem(name string, mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return fmt.Sprintf("'%s' is a symlink, which is not allowed", name)
+	case !mode.IsRegular() && !mode.IsDir():
+		return fmt.Sprintf("'%s' is not a regular file or directory", name)
+	}
+	return ""
+}
+
+// EventFileMode The mode of the files unpacked from an event archive. The modes in the
+// archive can't be trusted, they could be setuid, world writable or not readable at all.
+const EventFileMode os.FileMode = 0644
+
+// EventArchiveNames Keeps track of the paths of the entries in an archive, so that two
+// entries can't be unpacked to the same path, and no entry ends up inside a file.
+// The paths are relative to the prefix and map to true for directories.
+type EventArchiveNames map[string]bool
+
+// Add Adds the path of an entry, returning the problem if it clashes with an earlier entry.
+func (n EventArchiveNames) Add(name string, rel string, isDir bool) string {
+	if wasDir, ok := n[rel]; ok && !(wasDir && isDir) {
+		return fmt.Sprintf("'%s' is in the archive more than once", name)
+	}
+
+	for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+		if dir, ok := n[p]; ok && !dir {
+			return fmt.Sprintf("'%s' is inside '%s', which is a file", name, p)
+		}
+	}
+
+	n[rel] = isDir
+	for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+		n[p] = true
+	}
+	return ""
+}
+
+// EventFilePath Returns where an archive entry is written, making sure it stays inside dest.
+func EventFilePath(dest string, rel string) (string, error) {
+	root := filepath.Clean(dest)
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if p != root && !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", &CatArchiveError{[]string{fmt.Sprintf("'%s' points outside of the event directory", rel)}}
+	}
+	return p, nil
+}
+
+// ValidateEventFiles Checks that every file referenced by the event JSON is among
+// the files in the archive. The files are keyed by their path relative to the prefix.
+func ValidateEventFiles(data *CatEventDataV1, files map[string]bool) []string {
+	var problems []string
+
+	check := func(what string, p string) {
+		if p == "" {
+			return
+		}
+
+		cleaned := cleanArchiveName(p)
+		if isEscapingPath(cleaned) {
+			problems = append(problems, fmt.Sprintf("%s path '%s' points outside of the event directory", what, p))
+		} else if !files[cleaned] {
+			problems = append(problems, fmt.Sprintf("%s file '%s' is missing from the archive", what, p))
+		}
+	}
+
+	for _, m := range data.Matches {
+		check(fmt.Sprintf("Match %s", m.ID), m.Path)
+
+		for _, s := range m.Steps {
+			check(fmt.Sprintf("Match %s step %s", m.ID, s.Name), s.Path)
+		}
+	}
+
+	return problems
+}
+
+// Event archive formats.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+)
+
+// eventArchiveContentTypes The content types accepted for each event archive format.
+var eventArchiveContentTypes = map[string]string{
+	"application/zip":              ArchiveZip,
+	"application/x-zip-compressed": ArchiveZip,
+	"application/x-tar":            ArchiveTar,
+	"application/gzip":             ArchiveTarGz,
+	"application/x-gzip":           ArchiveTarGz,
+	"application/x-compressed-tar": ArchiveTarGz,
+}
+
+// EventArchiveContentTypes Returns the content types accepted for event archives.
+func EventArchiveContentTypes() []string {
+	types := make([]string, 0, len(eventArchiveContentTypes))
+	for t := range eventArchiveContentTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// EventArchiveFormatFromContentType Returns the archive format for a content type,
+// or an empty string if it doesn't say, such as for application/octet-stream.
+func EventArchiveFormatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return eventArchiveContentTypes[mediaType]
+}
+
+// SniffEventArchiveFormat Guesses the format of an archive from its magic bytes.
+// Returns an empty string if it is not a format we know.
+func SniffEventArchiveFormat(src string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The tar magic is found after the name and other fields of the first header.
+	magic := make([]byte, 262)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return ArchiveZip, nil
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return ArchiveTarGz, nil
+	case len(magic) >= 262 && bytes.Equal(magic[257:262], []byte("ustar")):
+		return ArchiveTar, nil
+	}
+
+	return "", nil
+}
+
+// UnpackEventArchive Unpacks an event archive of the given format.
+func UnpackEventArchive(format, src, dest, versionHint string, limits *EventArchiveLimits) (*CatEventHeader, *CatEventDataV1, error) {
+	switch format {
+	case ArchiveZip:
+		return UnzipEvent(src, dest, versionHint, limits)
+	case ArchiveTar:
+		return UntarEvent(src, dest, false, versionHint, limits)
+	case ArchiveTarGz:
+		return UntarEvent(src, dest, true, versionHint, limits)
+	}
+
+	return nil, nil, &CatArchiveError{[]string{fmt.Sprintf("Unknown archive format '%s'", format)}}
+}
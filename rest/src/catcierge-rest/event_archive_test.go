@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testArchiveEntry An entry for building test event archives.
+type testArchiveEntry struct {
+	Name string
+	Body string
+	Mode os.FileMode
+}
+
+const testEventArchiveJSON = `{
+	"id": "abcdef0123456789",
+	"event_json_version": "1.0",
+	"matches": [
+		{"id": "m1", "path": "match1.png", "steps": [{"name": "s1", "path": "steps/step1.png"}]}
+	]
+}`
+
+// testEventArchiveEntries Returns the entries of a valid event archive,
+// with all names starting with prefix.
+func testEventArchiveEntries(prefix string) []testArchiveEntry {
+	return []testArchiveEntry{
+		{prefix + "event.json", testEventArchiveJSON, 0644},
+		{prefix + "match1.png", "match", 0644},
+		{prefix + "steps/", "", os.ModeDir | 0755},
+		{prefix + "steps/step1.png", "step", 0644},
+	}
+}
+
+// testTempDir Creates a temporary directory, remove it with os.RemoveAll when done.
+func testTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "catcierge-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	return dir
+}
+
+// testArchiveProblems Returns the problems of a CatArchiveError, failing if it is another error.
+func testArchiveProblems(t *testing.T, err error) []string {
+	archiveErr, ok := err.(*CatArchiveError)
+	if !ok {
+		t.Fatalf("Expected a CatArchiveError, got %T: %v", err, err)
+	}
+	return archiveErr.Problems
+}
+
+// testHasProblem Checks that one of the problems contains the given text.
+func testHasProblem(problems []string, text string) bool {
+	for _, p := range problems {
+		if strings.Contains(p, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEventArchivePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		isDir   bool
+		prefix  string
+		rel     string
+		skip    bool
+		problem bool
+	}{
+		{"match1.png", false, ".", "match1.png", false, false},
+		{"./steps/step1.png", false, ".", "steps/step1.png", false, false},
+		{"event/match1.png", false, "event", "match1.png", false, false},
+		{"event\\match1.png", false, "event", "match1.png", false, false},
+		{"home/", true, "home/event", "", true, false},
+		{"home/event/", true, "home/event", "", true, false},
+		{"home/other.png", false, "home/event", "", false, true},
+		{"other/match1.png", false, "event", "", false, true},
+		{"../match1.png", false, ".", "", false, true},
+		{"event/../../match1.png", false, "event", "", false, true},
+		{"/etc/passwd", false, ".", "", false, true},
+		{"..", true, ".", "", false, true},
+	}
+
+	for _, tc := range tests {
+		rel, skip, problem := EventArchivePath(tc.name, tc.isDir, tc.prefix)
+		if rel != tc.rel || skip != tc.skip || (problem != "") != tc.problem {
+			t.Errorf("%s in %s: Expected (%q, %v, problem %v), got (%q, %v, %q)",
+				tc.name, tc.prefix, tc.rel, tc.skip, tc.problem, rel, skip, problem)
+		}
+	}
+}
+
+func TestEventArchivePrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		err    bool
+	}{
+		{"event.json", ".", false},
+		{"home/event/event.json", "home/event", false},
+		{"../event.json", "", true},
+		{"/event.json", "", true},
+	}
+
+	for _, tc := range tests {
+		prefix, err := EventArchivePrefix(tc.name)
+		if prefix != tc.prefix || (err != nil) != tc.err {
+			t.Errorf("%s: Expected (%q, error %v), got (%q, %v)", tc.name, tc.prefix, tc.err, prefix, err)
+		}
+	}
+}
+
+func TestEventArchiveNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		isDir   bool
+		problem bool
+	}{
+		{"steps/step1.png", false, false},
+		{"steps", true, false},
+		{"steps", true, false},
+		{"match1.png", false, false},
+		{"match1.png", false, true},
+		{"steps", false, true},
+		{"match1.png/evil.png", false, true},
+		{"match1.png", true, true},
+	}
+
+	names := make(EventArchiveNames)
+	for i, tc := range tests {
+		if problem := names.Add(tc.name, tc.name, tc.isDir); (problem != "") != tc.problem {
+			t.Errorf("%d %s: Expected problem %v, got %q", i, tc.name, tc.problem, problem)
+		}
+	}
+}
+
+func TestEventFilePath(t *testing.T) {
+	if p, err := EventFilePath("/tmp/event", "steps/step1.png"); err != nil || p != "/tmp/event/steps/step1.png" {
+		t.Errorf("Expected /tmp/event/steps/step1.png, got %q, %v", p, err)
+	}
+
+	if _, err := EventFilePath("/tmp/event", "../other/step1.png"); err == nil {
+		t.Errorf("Expected a path outside of dest to fail")
+	}
+}
+
+func TestValidateEventFiles(t *testing.T) {
+	_, data, err := ParseEventJSON([]byte(testEventArchiveJSON), "")
+	if err != nil {
+		t.Fatalf("Failed to parse event JSON: %s", err)
+	}
+
+	if problems := ValidateEventFiles(data, map[string]bool{"match1.png": true, "steps/step1.png": true}); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	problems := ValidateEventFiles(data, map[string]bool{"match1.png": true})
+	if len(problems) != 1 || !testHasProblem(problems, "steps/step1.png") {
+		t.Errorf("Expected the step file to be missing, got %v", problems)
+	}
+
+	data.Matches[0].Path = "../../etc/passwd"
+	problems = ValidateEventFiles(data, map[string]bool{"steps/step1.png": true})
+	if len(problems) != 1 || !testHasProblem(problems, "outside of the event directory") {
+		t.Errorf("Expected the match path to point outside, got %v", problems)
+	}
+}
+
+func TestNewEventArchiveLimits(t *testing.T) {
+	l := NewEventArchiveLimits(MB, 10, 50, " .PNG, jpg,,.json ")
+	if !reflect.DeepEqual(l.AllowedExtensions, []string{".png", ".jpg", ".json"}) {
+		t.Errorf("Unexpected extensions %v", l.AllowedExtensions)
+	}
+
+	if err := l.CheckEntryCount(10); err != nil {
+		t.Errorf("Expected 10 entries to be allowed, got %s", err)
+	}
+	if _, ok := l.CheckEntryCount(11).(*CatArchiveLimitError); !ok {
+		t.Errorf("Expected 11 entries to fail with a CatArchiveLimitError")
+	}
+
+	for name, ok := range map[string]bool{
+		"match1.png":     true,
+		"steps/STEP.Jpg": true,
+		"event.json":     true,
+		"evil.sh":        false,
+		"noextension":    false,
+		"evil.png.exe":   false,
+	} {
+		if problem := l.ExtensionProblem(name); (problem == "") != ok {
+			t.Errorf("%s: Expected allowed %v, got %q", name, ok, problem)
+		}
+	}
+
+	unlimited := NewEventArchiveLimits(0, 0, 0, "")
+	if err := unlimited.CheckEntryCount(1000000); err != nil {
+		t.Errorf("Expected no entry limit, got %s", err)
+	}
+	if problem := unlimited.ExtensionProblem("evil.sh"); problem != "" {
+		t.Errorf("Expected all extensions to be allowed, got %q", problem)
+	}
+}
+
+func TestEventEntryReader(t *testing.T) {
+	data := strings.Repeat("a", int(2*compressionRatioGrace))
+
+	tests := []struct {
+		name           string
+		limits         *EventArchiveLimits
+		compressedSize int64
+		err            interface{}
+	}{
+		{"no limits", NewEventArchiveLimits(0, 0, 0, ""), 10, nil},
+		{"within limits", NewEventArchiveLimits(MB, 0, 100, ""), int64(len(data)) / 50, nil},
+		{"unknown compressed size", NewEventArchiveLimits(MB, 0, 100, ""), -1, nil},
+		{"too large", NewEventArchiveLimits(compressionRatioGrace, 0, 0, ""), 10, &CatArchiveTooLargeError{}},
+		{"compression ratio", NewEventArchiveLimits(MB, 0, 100, ""), 10, &CatArchiveLimitError{}},
+	}
+
+	for _, tc := range tests {
+		var total int64
+		_, err := ioutil.ReadAll(tc.limits.NewEntryReader(strings.NewReader(data), "bomb.png", tc.compressedSize, &total))
+
+		switch tc.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: Expected no error, got %s", tc.name, err)
+			}
+		case *CatArchiveTooLargeError:
+			if _, ok := err.(*CatArchiveTooLargeError); !ok {
+				t.Errorf("%s: Expected a CatArchiveTooLargeError, got %T: %v", tc.name, err, err)
+			}
+		case *CatArchiveLimitError:
+			if _, ok := err.(*CatArchiveLimitError); !ok {
+				t.Errorf("%s: Expected a CatArchiveLimitError, got %T: %v", tc.name, err, err)
+			}
+		}
+	}
+
+	// The total is shared between the entries of an archive.
+	var total int64
+	l := NewEventArchiveLimits(ByteSize(len(data)+len(data)/2), 0, 0, "")
+	if _, err := ioutil.ReadAll(l.NewEntryReader(strings.NewReader(data), "1.png", -1, &total)); err != nil {
+		t.Fatalf("Expected the first entry to fit, got %s", err)
+	}
+	if _, err := ioutil.ReadAll(l.NewEntryReader(strings.NewReader(data), "2.png", -1, &total)); err == nil {
+		t.Errorf("Expected the second entry to exceed the total size")
+	}
+}
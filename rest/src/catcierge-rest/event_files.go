@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Prefixes for the temporary directories in the event path. Events are
+// unpacked into a staging directory and only moved in place once they are
+// in the database, and deleted events are moved aside before they are removed.
+// So an event directory only exists as long as its database document does.
+const (
+	eventStagingPrefix = ".upload-"
+	eventDeletedPrefix = ".deleted-"
+)
+
+// EventDir Returns the directory that the files for an event are stored in.
+func EventDir(eventPath string, id bson.ObjectId) string {
+	return filepath.Join(eventPath, id.Hex())
+}
+
+// eventCacheDirName The directory in the event path that files generated from
+// the event files are cached in, such as resized images.
+const eventCacheDirName = ".cache"
+
+// EventCacheDir Returns the directory that generated files for an event are cached in.
+// Anything in it can be removed at any time, it is created again when needed.
+func EventCacheDir(eventPath string, id bson.ObjectId) string {
+	return filepath.Join(eventPath, eventCacheDirName, id.Hex())
+}
+
+// NewEventStagingDir Creates a new directory that an event can be unpacked into.
+func NewEventStagingDir(eventPath string) (string, error) {
+	if err := os.MkdirAll(eventPath, 0755); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(eventPath, eventStagingPrefix)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, 0755)
+}
+
+// MoveEventDirAside Moves an event directory out of the way before deleting it.
+// Returns the directory it was moved into, or an empty string if the event has
+// no directory. Remove the returned directory, or undo using RestoreEventDir.
+func MoveEventDirAside(eventPath string, id bson.ObjectId) (string, error) {
+	dir := EventDir(eventPath, id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	deleted, err := ioutil.TempDir(eventPath, eventDeletedPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(dir, filepath.Join(deleted, id.Hex())); err != nil {
+		os.Remove(deleted)
+		return "", err
+	}
+
+	return deleted, nil
+}
+
+// RestoreEventDir Moves an event directory back after MoveEventDirAside.
+func RestoreEventDir(eventPath string, id bson.ObjectId, deleted string) error {
+	if err := os.Rename(filepath.Join(deleted, id.Hex()), EventDir(eventPath, id)); err != nil {
+		return err
+	}
+	return os.Remove(deleted)
+}
+
+// CleanupEventPath Removes any staging or deleted directories left behind,
+// for instance if the server was killed in the middle of an upload.
+func CleanupEventPath(eventPath string) {
+	entries, err := ioutil.ReadDir(eventPath)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, eventStagingPrefix) || strings.HasPrefix(name, eventDeletedPrefix) {
+			log.Printf("Removing leftover event directory %s", name)
+			if err := os.RemoveAll(filepath.Join(eventPath, name)); err != nil {
+				log.Printf("Failed to remove %s: %s", name, err)
+			}
+		}
+	}
+}
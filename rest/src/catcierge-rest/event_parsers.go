@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CatEventParser Decodes the event JSON of a specific event_json_version
+// and upgrades it into CatEventDataV1, which is what we store for all versions.
+type CatEventParser func(r io.Reader) (*CatEventDataV1, error)
+
+// catEventParsers The registered event JSON parsers keyed by event_json_version.
+var catEventParsers = make(map[string]CatEventParser)
+
+// RegisterCatEventParser Registers a parser for an event_json_version.
+func RegisterCatEventParser(version string, parser CatEventParser) {
+	if _, ok := catEventParsers[version]; ok {
+		panic(fmt.Sprintf("Event JSON parser for version %s registered twice", version))
+	}
+	catEventParsers[version] = parser
+}
+
+func init() {
+	RegisterCatEventParser("1.0", parseCatEventV1)
+}
+
+// parseCatEventV1 Parses the first version of the event JSON.
+func parseCatEventV1(r io.Reader) (*CatEventDataV1, error) {
+	var data CatEventDataV1
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// parseEventVersion Splits a "major.minor" version string.
+func parseEventVersion(version string) (int, int, bool) {
+	parts := strings.SplitN(version, ".", 2)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	minor := 0
+	if len(parts) == 2 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	return major, minor, true
+}
+
+// eventVersionLess Compares two "major.minor" version strings.
+func eventVersionLess(a string, b string) bool {
+	amaj, amin, _ := parseEventVersion(a)
+	bmaj, bmin, _ := parseEventVersion(b)
+	if amaj != bmaj {
+		return amaj < bmaj
+	}
+	return amin < bmin
+}
+
+// SupportedEventVersions Returns all event JSON versions we have parsers for, oldest first.
+func SupportedEventVersions() []string {
+	versions := make([]string, 0, len(catEventParsers))
+	for v := range catEventParsers {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return eventVersionLess(versions[i], versions[j]) })
+	return versions
+}
+
+// LatestEventVersion Returns the newest event JSON version we have a parser for.
+func LatestEventVersion() string {
+	versions := SupportedEventVersions()
+	return versions[len(versions)-1]
+}
+
+// FindCatEventParser Returns the parser for an event JSON version. Newer minor
+// versions only add fields, so they are parsed by the newest parser for the same
+// major version. Also returns the version of the parser that was picked.
+func FindCatEventParser(version string) (CatEventParser, string, bool) {
+	if p, ok := catEventParsers[version]; ok {
+		return p, version, true
+	}
+
+	major, _, ok := parseEventVersion(version)
+	if !ok {
+		return nil, "", false
+	}
+
+	versions := SupportedEventVersions()
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if pmaj, _, _ := parseEventVersion(v); pmaj == major && eventVersionLess(v, version) {
+			return catEventParsers[v], v, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// ParseEventJSON Parses the event JSON using the parser for its event_json_version.
+// The versionHint is the version the uploader says it is sending (from the Content-Type), if any.
+func ParseEventJSON(content []byte, versionHint string) (*CatEventHeader, *CatEventDataV1, error) {
+	var header CatEventHeader
+
+	// Start by decoding the header so we can get the version info.
+	if err := json.Unmarshal(content, &header); err != nil {
+		log.Printf("Failed to decode event header: %s", err)
+		return nil, nil, &CatJSONHeaderError{err}
+	}
+
+	// Without a version in the JSON we go by the Content-Type,
+	// and if that doesn't say either we assume it is the latest version.
+	if header.EventJSONVersion == "" {
+		header.EventJSONVersion = versionHint
+		if header.EventJSONVersion == "" {
+			header.EventJSONVersion = LatestEventVersion()
+		}
+	} else if versionHint != "" && versionHint != header.EventJSONVersion {
+		log.Printf("Version mismatch for event %s: %s but expected %s", header.ID, header.EventJSONVersion, versionHint)
+		return &header, nil, &CatJSONVersionError{fmt.Errorf("Content-Type says event JSON version %s but the event is version %s",
+			versionHint, header.EventJSONVersion)}
+	}
+
+	parser, parserVersion, ok := FindCatEventParser(header.EventJSONVersion)
+	if !ok {
+		log.Printf("Unsupported version for event %s: %s", header.ID, header.EventJSONVersion)
+		return &header, nil, &CatJSONVersionError{fmt.Errorf("Event JSON version %s is not supported, supported versions: %s",
+			header.EventJSONVersion, strings.Join(SupportedEventVersions(), ", "))}
+	}
+
+	if parserVersion != header.EventJSONVersion {
+		log.Printf("Parsing event %s version %s using the version %s parser", header.ID, header.EventJSONVersion, parserVersion)
+	}
+
+	data, err := parser(bytes.NewReader(content))
+	if err != nil {
+		log.Printf("Failed to decode JSON (v%s) for event %s: %s", header.EventJSONVersion, header.ID, err)
+		return &header, nil, &CatJSONError{err}
+	}
+	data.EventJSONVersion = header.EventJSONVersion
+
+	return &header, data, nil
+}
+
+// EventVersionFromContentType Gets the event JSON version hint from a content type
+// such as "application/zip; version=1.0". Returns an empty string if there is none.
+func EventVersionFromContentType(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return params["version"]
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MIMEMergePatch The content type for a JSON Merge Patch (RFC 7396).
+const MIMEMergePatch = "application/merge-patch+json"
+
+// CatEventMatchPatch The user owned fields of a match that can be patched.
+type CatEventMatchPatch struct {
+	IsFalsePositive *bool `json:"is_false_positive,omitempty"`
+}
+
+// CatEventPatch A JSON Merge Patch of the user owned fields of an event.
+// Matches are patched by their match ID. Setting a field to null resets it, except for
+// the matches themselves.
+// The device generated "data" can't be patched.
+type CatEventPatch struct {
+	Name    *string                       `json:"name,omitempty"`
+	Tags    *[]string                     `json:"tags,omitempty"`
+	Missing *bool                         `json:"missing,omitempty"`
+	Matches map[string]CatEventMatchPatch `json:"matches,omitempty"`
+
+	reset map[string]bool `json:"-"` // Fields explicitly set to null.
+}
+
+// CatEventPatchError Indicates a patch that is valid JSON, but can't be applied to an event.
+type CatEventPatchError struct {
+	error
+}
+
+// catEventPatchFields The fields that users are allowed to patch.
+var catEventPatchFields = map[string]bool{
+	"name":    true,
+	"tags":    true,
+	"missing": true,
+	"matches": true,
+}
+
+// ReadCatEventPatch Decodes and validates a JSON Merge Patch for an event.
+func ReadCatEventPatch(r io.Reader) (*CatEventPatch, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON Merge Patch: %s", err)
+	}
+
+	p := &CatEventPatch{reset: make(map[string]bool)}
+
+	if _, ok := raw["data"]; ok {
+		return nil, CatEventPatchError{fmt.Errorf("The event 'data' is generated by the device and can't be changed")}
+	}
+
+	var invalid []string
+	for k, v := range raw {
+		if !catEventPatchFields[k] {
+			invalid = append(invalid, k)
+			continue
+		}
+
+		if string(v) == "null" {
+			p.reset[k] = true
+		}
+	}
+
+	// The matches are generated by the device, only their user owned fields can be reset.
+	if p.reset["matches"] {
+		return nil, CatEventPatchError{fmt.Errorf("The 'matches' can't be removed, patch the fields of each match instead")}
+	}
+
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, CatEventPatchError{fmt.Errorf("Only the fields %s can be changed, not: %s",
+			"name, tags, missing and matches", strings.Join(invalid, ", "))}
+	}
+
+	b, _ := json.Marshal(raw)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, CatEventPatchError{fmt.Errorf("Invalid JSON Merge Patch: %s", err)}
+	}
+
+	return p, nil
+}
+
+// Apply Applies the patch to an event. No changes are made if the patch
+// refers to a match that doesn't exist in the event.
+func (p *CatEventPatch) Apply(e *CatEvent) error {
+	matchIndex := make(map[string]int)
+	for i, m := range e.Data.Matches {
+		matchIndex[m.ID] = i
+	}
+
+	for id := range p.Matches {
+		if _, ok := matchIndex[id]; !ok {
+			return CatEventPatchError{fmt.Errorf("Event has no match with ID '%s'", id)}
+		}
+	}
+
+	if p.reset["name"] {
+		e.Name = ""
+	} else if p.Name != nil {
+		e.Name = *p.Name
+	}
+
+	if p.reset["tags"] {
+		e.Tags = []string{}
+	} else if p.Tags != nil {
+		e.Tags = *p.Tags
+	}
+
+	if p.reset["missing"] {
+		e.Missing = false
+	} else if p.Missing != nil {
+		e.Missing = *p.Missing
+	}
+
+	for id, mp := range p.Matches {
+		m := &e.Data.Matches[matchIndex[id]]
+		if mp.IsFalsePositive != nil {
+			m.IsFalsePositive = *mp.IsFalsePositive
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCatEventPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patch    string
+		readErr  string // "json" for invalid JSON, "patch" for a CatEventPatchError.
+		applyErr bool
+		want     CatEvent // Only Name, Tags, Missing are compared.
+		wantFP   bool     // If match 'a' should be a false positive.
+	}{
+		{"empty", `{}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: true}, false},
+		{"name", `{"name": "Tom"}`, "", false,
+			CatEvent{Name: "Tom", Tags: []string{"old"}, Missing: true}, false},
+		{"reset name", `{"name": null}`, "", false,
+			CatEvent{Name: "", Tags: []string{"old"}, Missing: true}, false},
+		{"tags", `{"tags": ["a", "b"]}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{"a", "b"}, Missing: true}, false},
+		{"reset tags", `{"tags": null}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{}, Missing: true}, false},
+		{"missing", `{"missing": false}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: false}, false},
+		{"reset missing", `{"missing": null}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: false}, false},
+		{"false positive", `{"matches": {"a": {"is_false_positive": true}}}`, "", false,
+			CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: true}, true},
+		{"unknown match", `{"name": "Tom", "matches": {"x": {"is_false_positive": true}}}`, "", true,
+			CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: true}, false},
+		{"data", `{"data": {}}`, "patch", false, CatEvent{}, false},
+		{"unknown field", `{"name": "Tom", "account_id": "x"}`, "patch", false, CatEvent{}, false},
+		{"reset matches", `{"matches": null}`, "patch", false, CatEvent{}, false},
+		{"wrong type", `{"name": 5}`, "patch", false, CatEvent{}, false},
+		{"invalid JSON", `{"name": `, "json", false, CatEvent{}, false},
+		{"not an object", `["name"]`, "json", false, CatEvent{}, false},
+	}
+
+	for _, tc := range tests {
+		p, err := ReadCatEventPatch(strings.NewReader(tc.patch))
+		if tc.readErr != "" {
+			if _, ok := err.(CatEventPatchError); err == nil || ok != (tc.readErr == "patch") {
+				t.Errorf("%s: Expected a %s error, got %v", tc.name, tc.readErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Failed to read patch: %s", tc.name, err)
+			continue
+		}
+
+		e := CatEvent{Name: "Kitty", Tags: []string{"old"}, Missing: true}
+		e.Data.Matches = []CatEventMatchV1{{ID: "a"}, {ID: "b"}}
+
+		err = p.Apply(&e)
+		if tc.applyErr {
+			if _, ok := err.(CatEventPatchError); !ok {
+				t.Errorf("%s: Expected a CatEventPatchError, got %v", tc.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Failed to apply patch: %s", tc.name, err)
+		}
+
+		if e.Name != tc.want.Name || !reflect.DeepEqual(e.Tags, tc.want.Tags) || e.Missing != tc.want.Missing {
+			t.Errorf("%s: Expected name '%s', tags %v, missing %v, got '%s', %v, %v", tc.name,
+				tc.want.Name, tc.want.Tags, tc.want.Missing, e.Name, e.Tags, e.Missing)
+		}
+		if e.Data.Matches[0].IsFalsePositive != tc.wantFP || e.Data.Matches[1].IsFalsePositive {
+			t.Errorf("%s: Expected match false positives [%v false], got [%v %v]", tc.name,
+				tc.wantFP, e.Data.Matches[0].IsFalsePositive, e.Data.Matches[1].IsFalsePositive)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// DefaultEventSort The default sort order when listing events.
+const DefaultEventSort = "start"
+
+// EventQuery Filters, sort order and pagination used when listing events.
+// Zero values mean that the filter is not used.
+type EventQuery struct {
+	Accounts          []bson.ObjectId // Only events of these accounts or without an account, all accounts if nil.
+	StartAfter        time.Time
+	StartBefore       time.Time
+	EndAfter          time.Time
+	EndBefore         time.Time
+	Direction         string
+	MatchGroupSuccess *bool
+	State             string
+	Tags              []string // The event must have all of these tags.
+	CatciergeType     string
+	GitHash           string
+	Device            string // Only events uploaded by this device.
+	Missing           *bool
+	CreatedAfter      time.Time // Only events uploaded after this time, used to resume the event stream.
+	Sort              []string  // Sort keys, prefixed with '-' for descending order.
+	Offset            int
+	Limit             int
+}
+
+// eventSortKey A key that events can be sorted on.
+type eventSortKey struct {
+	mongoField string
+	compare    func(a *CatEvent, b *CatEvent) int
+}
+
+func compareTimes(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a string, b string) int {
+	return strings.Compare(a, b)
+}
+
+func compareInts(a int, b int) int {
+	return a - b
+}
+
+// eventSortKeys The keys that can be used in ?sort= when listing events.
+// The MongoDB fields are where the fields end up in the stored BSON.
+var eventSortKeys = map[string]eventSortKey{
+	"start": {"data.start.time", func(a *CatEvent, b *CatEvent) int {
+		return compareTimes(a.Data.Start.Time, b.Data.Start.Time)
+	}},
+	"end": {"data.end.time", func(a *CatEvent, b *CatEvent) int {
+		return compareTimes(a.Data.End.Time, b.Data.End.Time)
+	}},
+	"time_generated": {"data.time_generated.time", func(a *CatEvent, b *CatEvent) int {
+		return compareTimes(a.Data.TimeGenerated.Time, b.Data.TimeGenerated.Time)
+	}},
+	"name": {"name", func(a *CatEvent, b *CatEvent) int {
+		return compareStrings(a.Name, b.Name)
+	}},
+	"direction": {"data.match_group_direction", func(a *CatEvent, b *CatEvent) int {
+		return compareStrings(a.Data.MatchGroupDirection, b.Data.MatchGroupDirection)
+	}},
+	"match_group_success": {"data.match_group_success", func(a *CatEvent, b *CatEvent) int {
+		return compareInts(a.Data.MatchGroupSuccess, b.Data.MatchGroupSuccess)
+	}},
+	"created": {"created", func(a *CatEvent, b *CatEvent) int {
+		return compareTimes(a.Created, b.Created)
+	}},
+	"state": {"data.state", func(a *CatEvent, b *CatEvent) int {
+		return compareStrings(a.Data.State, b.Data.State)
+	}},
+	"catcierge_type": {"data.catcierge_type", func(a *CatEvent, b *CatEvent) int {
+		return compareStrings(a.Data.CatciergeType, b.Data.CatciergeType)
+	}},
+}
+
+// sortKeyNames Returns the names of all the sort keys.
+func sortKeyNames() []string {
+	names := make([]string, 0, len(eventSortKeys))
+	for k := range eventSortKeys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseQueryTime Parses a time query parameter, either RFC3339 or just a date.
+func parseQueryTime(request *restful.Request, name string) (time.Time, error) {
+	s := request.QueryParameter(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+		if err != nil {
+			return t, fmt.Errorf("Invalid time '%s' for '%s', expected RFC3339 or YYYY-MM-DD", s, name)
+		}
+	}
+	return t, nil
+}
+
+// parseQueryBool Parses a boolean query parameter, nil if not set.
+func parseQueryBool(request *restful.Request, name string) (*bool, error) {
+	s := request.QueryParameter(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid boolean '%s' for '%s'", s, name)
+	}
+	return &b, nil
+}
+
+// parseQueryList Parses a comma separated list query parameter.
+func parseQueryList(request *restful.Request, name string) []string {
+	var list []string
+	for _, s := range strings.Split(request.QueryParameter(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// ParseEventQuery Gets the event filters and sort order from the request query parameters.
+func ParseEventQuery(request *restful.Request) (*EventQuery, error) {
+	var err error
+	q := &EventQuery{
+		Direction:     request.QueryParameter("direction"),
+		State:         request.QueryParameter("state"),
+		Tags:          parseQueryList(request, "tags"),
+		CatciergeType: request.QueryParameter("catcierge_type"),
+		GitHash:       request.QueryParameter("git_hash"),
+		Device:        request.QueryParameter("device"),
+		Sort:          parseQueryList(request, "sort")}
+
+	times := map[string]*time.Time{
+		"start_after":  &q.StartAfter,
+		"start_before": &q.StartBefore,
+		"end_after":    &q.EndAfter,
+		"end_before":   &q.EndBefore,
+	}
+
+	for name, t := range times {
+		if *t, err = parseQueryTime(request, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.MatchGroupSuccess, err = parseQueryBool(request, "match_group_success"); err != nil {
+		return nil, err
+	}
+
+	if q.Missing, err = parseQueryBool(request, "missing"); err != nil {
+		return nil, err
+	}
+
+	if len(q.Sort) == 0 {
+		q.Sort = []string{DefaultEventSort}
+	}
+
+	for _, s := range q.Sort {
+		if _, ok := eventSortKeys[strings.TrimPrefix(s, "-")]; !ok {
+			return nil, fmt.Errorf("Invalid sort key '%s', expected one of: %s",
+				s, strings.Join(sortKeyNames(), ", "))
+		}
+	}
+
+	return q, nil
+}
+
+// AddEventQueryRequestParams Sets the filter and sort parameters for listing events.
+func AddEventQueryRequestParams(ws *restful.WebService) func(b *restful.RouteBuilder) {
+	return func(b *restful.RouteBuilder) {
+		b.Param(ws.QueryParameter("start_after", "Only events that started at or after this time (RFC3339 or YYYY-MM-DD)").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("start_before", "Only events that started before this time (RFC3339 or YYYY-MM-DD)").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("end_after", "Only events that ended at or after this time (RFC3339 or YYYY-MM-DD)").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("end_before", "Only events that ended before this time (RFC3339 or YYYY-MM-DD)").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("direction", "Only events with this match group direction (in, out or unknown)").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("match_group_success", "Only successful or failed events").
+			DataType("boolean"))
+
+		b.Param(ws.QueryParameter("state", "Only events in this state").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("tags", "Only events that have all of these comma separated tags").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("catcierge_type", "Only events from this catcierge type").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("git_hash", "Only events from this catcierge git hash").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("device", "Only events uploaded by this device").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("missing", "Only events that are (or are not) missing their files").
+			DataType("boolean"))
+
+		b.Param(ws.QueryParameter("sort", fmt.Sprintf("Comma separated sort keys, prefix with '-' for descending order. Keys: %s",
+			strings.Join(sortKeyNames(), ", "))).
+			DataType("string").DefaultValue(DefaultEventSort))
+	}
+}
+
+// HasFilters Checks if the query has any filters, or only sorts and pages all events.
+func (q *EventQuery) HasFilters() bool {
+	return q.Accounts != nil ||
+		!q.StartAfter.IsZero() || !q.StartBefore.IsZero() ||
+		!q.EndAfter.IsZero() || !q.EndBefore.IsZero() ||
+		q.Direction != "" || q.MatchGroupSuccess != nil || q.State != "" ||
+		len(q.Tags) > 0 || q.CatciergeType != "" || q.GitHash != "" ||
+		q.Device != "" || q.Missing != nil || !q.CreatedAfter.IsZero()
+}
+
+// Match Checks if an event matches all the filters in the query.
+func (q *EventQuery) Match(e *CatEvent) bool {
+	d := &e.Data
+
+	if q.Accounts != nil && e.AccountID != "" {
+		found := false
+		for _, id := range q.Accounts {
+			found = found || e.AccountID == id
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !q.StartAfter.IsZero() && d.Start.Before(q.StartAfter) {
+		return false
+	}
+	if !q.StartBefore.IsZero() && !d.Start.Before(q.StartBefore) {
+		return false
+	}
+	if !q.EndAfter.IsZero() && d.End.Before(q.EndAfter) {
+		return false
+	}
+	if !q.EndBefore.IsZero() && !d.End.Before(q.EndBefore) {
+		return false
+	}
+	if q.Direction != "" && d.MatchGroupDirection != q.Direction {
+		return false
+	}
+	if q.MatchGroupSuccess != nil && (d.MatchGroupSuccess != 0) != *q.MatchGroupSuccess {
+		return false
+	}
+	if q.State != "" && d.State != q.State {
+		return false
+	}
+	if q.CatciergeType != "" && d.CatciergeType != q.CatciergeType {
+		return false
+	}
+	if q.GitHash != "" && d.GitHash != q.GitHash && d.GitHashShort != q.GitHash {
+		return false
+	}
+	if q.Device != "" && e.DeviceID != q.Device {
+		return false
+	}
+	if q.Missing != nil && e.Missing != *q.Missing {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !e.Created.After(q.CreatedAfter) {
+		return false
+	}
+
+	for _, tag := range q.Tags {
+		found := false
+		for _, t := range e.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Less Compares two events using the sort keys in the query,
+// the event ID is used when everything else is equal.
+func (q *EventQuery) Less(a *CatEvent, b *CatEvent) bool {
+	for _, s := range q.Sort {
+		desc := strings.HasPrefix(s, "-")
+		key, ok := eventSortKeys[strings.TrimPrefix(s, "-")]
+		if !ok {
+			continue
+		}
+
+		c := key.compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+
+	return a.ID < b.ID
+}
+
+// SortEvents Sorts events using the sort keys in the query.
+func (q *EventQuery) SortEvents(events []*CatEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return q.Less(events[i], events[j])
+	})
+}
+
+// MongoQuery Returns the MongoDB query for the filters.
+func (q *EventQuery) MongoQuery() bson.M {
+	m := bson.M{}
+
+	if q.Accounts != nil {
+		// A null matches the events without an account.
+		accounts := []interface{}{nil}
+		for _, id := range q.Accounts {
+			accounts = append(accounts, id)
+		}
+		m["account_id"] = bson.M{"$in": accounts}
+	}
+
+	timeRange := func(field string, after time.Time, before time.Time) {
+		r := bson.M{}
+		if !after.IsZero() {
+			r["$gte"] = after
+		}
+		if !before.IsZero() {
+			r["$lt"] = before
+		}
+		if len(r) > 0 {
+			m[field] = r
+		}
+	}
+
+	timeRange("data.start.time", q.StartAfter, q.StartBefore)
+	timeRange("data.end.time", q.EndAfter, q.EndBefore)
+
+	if q.Direction != "" {
+		m["data.match_group_direction"] = q.Direction
+	}
+	if q.MatchGroupSuccess != nil {
+		if *q.MatchGroupSuccess {
+			m["data.match_group_success"] = bson.M{"$ne": 0}
+		} else {
+			m["data.match_group_success"] = 0
+		}
+	}
+	if q.State != "" {
+		m["data.state"] = q.State
+	}
+	if q.CatciergeType != "" {
+		m["data.catcierge_type"] = q.CatciergeType
+	}
+	if q.GitHash != "" {
+		m["$or"] = []bson.M{
+			{"data.cateventheader.git_hash": q.GitHash},
+			{"data.cateventheader.git_hash_short": q.GitHash},
+		}
+	}
+	if q.Device != "" {
+		m["device_id"] = q.Device
+	}
+	if q.Missing != nil {
+		m["missing"] = *q.Missing
+	}
+	if !q.CreatedAfter.IsZero() {
+		m["created"] = bson.M{"$gt": q.CreatedAfter}
+	}
+	if len(q.Tags) > 0 {
+		m["tags"] = bson.M{"$all": q.Tags}
+	}
+
+	return m
+}
+
+// MongoSort Returns the MongoDB sort fields for the sort keys.
+func (q *EventQuery) MongoSort() []string {
+	var fields []string
+	for _, s := range q.Sort {
+		prefix := ""
+		if strings.HasPrefix(s, "-") {
+			prefix = "-"
+		}
+		if key, ok := eventSortKeys[strings.TrimPrefix(s, "-")]; ok {
+			fields = append(fields, prefix+key.mongoField)
+		}
+	}
+	return append(fields, "_id")
+}
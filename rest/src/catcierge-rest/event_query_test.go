@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+func testEventQueryRequest(t *testing.T, query string) *restful.Request {
+	req, err := http.NewRequest("GET", "/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restful.NewRequest(req)
+}
+
+func TestParseEventQuery(t *testing.T) {
+	yes, no := true, false
+	day := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	noon := time.Date(2017, 3, 4, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		query string
+		want  *EventQuery // nil if the query is invalid.
+	}{
+		{"", &EventQuery{Sort: []string{"start"}}},
+		{"direction=in&state=Lockout&catcierge_type=haar&git_hash=abc&device=door",
+			&EventQuery{Direction: "in", State: "Lockout", CatciergeType: "haar", GitHash: "abc", Device: "door",
+				Sort: []string{"start"}}},
+		{"tags=prey,%20night,,", &EventQuery{Tags: []string{"prey", "night"}, Sort: []string{"start"}}},
+		{"start_after=2017-03-04&end_before=2017-03-04T12:30:00Z",
+			&EventQuery{StartAfter: day, EndBefore: noon, Sort: []string{"start"}}},
+		{"match_group_success=true&missing=0",
+			&EventQuery{MatchGroupSuccess: &yes, Missing: &no, Sort: []string{"start"}}},
+		{"sort=-end,name", &EventQuery{Sort: []string{"-end", "name"}}},
+		{"start_after=yesterday", nil},
+		{"end_before=2017-13-01", nil},
+		{"match_group_success=maybe", nil},
+		{"missing=2", nil},
+		{"sort=size", nil},
+		{"sort=start,--end", nil},
+	}
+
+	for _, tc := range tests {
+		q, err := ParseEventQuery(testEventQueryRequest(t, tc.query))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("'%s': Expected an error, got %+v", tc.query, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': Failed to parse query: %s", tc.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, tc.want) {
+			t.Errorf("'%s': Expected %+v, got %+v", tc.query, tc.want, q)
+		}
+	}
+}
+
+func TestEventQueryMongoQuery(t *testing.T) {
+	yes, no := true, false
+	day := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	account := bson.NewObjectId()
+
+	tests := []struct {
+		name  string
+		query EventQuery
+		want  bson.M
+	}{
+		{"nothing", EventQuery{}, bson.M{}},
+		{"accounts", EventQuery{Accounts: []bson.ObjectId{account}},
+			bson.M{"account_id": bson.M{"$in": []interface{}{nil, account}}}},
+		{"no accounts", EventQuery{Accounts: []bson.ObjectId{}},
+			bson.M{"account_id": bson.M{"$in": []interface{}{nil}}}},
+		{"start range", EventQuery{StartAfter: day, StartBefore: day.AddDate(0, 0, 1)},
+			bson.M{"data.start.time": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}},
+		{"end after", EventQuery{EndAfter: day}, bson.M{"data.end.time": bson.M{"$gte": day}}},
+		{"success", EventQuery{MatchGroupSuccess: &yes}, bson.M{"data.match_group_success": bson.M{"$ne": 0}}},
+		{"failure", EventQuery{MatchGroupSuccess: &no}, bson.M{"data.match_group_success": 0}},
+		{"git hash", EventQuery{GitHash: "abc"}, bson.M{"$or": []bson.M{
+			{"data.cateventheader.git_hash": "abc"},
+			{"data.cateventheader.git_hash_short": "abc"}}}},
+		{"fields", EventQuery{Direction: "in", State: "Lockout", CatciergeType: "haar", Device: "door", Missing: &no},
+			bson.M{"data.match_group_direction": "in", "data.state": "Lockout", "data.catcierge_type": "haar",
+				"device_id": "door", "missing": false}},
+		{"tags", EventQuery{Tags: []string{"prey", "night"}}, bson.M{"tags": bson.M{"$all": []string{"prey", "night"}}}},
+		{"created after", EventQuery{CreatedAfter: day}, bson.M{"created": bson.M{"$gt": day}}},
+	}
+
+	for _, tc := range tests {
+		if m := tc.query.MongoQuery(); !reflect.DeepEqual(m, tc.want) {
+			t.Errorf("%s: Expected %v, got %v", tc.name, tc.want, m)
+		}
+	}
+}
+
+func TestEventQueryMongoSort(t *testing.T) {
+	tests := []struct {
+		sort []string
+		want []string
+	}{
+		{[]string{"start"}, []string{"data.start.time", "_id"}},
+		{[]string{"-end", "name"}, []string{"-data.end.time", "name", "_id"}},
+		{[]string{"direction", "-match_group_success"}, []string{"data.match_group_direction", "-data.match_group_success", "_id"}},
+	}
+
+	for _, tc := range tests {
+		q := EventQuery{Sort: tc.sort}
+		if fields := q.MongoSort(); !reflect.DeepEqual(fields, tc.want) {
+			t.Errorf("%v: Expected %v, got %v", tc.sort, tc.want, fields)
+		}
+	}
+}
+
+// TestEventQueryMongoFields Makes sure the MongoDB fields used by the queries are where
+// the event fields end up in the stored BSON.
+func TestEventQueryMongoFields(t *testing.T) {
+	e := testEvent(1, "in")
+	e.Data.GitHash = "abc"
+	e.Data.GitHashShort = "a"
+
+	b, err := bson.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(path ...string) interface{} {
+		var v interface{} = m
+		for _, p := range path {
+			doc, ok := v.(bson.M)
+			if !ok {
+				return nil
+			}
+			v = doc[p]
+		}
+		return v
+	}
+
+	tests := []struct {
+		path []string
+		want interface{}
+	}{
+		{[]string{"data", "match_group_direction"}, "in"},
+		{[]string{"data", "cateventheader", "git_hash"}, "abc"},
+		{[]string{"data", "cateventheader", "git_hash_short"}, "a"},
+	}
+	for _, tc := range tests {
+		if v := lookup(tc.path...); v != tc.want {
+			t.Errorf("Expected %v at %v, got %v", tc.want, tc.path, v)
+		}
+	}
+
+	if _, ok := lookup("data", "start", "time").(time.Time); !ok {
+		t.Errorf("Expected a time at data.start.time, got %v", lookup("data", "start", "time"))
+	}
+}
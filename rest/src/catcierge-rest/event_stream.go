@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// Types of event notifications.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// eventStreamKeepAlive How often a comment is sent on an idle event stream,
+// so that proxies don't close the connection.
+const eventStreamKeepAlive = 30 * time.Second
+
+// eventStreamBuffer How many notifications a subscriber can fall behind before it is dropped.
+const eventStreamBuffer = 64
+
+// maxEventStreamReplay The max number of events sent when resuming a stream using Last-Event-ID.
+const maxEventStreamReplay = 1000
+
+// EventNotification Tells subscribers that an event was created, updated or deleted.
+type EventNotification struct {
+	Type  string
+	Event *CatEvent
+}
+
+// EventBroker Passes event notifications on to everyone that has subscribed.
+type EventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan EventNotification]bool
+	listeners   []*eventListener
+}
+
+// NewEventBroker Creates a new EventBroker.
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[chan EventNotification]bool)}
+}
+
+// eventListener Calls a handler for each notification in the order they were published.
+// The notifications are queued for as long as the handler takes, so none are ever dropped.
+type eventListener struct {
+	handle func(n EventNotification)
+	mutex  sync.Mutex
+	queue  []EventNotification
+	wake   chan struct{}
+}
+
+// push Queues a notification without waiting for the handler.
+func (l *eventListener) push(n EventNotification) {
+	l.mutex.Lock()
+	l.queue = append(l.queue, n)
+	l.mutex.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default: // Already woken up, the notification is picked up with the rest of the queue.
+	}
+}
+
+// run Hands the queued notifications to the handler. Never returns.
+func (l *eventListener) run() {
+	for range l.wake {
+		for {
+			l.mutex.Lock()
+			if len(l.queue) == 0 {
+				l.mutex.Unlock()
+				break
+			}
+			n := l.queue[0]
+			l.queue[0] = EventNotification{}
+			l.queue = l.queue[1:]
+			l.mutex.Unlock()
+
+			l.handle(n)
+		}
+	}
+}
+
+// Listen Calls handle in the background for every notification published from now on.
+// Unlike a subscriber a listener is never dropped, use it when no notification may be
+// missed, such as for webhooks. The handler should not block forever, the notifications
+// queue up in memory until it returns.
+func (b *EventBroker) Listen(handle func(n EventNotification)) {
+	l := &eventListener{handle: handle, wake: make(chan struct{}, 1)}
+	go l.run()
+
+	b.mutex.Lock()
+	b.listeners = append(b.listeners, l)
+	b.mutex.Unlock()
+}
+
+// Subscribe Returns a channel that receives all notifications. A subscriber that
+// falls too far behind is dropped and its channel is closed, so it never blocks the publisher.
+func (b *EventBroker) Subscribe() chan EventNotification {
+	ch := make(chan EventNotification, eventStreamBuffer)
+	b.mutex.Lock()
+	b.subscribers[ch] = true
+	b.mutex.Unlock()
+	return ch
+}
+
+// Unsubscribe Stops sending notifications to a channel.
+func (b *EventBroker) Unsubscribe(ch chan EventNotification) {
+	b.mutex.Lock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	b.mutex.Unlock()
+}
+
+// Publish Sends a notification to all listeners and subscribers. Each one gets its own
+// copy of the event, so that it can fill in the URLs for its own request.
+func (b *EventBroker) Publish(eventType string, e *CatEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, l := range b.listeners {
+		l.push(EventNotification{Type: eventType, Event: e.Copy()})
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- EventNotification{Type: eventType, Event: e.Copy()}:
+		default:
+			log.Printf("Dropping event subscriber that is too far behind")
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventStreamID The ID of an event in the stream, used to resume using Last-Event-ID.
+// The events are streamed in the order they were created, so that is what it is based on.
+func eventStreamID(e *CatEvent) string {
+	return strconv.FormatInt(e.Created.UnixNano(), 10)
+}
+
+// parseLastEventID Parses the Last-Event-ID header, a zero time if there is none.
+func parseLastEventID(request *restful.Request) (time.Time, error) {
+	s := request.HeaderParameter("Last-Event-ID")
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid Last-Event-ID '%s'", s)
+	}
+	return time.Unix(0, n), nil
+}
+
+// writeStreamEvent Writes an event to the stream in the Server-Sent Events format.
+func writeStreamEvent(w http.ResponseWriter, request *restful.Request, eventType string, e *CatEvent) error {
+	e.FillResponse(request)
+
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", eventStreamID(e), eventType, content)
+	return err
+}
+
+func (ev *CatEventsResource) streamEvents(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	query, err := ParseEventQuery(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only look for the events the caller can see, so they aren't left out of the replay limit.
+	if query.Accounts, err = authState.VisibleAccounts(ev.store); err != nil {
+		log.Printf("Failed to get the accounts of the user: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	lastCreated, err := parseLastEventID(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flusher, ok := response.ResponseWriter.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming is not supported by the response writer")
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Subscribe before catching up, so nothing created in between is missed.
+	ch := ev.broker.Subscribe()
+	defer ev.broker.Unsubscribe(ch)
+
+	var replay []CatEvent
+	if !lastCreated.IsZero() {
+		query.CreatedAfter = lastCreated
+		query.Sort = []string{"created"}
+		query.Limit = maxEventStreamReplay
+
+		if replay, err = ev.store.ListEvents(query); err != nil {
+			log.Printf("Failed to list events to resume stream: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	header := response.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+
+	// Tell the client how long to wait before reconnecting.
+	fmt.Fprintf(response, "retry: %d\n\n", 5000)
+
+	sent := make(map[string]bool)
+
+	send := func(eventType string, e *CatEvent) bool {
+		if sent[e.ID.Hex()] || !query.Match(e) || !authState.CanSeeEvent(ev.store, e) {
+			return true
+		}
+
+		if err := writeStreamEvent(response, request, eventType, e); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for i := range replay {
+		if !send(EventCreated, &replay[i]) {
+			return
+		}
+		// Events created while we were catching up are also in the channel.
+		sent[replay[i].ID.Hex()] = true
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case n, ok := <-ch:
+			if !ok {
+				// We fell behind, the client reconnects and catches up using Last-Event-ID.
+				return
+			}
+			if n.Type == EventCreated && !send(n.Type, n.Event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestEventBrokerListen(t *testing.T) {
+	broker := NewEventBroker()
+
+	ch := make(chan EventNotification, 1)
+	broker.Listen(func(n EventNotification) {
+		ch <- n
+	})
+
+	// A subscriber that never reads is dropped, but the listener gets everything in order.
+	sub := broker.Subscribe()
+
+	var ids []bson.ObjectId
+	for i := 0; i < 3*eventStreamBuffer; i++ {
+		e := &CatEvent{ID: bson.NewObjectId()}
+		ids = append(ids, e.ID)
+		broker.Publish(EventCreated, e)
+	}
+
+	for i, id := range ids {
+		select {
+		case n := <-ch:
+			if n.Event.ID != id {
+				t.Fatalf("Expected event %d to be %s, got %s", i, id.Hex(), n.Event.ID.Hex())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only got %d of %d notifications", i, len(ids))
+		}
+	}
+
+	received := 0
+	for range sub {
+		received++
+	}
+	if received != eventStreamBuffer {
+		t.Errorf("Expected the subscriber to get %d notifications before being dropped, got %d", eventStreamBuffer, received)
+	}
+}
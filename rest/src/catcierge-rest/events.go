@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
@@ -20,7 +25,7 @@ const DefaultPageOffset = 0
 // DefaultPageLimit The default page limit for pagination.
 const DefaultPageLimit = 10
 
-// DefaultMaxEventSize The default max ZIP size for a cat event.
+// DefaultMaxEventSize The default max archive size for a cat event.
 const DefaultMaxEventSize = 2 * MB
 
 // CatEvent Cat event.
@@ -30,19 +35,42 @@ type CatEvent struct {
 	Data    CatEventDataV1 `json:"data" bson:"data"`
 	Tags    []string       `json:"tags" bson:"tags"`
 	Missing bool           `json:"missing" bson:"missing"`
+
+	AccountID bson.ObjectId `json:"account_id,omitempty" bson:"account_id,omitempty"` // The account that uploaded the event, if any.
+	DeviceID  string        `json:"device_id,omitempty" bson:"device_id,omitempty"`   // The device that uploaded the event, if known.
+	Created   time.Time     `json:"created" bson:"created"`                           // When the event was uploaded.
+}
+
+// Copy Returns a copy of the event that can be changed without affecting the original.
+func (c *CatEvent) Copy() *CatEvent {
+	e := *c
+	e.Tags = append([]string(nil), c.Tags...)
+	e.Data.Matches = append([]CatEventMatchV1(nil), c.Data.Matches...)
+	for i := range e.Data.Matches {
+		e.Data.Matches[i].Steps = append([]CatEventMatchStepV1(nil), c.Data.Matches[i].Steps...)
+	}
+	return &e
 }
 
 // FillResponse This will fill a CatEvent struct with URLs based on the request origin
-// as well as the Path specified in the JSON.
+// as well as the Path specified in the JSON, and links to thumbnails of the images.
 func (c *CatEvent) FillResponse(request *restful.Request) {
+	eventURL := path.Join("/events", c.ID.Hex())
+
 	d := &c.Data
 	for mi := range d.Matches {
 		m := &d.Matches[mi]
-		m.Ref = ReverseURL(request.Request, path.Join(request.Request.URL.String(), m.Path))
+		m.Ref = ReverseURL(request.Request, path.Join(eventURL, m.Path))
+		if m.Path != "" {
+			m.Thumbnail = m.Ref + "?" + ThumbnailQuery()
+		}
 
 		for si := range m.Steps {
 			s := &m.Steps[si]
-			s.Ref = ReverseURL(request.Request, path.Join(request.Request.URL.String(), s.Path))
+			s.Ref = ReverseURL(request.Request, path.Join(eventURL, s.Path))
+			if s.Path != "" {
+				s.Thumbnail = s.Ref + "?" + ThumbnailQuery()
+			}
 		}
 	}
 }
@@ -50,6 +78,7 @@ func (c *CatEvent) FillResponse(request *restful.Request) {
 // CatEventsResource A REST resource representing the CatEvents.
 type CatEventsResource struct {
 	CatciergeResource
+	broker *EventBroker // Notifies about created, updated and deleted events.
 }
 
 // CatEventListResponse A response returned when listing the CatEventResource.
@@ -58,8 +87,6 @@ type CatEventListResponse struct {
 	Items []CatEvent `json:"items"`
 }
 
-var eventsKey key
-
 // FromEventsContext returns the CatEventResource in ctx, if any.
 func FromEventsContext(ctx context.Context) (*CatEventsResource, bool) {
 	ev, ok := ctx.Value(eventsKey).(*CatEventsResource)
@@ -72,12 +99,12 @@ func (ev *CatEventsResource) AddContext(c *context.Context) context.Context {
 }
 
 // NewEventsResource Create a new CatEventResource instance.
-func NewEventsResource(session *mgo.Session, settings *CatSettings) *CatEventsResource {
-	return &CatEventsResource{CatciergeResource{session: session, settings: settings}}
+func NewEventsResource(store CatciergeStore, settings *CatSettings) *CatEventsResource {
+	return &CatEventsResource{
+		CatciergeResource: CatciergeResource{store: store, settings: settings},
+		broker:            NewEventBroker()}
 }
 
-// TODO: Add a new resource for listing all images.
-
 // Register Registers the resource endpoints for a CatEventResource.
 func (ev CatEventsResource) Register(container *restful.Container) {
 	ws := new(restful.WebService)
@@ -93,54 +120,235 @@ func (ev CatEventsResource) Register(container *restful.Container) {
 		Doc("Get all events").
 		Returns(http.StatusOK, http.StatusText(http.StatusOK), CatEventListResponse{}).
 		Do(AddListRequestParams(ws),
+			AddEventQueryRequestParams(ws),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
 			ReturnsError(http.StatusInternalServerError)).
 		Writes(CatEventListResponse{}))
 
+	ws.Route(ws.GET("/stream").To(ev.streamEvents).
+		Doc("Get newly created events as they are uploaded, as Server-Sent Events. "+
+			"Takes the same filters as listing events, and resumes after the event given in the Last-Event-ID header").
+		Param(ws.HeaderParameter("Last-Event-ID", "Resume the stream after this event").DataType("string")).
+		Produces("text/event-stream").
+		Do(AddEventQueryRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", CatEvent{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)))
+
 	ws.Route(ws.GET("/{event-id}").To(ev.getEvent).
 		Doc("Get an event").
 		Param(eventID).
 		Do(ReturnsStatus(http.StatusOK, "", CatEvent{}),
+			ReturnsError(http.StatusUnauthorized),
 			ReturnsError(http.StatusNotFound),
 			ReturnsError(http.StatusInternalServerError)).
 		Writes(CatEvent{}))
 
+	ws.Route(ws.PATCH("/{event-id}").To(ev.patchEvent).
+		Doc("Change the name, tags, missing flag or false positive matches of an event using a JSON Merge Patch").
+		Param(eventID).
+		Consumes(MIMEMergePatch, restful.MIME_JSON).
+		Reads(CatEventPatch{}).
+		Do(ReturnsStatus(http.StatusOK, "", CatEvent{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusUnprocessableEntity),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(CatEvent{}))
+
+	ws.Route(ws.DELETE("/{event-id}").To(ev.deleteEvent).
+		Doc("Delete an event and all its files").
+		Param(eventID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{event-id}/animation.gif").To(ev.eventAnimation).
+		Doc("Get an animated GIF of the match images of an event in time order. The frames can be resized using 'w', 'h' and 'fit'").
+		Param(eventID).
+		Produces("image/gif", restful.MIME_JSON).
+		Do(AddEventAnimationRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", nil),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{event-id}/contact-sheet.png").To(ev.eventContactSheet).
+		Doc("Get a PNG with all match and step images of an event, labeled with the step names, match results, direction and success").
+		Param(eventID).
+		Param(ws.QueryParameter("cell", fmt.Sprintf("Width of each image, %d to %d",
+			MinContactSheetCellWidth, MaxContactSheetCellWidth)).
+			DataType("int").DefaultValue(strconv.Itoa(DefaultContactSheetCellWidth))).
+		Produces("image/png", restful.MIME_JSON).
+		Do(ReturnsStatus(http.StatusOK, "", nil),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
 	// Static images.
 	ws.Route(ws.GET("/{event-id}/{subpath:*}").To(ev.eventStaticFiles).
-		Doc("Get static files for an event such as images").
+		Doc("Get static files for an event such as images. JPEG and PNG images can be resized using 'w', 'h' and 'fit'. "+
+			"Match images can have the match result, direction, success, time and false positive flag drawn on them using 'overlay'").
 		Param(eventID).
-		Do(ReturnsStatus(http.StatusOK, "", CatEvent{}),
+		Param(ws.QueryParameter("overlay", "Draw the match metadata on a match image").
+			DataType("boolean")).
+		Do(AddImageResizeRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", nil),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
 			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusUnprocessableEntity),
 			ReturnsError(http.StatusInternalServerError)))
 
 	ws.Route(ws.POST("").To(ev.createEvent).
-		Doc("Create an event based on an event ZIP file").
+		Doc("Create an event based on an event ZIP, tar or tar.gz file. The event JSON version can be given using 'application/zip; version=1.0'. "+
+			"The archive format is sniffed from the file if the Content-Type doesn't say. "+
+			"The event can also be sent as multipart/form-data, with the event JSON in the '"+EventFormField+"' field and each image as a file part").
+		Consumes(append(EventArchiveContentTypes(), restful.MIME_OCTET, MIMEMultipartFormData)...).
+		Param(ws.QueryParameter("device", "ID of the device uploading the event, it is created if it doesn't exist. Not needed when using a device credential").DataType("string")).
 		Do(ReturnsStatus(http.StatusOK, "", CatEvent{}),
 			ReturnsError(http.StatusBadRequest),
 			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusForbidden),
+			ReturnsError(http.StatusNotFound),
 			ReturnsError(http.StatusConflict),
+			ReturnsError(http.StatusRequestEntityTooLarge),
+			ReturnsError(http.StatusUnsupportedMediaType),
 			ReturnsError(http.StatusInternalServerError)))
 
 	container.Add(ws)
 }
 
 func (ev *CatEventsResource) eventStaticFiles(req *restful.Request, resp *restful.Response) {
-	fullPath := path.Join(ev.settings.eventPath, req.PathParameter("event-id"), req.PathParameter("subpath"))
+	authState, err := IsAuthorizedForEvents(req, resp)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	subpath := req.PathParameter("subpath")
+
+	catEvent, ok := ev.getRequestEvent(req, resp, authState)
+	if !ok {
+		return
+	}
+	oid := catEvent.ID
+
+	fullPath, err := EventFilePath(EventDir(ev.settings.eventPath, oid), subpath)
+	if err != nil {
+		WriteCatciergeErrorString(resp, http.StatusNotFound, fmt.Sprintf("File '%s' could not be found", subpath))
+		return
+	}
+
+	resize, err := ParseImageResizeOptions(req)
+	if err != nil {
+		WriteCatciergeErrorString(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	overlay, err := parseQueryBool(req, "overlay")
+	if err != nil {
+		WriteCatciergeErrorString(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if resize != nil || (overlay != nil && *overlay) {
+		if !isResizableImage(fullPath) {
+			WriteCatciergeErrorString(resp, http.StatusBadRequest, "Only JPEG and PNG images can be resized or have an overlay")
+			return
+		}
+
+		if _, err := os.Stat(fullPath); err != nil {
+			WriteCatciergeErrorString(resp, http.StatusNotFound, fmt.Sprintf("File '%s' could not be found", subpath))
+			return
+		}
+
+		var match *CatEventMatchV1
+		cacheName := ""
+
+		if overlay != nil && *overlay {
+			var ok bool
+			if match, ok = FindEventMatch(catEvent, subpath); !ok {
+				WriteCatciergeErrorString(resp, http.StatusBadRequest, fmt.Sprintf("'%s' is not a match image, only match images can have an overlay", subpath))
+				return
+			}
+			cacheName = OverlayCacheName(subpath, match, resize)
+		} else {
+			cacheName = resize.CacheName(subpath)
+		}
+
+		// The generated images are cached next to the event directory.
+		cachePath, err := EventFilePath(EventCacheDir(ev.settings.eventPath, oid), cacheName)
+		if err != nil {
+			WriteCatciergeErrorString(resp, http.StatusNotFound, fmt.Sprintf("File '%s' could not be found", subpath))
+			return
+		}
+
+		if match != nil {
+			err = WriteMatchOverlayFile(fullPath, cachePath, match, resize)
+		} else {
+			err = ResizeImageFile(fullPath, cachePath, resize)
+		}
+
+		if err != nil {
+			log.Printf("Failed to create %s: %s", cachePath, err)
+			if _, ok := err.(*ImageTooLargeError); ok {
+				WriteCatciergeErrorString(resp, http.StatusUnprocessableEntity, err.Error())
+			} else {
+				WriteCatciergeErrorString(resp, http.StatusInternalServerError, "Failed to create the image")
+			}
+			return
+		}
+
+		fullPath = cachePath
+	}
+
 	log.Printf("GET %s", fullPath)
 	http.ServeFile(resp.ResponseWriter, req.Request, fullPath)
 }
 
-// List events. Supports pagination.
+// List events. Supports pagination, filtering and sorting.
 func (ev *CatEventsResource) listEvents(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
 	var l = CatEventListResponse{}
 	l.getListResponseParams(request)
 
-	count, err := ev.session.DB("catcierge").C("events").Count()
+	query, err := ParseEventQuery(request)
 	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Offset = l.Offset
+	query.Limit = l.Limit
+
+	if query.Accounts, err = authState.VisibleAccounts(ev.store); err != nil {
+		log.Printf("Failed to get the accounts of the user: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	count, err := ev.store.CountEvents(query)
+	if err != nil {
+		log.Printf("Failed to count items: %s", err)
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, fmt.Sprintf("Failed to get event count"))
+		return
 	}
 	l.Count = count
 
-	err = ev.session.DB("catcierge").C("events").Find(nil).Skip(l.Offset).Limit(l.Limit).Sort("start").All(&l.Items)
+	l.Items, err = ev.store.ListEvents(query)
 	if err != nil {
 		log.Printf("Failed to list items: %s", err)
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, fmt.Sprintf("Failed to list events"))
@@ -156,9 +364,6 @@ func (ev *CatEventsResource) listEvents(request *restful.Request, response *rest
 
 // Gets a single event.
 func (ev *CatEventsResource) getEvent(request *restful.Request, response *restful.Response) {
-	id := request.PathParameter("event-id")
-	oid := bson.ObjectIdHex(id[0:24])
-
 	account, ok := request.PathParameters()["account-name"]
 	if ok {
 		// TODO: Change the query based on if we have an accout name or not
@@ -166,63 +371,388 @@ func (ev *CatEventsResource) getEvent(request *restful.Request, response *restfu
 		return
 	}
 
-	catEvent := CatEvent{}
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	catEvent, ok := ev.getRequestEvent(request, response, authState)
+	if !ok {
+		return
+	}
 
-	if err := ev.session.DB("catcierge").C("events").FindId(oid).One(&catEvent); err != nil {
+	catEvent.FillResponse(request)
+	response.WriteEntity(catEvent)
+}
+
+// getRequestEvent Gets the event given by the event-id path parameter, writing
+// an error response if it can't be found. Events the caller can't see are not found.
+func (ev *CatEventsResource) getRequestEvent(request *restful.Request, response *restful.Response, authState *AuthenticationState) (*CatEvent, bool) {
+	id := request.PathParameter("event-id")
+	if !bson.IsObjectIdHex(id) {
 		WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Event '%s' could not be found", id))
+		return nil, false
+	}
+
+	catEvent, err := ev.store.GetEvent(bson.ObjectIdHex(id))
+	if err == nil && !authState.CanSeeEvent(ev.store, catEvent) {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Event '%s' could not be found", id))
+		} else {
+			log.Printf("Failed to get event %s: %s", id, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return nil, false
+	}
+
+	return catEvent, true
+}
+
+func (ev *CatEventsResource) eventAnimation(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	options, err := ParseEventAnimationOptions(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	catEvent, ok := ev.getRequestEvent(request, response, authState)
+	if !ok {
+		return
+	}
+
+	frames, err := EventAnimationFrames(EventDir(ev.settings.eventPath, catEvent.ID), catEvent)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusNotFound, err.Error())
 		return
 	}
 
+	cachePath := filepath.Join(EventCacheDir(ev.settings.eventPath, catEvent.ID), options.CacheName())
+
+	if err := WriteEventAnimation(frames, cachePath, options); err != nil {
+		log.Printf("Failed to create animation for event %s: %s", catEvent.ID.Hex(), err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to create the animation")
+		return
+	}
+
+	http.ServeFile(response.ResponseWriter, request.Request, cachePath)
+}
+
+func (ev *CatEventsResource) eventContactSheet(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	cellWidth, err := ParseContactSheetCellWidth(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	catEvent, ok := ev.getRequestEvent(request, response, authState)
+	if !ok {
+		return
+	}
+
+	if len(catEvent.Data.Matches) == 0 {
+		WriteCatciergeErrorString(response, http.StatusNotFound, "The event has no matches")
+		return
+	}
+
+	cachePath := filepath.Join(EventCacheDir(ev.settings.eventPath, catEvent.ID), ContactSheetCacheName(catEvent, cellWidth))
+
+	if err := WriteContactSheet(EventDir(ev.settings.eventPath, catEvent.ID), catEvent, cellWidth, cachePath); err != nil {
+		log.Printf("Failed to create contact sheet for event %s: %s", catEvent.ID.Hex(), err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to create the contact sheet")
+		return
+	}
+
+	http.ServeFile(response.ResponseWriter, request.Request, cachePath)
+}
+
+// IsAuthorizedForEvents Checks if the request is authenticated, which is needed to view or
+// change events. Which events the caller can see is up to CanSeeEvent and VisibleAccounts.
+func IsAuthorizedForEvents(request *restful.Request, response *restful.Response) (*AuthenticationState, error) {
+	authState, ok := FromAuthStateContext(request.Request.Context())
+	if !ok {
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return nil, errors.New("Failed to get authentication state from request context")
+	}
+
+	if !authState.IsAuthenticated {
+		WriteCatciergeErrorString(response, http.StatusUnauthorized,
+			"You must be logged in to view or change events")
+		return authState, errors.New("Unauthenticated user")
+	}
+
+	return authState, nil
+}
+
+// writeCatEventPatchError Writes the error response for a patch that is either
+// not valid JSON, or can't be applied to the event.
+func writeCatEventPatchError(response *restful.Response, err error) {
+	if _, ok := err.(CatEventPatchError); ok {
+		WriteCatciergeErrorString(response, http.StatusUnprocessableEntity, err.Error())
+	} else {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+	}
+}
+
+// Changes the user owned fields of an event.
+func (ev *CatEventsResource) patchEvent(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	catEvent, ok := ev.getRequestEvent(request, response, authState)
+	if !ok {
+		return
+	}
+	id := catEvent.ID.Hex()
+
+	if !authState.CanChangeEvent(ev.store, catEvent) {
+		WriteCatciergeErrorString(response, http.StatusForbidden, "Only the members of the account that uploaded an event can change it")
+		return
+	}
+
+	patch, err := ReadCatEventPatch(request.Request.Body)
+	if err != nil {
+		writeCatEventPatchError(response, err)
+		return
+	}
+
+	if err := patch.Apply(catEvent); err != nil {
+		writeCatEventPatchError(response, err)
+		return
+	}
+
+	if err := ev.store.UpdateEvent(catEvent); err != nil {
+		log.Printf("Failed to update event %s: %s", id, err)
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Event '%s' could not be found", id))
+		} else {
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	ev.broker.Publish(EventUpdated, catEvent)
+
+	catEvent.FillResponse(request)
 	response.WriteEntity(catEvent)
 }
 
-// Create a new catcierge event by uploading a ZIP file.
+// Deletes an event together with its files.
+func (ev *CatEventsResource) deleteEvent(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	catEvent, ok := ev.getRequestEvent(request, response, authState)
+	if !ok {
+		return
+	}
+	oid := catEvent.ID
+	id := oid.Hex()
+
+	if !authState.CanChangeEvent(ev.store, catEvent) {
+		WriteCatciergeErrorString(response, http.StatusForbidden, "Only the members of the account that uploaded an event can delete it")
+		return
+	}
+
+	// Move the files out of the way first, so they can be put back
+	// if we fail to delete the event from the database.
+	deletedDir, err := MoveEventDirAside(ev.settings.eventPath, oid)
+	if err != nil {
+		log.Printf("Failed to move files for event %s aside: %s", id, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := ev.store.DeleteEvent(oid); err != nil {
+		log.Printf("Failed to delete event %s: %s", id, err)
+		if deletedDir != "" {
+			if err := RestoreEventDir(ev.settings.eventPath, oid, deletedDir); err != nil {
+				log.Printf("Failed to restore files for event %s: %s", id, err)
+			}
+		}
+
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Event '%s' could not be found", id))
+		} else {
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	// If this fails the directory is removed by CleanupEventPath on the next start.
+	if deletedDir != "" {
+		if err := os.RemoveAll(deletedDir); err != nil {
+			log.Printf("Failed to remove files for event %s: %s", id, err)
+		}
+	}
+
+	if err := os.RemoveAll(EventCacheDir(ev.settings.eventPath, oid)); err != nil {
+		log.Printf("Failed to remove cached files for event %s: %s", id, err)
+	}
+
+	ev.broker.Publish(EventDeleted, catEvent)
+
+	log.Printf("Deleted event %s\n", id)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Create a new catcierge event by uploading a ZIP or tar archive, or a multipart form.
 func (ev *CatEventsResource) createEvent(request *restful.Request, response *restful.Response) {
-	// TODO: Copy the db session for this more costly operation.
-	fileSize := ByteSize(request.Request.ContentLength)
 	// TODO: Add check if user is logged in.
-	if fileSize >= DefaultMaxEventSize {
-		msg := fmt.Sprintf("Max file size allowed %s but got %s", DefaultMaxEventSize, fileSize)
+	maxSize := ev.settings.maxEventSize
+
+	// Fail early if we're told the size up front, chunked uploads are limited while streaming.
+	if request.Request.ContentLength > int64(maxSize) {
+		msg := fmt.Sprintf("Max file size allowed %s but got %s", maxSize, ByteSize(request.Request.ContentLength))
 		log.Println(msg)
-		WriteCatciergeErrorString(response, http.StatusBadRequest, msg)
+		WriteCatciergeErrorString(response, http.StatusRequestEntityTooLarge, msg)
 		return
 	}
 
+	// Save the upload on the filesystem temporarily.
+	uploadPath, fileSize, err := SaveUpload(request.Request.Body, ev.settings.tmpPath, "event", maxSize)
+	if err != nil {
+		if _, ok := err.(*CatUploadTooLargeError); ok {
+			log.Printf("Upload too large: %s", err)
+			WriteCatciergeErrorString(response, http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			log.Printf("Failed to save upload to a temp file for unpacking: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	defer os.Remove(uploadPath)
+
 	log.Printf("Received file of size %s\n", fileSize)
 
-	// Save the ZIP on the filesystem temporarily.
-	tmpfile, err := ioutil.TempFile("/tmp/", "event")
-	if err != nil {
-		log.Printf("Failed to create temp file for unzipping: %s", err)
-		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+	contentType := request.HeaderParameter("Content-Type")
+	versionHint := EventVersionFromContentType(contentType)
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	deviceID := request.QueryParameter("device")
+
+	if mediaType == MIMEMultipartFormData {
+		ev.createEventFromMultipart(request, response, uploadPath, params["boundary"], versionHint, deviceID)
 		return
 	}
 
-	defer os.Remove(tmpfile.Name())
+	ev.createEventFromArchive(request, response, uploadPath, EventArchiveFormatFromContentType(contentType), versionHint, deviceID)
+}
+
+// EventUnpacker Unpacks an uploaded event into the given directory.
+type EventUnpacker func(dest string) (*CatEventHeader, *CatEventDataV1, error)
+
+// Creates an event from a ZIP or tar archive that has been saved on the filesystem.
+// If the format is not known from the Content-Type it is sniffed from the file.
+func (ev *CatEventsResource) createEventFromArchive(request *restful.Request, response *restful.Response, archivePath string, format string, versionHint string, deviceID string) {
+	if format == "" {
+		var err error
+		if format, err = SniffEventArchiveFormat(archivePath); err != nil {
+			log.Printf("Failed to sniff archive format of %s: %s", archivePath, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+			return
+		}
+
+		if format == "" {
+			WriteCatciergeErrorString(response, http.StatusUnsupportedMediaType,
+				fmt.Sprintf("Unknown archive format, supported content types: %s", strings.Join(EventArchiveContentTypes(), ", ")))
+			return
+		}
 
-	content, err := ioutil.ReadAll(request.Request.Body)
+		log.Printf("Sniffed archive format %s", format)
+	}
+
+	ev.createEventFromUpload(request, response, deviceID, func(dest string) (*CatEventHeader, *CatEventDataV1, error) {
+		return UnpackEventArchive(format, archivePath, dest, versionHint, ev.settings.EventArchiveLimits())
+	})
+}
+
+// Creates an event from a multipart/form-data body that has been saved on the filesystem.
+func (ev *CatEventsResource) createEventFromMultipart(request *restful.Request, response *restful.Response, bodyPath string, boundary string, versionHint string, deviceID string) {
+	if boundary == "" {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, "The multipart/form-data Content-Type has no boundary")
+		return
+	}
+
+	f, err := os.Open(bodyPath)
 	if err != nil {
-		log.Printf("Failed to read body: %s\n", err)
+		log.Printf("Failed to open multipart upload %s: %s", bodyPath, err)
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
 		return
 	}
+	defer f.Close()
+
+	ev.createEventFromUpload(request, response, deviceID, func(dest string) (*CatEventHeader, *CatEventDataV1, error) {
+		return UnpackMultipartEvent(multipart.NewReader(f, boundary), dest, versionHint, ev.settings.EventArchiveLimits())
+	})
+}
 
-	if _, err := tmpfile.Write(content); err != nil {
-		log.Printf("Failed to write to tmpfile %v: %s", tmpfile.Name(), err)
+// Creates an event using an unpacker for the uploaded format. The device
+// the event is from is optional, it is created if it doesn't exist.
+func (ev *CatEventsResource) createEventFromUpload(request *restful.Request, response *restful.Response, deviceID string, unpack EventUnpacker) {
+	var accountID bson.ObjectId
+	if authState, ok := FromAuthStateContext(request.Request.Context()); ok {
+		if authState.Account != nil {
+			accountID = authState.Account.ID
+		}
+
+		var err error
+		if deviceID, err = authState.EventDeviceID(deviceID); err != nil {
+			WriteCatciergeErrorString(response, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	devices, ok := FromDevicesContext(request.Request.Context())
+	if !ok {
+		log.Printf("Failed to get devices resource from context")
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
 		return
 	}
-	if err := tmpfile.Close(); err != nil {
+
+	if deviceID != "" && !CheckEventDevice(response, deviceID, accountID) {
+		return
+	}
+
+	// Unpack the event to a staging directory, it is moved in place once the event is in the database.
+	stagingDir, err := NewEventStagingDir(ev.settings.eventPath)
+	if err != nil {
+		log.Printf("Failed to create staging directory for unpacking: %s", err)
 		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
 		return
 	}
 
-	// Unzip the file to the output directory.
-	eventHeader, eventData, err := UnzipEvent(tmpfile.Name(), ev.settings.eventPath)
+	defer os.RemoveAll(stagingDir)
+
+	eventHeader, eventData, err := unpack(stagingDir)
 	if err != nil {
-		log.Printf("Failed to unzip file %v to %v: %s", tmpfile.Name(), ev.settings.eventPath, err)
+		log.Printf("Failed to unpack event to %v: %s", stagingDir, err)
 		extra := ""
 		status := http.StatusInternalServerError
+		var problems []string
 
 		switch err.(type) {
 		case *CatJSONHeaderError:
@@ -233,21 +763,42 @@ func (ev *CatEventsResource) createEvent(request *restful.Request, response *res
 			extra = fmt.Sprintf("Failed to parse JSON for event %s. Expecting format %s: %s", eventHeader.ID, eventHeader.EventJSONVersion, err)
 			status = http.StatusBadRequest
 		case *CatJSONVersionError:
-			extra = fmt.Sprintf("Failed to parse JSON for event %s. Event JSON version %s is not supported.", eventHeader.ID, eventHeader.EventJSONVersion)
+			extra = fmt.Sprintf("Failed to parse JSON for event %s: %s", eventHeader.ID, err)
+			status = http.StatusBadRequest
+		case *CatArchiveError:
+			extra = "The event archive is invalid"
+			status = http.StatusBadRequest
+			problems = err.(*CatArchiveError).Problems
+		case *CatArchiveLimitError:
+			extra = err.Error()
 			status = http.StatusBadRequest
+		case *CatArchiveTooLargeError:
+			extra = err.Error()
+			status = http.StatusRequestEntityTooLarge
 		default:
 			break
 		}
-		WriteCatciergeErrorString(response, status, extra)
+		WriteCatciergeErrorProblems(response, status, extra, problems)
 		return
 	}
 
-	// Create the event in MongoDB.
-	catEvent := CatEvent{ID: bson.ObjectIdHex(eventData.ID[0:24]), Data: *eventData}
+	if len(eventData.ID) < 24 || !bson.IsObjectIdHex(eventData.ID[0:24]) {
+		WriteCatciergeErrorString(response, http.StatusBadRequest,
+			fmt.Sprintf("Invalid event ID '%s', expected a hex string of at least 24 characters", eventData.ID))
+		return
+	}
 
-	if err := ev.session.DB("catcierge").C("events").Insert(catEvent); err != nil {
+	// Create the event in the database.
+	catEvent := CatEvent{
+		ID:        bson.ObjectIdHex(eventData.ID[0:24]),
+		Data:      *eventData,
+		AccountID: accountID,
+		DeviceID:  deviceID,
+		Created:   time.Now().UTC().Truncate(time.Millisecond)} // Stored with millisecond precision.
+
+	if err := ev.store.InsertEvent(&catEvent); err != nil {
 		log.Printf("Failed to insert event in database: %s", err)
-		if mgo.IsDup(err) {
+		if err == ErrDuplicate {
 			// TODO: Return a link to the existing resource in this error.
 			WriteCatciergeErrorString(response, http.StatusConflict,
 				fmt.Sprintf("An event with this ID already exists: %s", eventData.ID))
@@ -257,6 +808,23 @@ func (ev *CatEventsResource) createEvent(request *restful.Request, response *res
 		return
 	}
 
+	if err := os.Rename(stagingDir, EventDir(ev.settings.eventPath, catEvent.ID)); err != nil {
+		log.Printf("Failed to move event %s in place: %s", eventData.ID, err)
+		if err := ev.store.DeleteEvent(catEvent.ID); err != nil {
+			log.Printf("Failed to delete event %s after failing to move it in place: %s", eventData.ID, err)
+		}
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	if deviceID != "" {
+		if err := devices.RecordEvent(&catEvent); err != nil {
+			log.Printf("Failed to record event %s for device %s: %s", eventData.ID, deviceID, err)
+		}
+	}
+
+	ev.broker.Publish(EventCreated, &catEvent)
+
 	catEvent.FillResponse(request)
 	response.WriteHeaderAndEntity(http.StatusCreated, catEvent)
 
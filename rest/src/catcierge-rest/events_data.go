@@ -77,6 +77,7 @@ type CatEventMatchStepV1 struct {
 	Name        string `json:"name" bson:"name"`
 	Path        string `json:"path" bson:"path"`
 	Ref         string `json:"ref,omitempty"`
+	Thumbnail   string `json:"thumbnail,omitempty" bson:"-"`
 }
 
 // CatEventMatchV1 Cat event match.
@@ -87,6 +88,7 @@ type CatEventMatchV1 struct {
 	Filename        string                `json:"filename" bson:"filename"`
 	Path            string                `json:"path" bson:"path"`
 	Ref             string                `json:"ref,omitempty"`
+	Thumbnail       string                `json:"thumbnail,omitempty" bson:"-"`
 	Result          float32               `json:"result" bson:"result"`
 	Success         int                   `json:"success" bson:"success"`
 	Time            CatEventTimeV1        `json:"time" bson:"time"`
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// testEventsContainer Returns a container with the events resource, where every
+// request is made with the given authentication state.
+func testEventsContainer(store CatciergeStore, settings *CatSettings, authState *AuthenticationState) *restful.Container {
+	container := restful.NewContainer()
+	container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		ctx := req.Request.Context()
+		req.Request = req.Request.WithContext(authState.AddContext(&ctx))
+		chain.ProcessFilter(req, resp)
+	})
+	NewEventsResource(store, settings).Register(container)
+	return container
+}
+
+func testServe(container *restful.Container, method string, url string) int {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Accept", "*/*")
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", MIMEMergePatch)
+	}
+	container.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestGetEventID(t *testing.T) {
+	store := NewMemoryStore()
+	e := testEvent(1, "in")
+	if err := store.InsertEvent(e); err != nil {
+		t.Fatalf("Failed to insert event: %s", err)
+	}
+
+	container := testEventsContainer(store, &CatSettings{}, NewAuthenticationState(true, &User{ID: bson.NewObjectId()}))
+
+	tests := []struct {
+		id     string
+		status int
+	}{
+		{e.ID.Hex(), http.StatusOK},
+		{bson.NewObjectId().Hex(), http.StatusNotFound},
+		{"abc", http.StatusNotFound},
+		{"zzzzzzzzzzzzzzzzzzzzzzzzzzzz", http.StatusNotFound},
+		{e.ID.Hex() + "00", http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		if status := testServe(container, "GET", "/events/"+tc.id); status != tc.status {
+			t.Errorf("GET /events/%s: Expected %d, got %d", tc.id, tc.status, status)
+		}
+	}
+}
+
+func TestEventsAccess(t *testing.T) {
+	store := NewMemoryStore()
+
+	alice := &User{ID: bson.NewObjectId(), Name: "alice"}
+	bob := &User{ID: bson.NewObjectId(), Name: "bob"}
+	home := &Account{ID: bson.NewObjectId(), Name: "Home", Users: []bson.ObjectId{alice.ID}}
+	cabin := &Account{ID: bson.NewObjectId(), Name: "Cabin", Users: []bson.ObjectId{bob.ID}}
+	for _, a := range []*Account{home, cabin} {
+		if err := store.InsertAccount(a); err != nil {
+			t.Fatalf("Failed to insert account: %s", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "catcierge-events-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	settings := &CatSettings{eventPath: dir}
+
+	homeEvent := testEvent(1, "in")
+	homeEvent.AccountID = home.ID
+	cabinEvent := testEvent(2, "in")
+	cabinEvent.AccountID = cabin.ID
+	anonymousEvent := testEvent(3, "in")
+
+	for _, e := range []*CatEvent{homeEvent, cabinEvent, anonymousEvent} {
+		if err := store.InsertEvent(e); err != nil {
+			t.Fatalf("Failed to insert event: %s", err)
+		}
+		os.MkdirAll(EventDir(dir, e.ID), 0755)
+		if err := ioutil.WriteFile(filepath.Join(EventDir(dir, e.ID), "event.json"), []byte("{}"), 0644); err != nil {
+			t.Fatalf("Failed to write event file: %s", err)
+		}
+	}
+
+	aliceAtHome := &AuthenticationState{IsAuthenticated: true, User: alice, Account: home}
+	anonymous := NewAuthenticationState(false, nil)
+
+	// Listing only shows the events of Alice's accounts, and the ones without an account.
+	w := httptest.NewRecorder()
+	testEventsContainer(store, settings, aliceAtHome).ServeHTTP(w, httptest.NewRequest("GET", "/events/", nil))
+	var l struct {
+		Count int        `json:"count"`
+		Items []CatEvent `json:"items"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+		t.Fatalf("Failed to decode event list: %s", err)
+	}
+	if l.Count != 2 || len(l.Items) != 2 {
+		t.Errorf("Expected 2 events, got count %d with %d items", l.Count, len(l.Items))
+	}
+	for _, e := range l.Items {
+		if e.ID == cabinEvent.ID {
+			t.Errorf("Expected the cabin event not to be listed")
+		}
+	}
+
+	tests := []struct {
+		name      string
+		authState *AuthenticationState
+		method    string
+		url       string
+		status    int
+	}{
+		{"list not logged in", anonymous, "GET", "/events/", http.StatusUnauthorized},
+		{"get not logged in", anonymous, "GET", "/events/" + homeEvent.ID.Hex(), http.StatusUnauthorized},
+		{"file not logged in", anonymous, "GET", "/events/" + homeEvent.ID.Hex() + "/event.json", http.StatusUnauthorized},
+		{"animation not logged in", anonymous, "GET", "/events/" + homeEvent.ID.Hex() + "/animation.gif", http.StatusUnauthorized},
+		{"contact sheet not logged in", anonymous, "GET", "/events/" + homeEvent.ID.Hex() + "/contact-sheet.png", http.StatusUnauthorized},
+		{"get own", aliceAtHome, "GET", "/events/" + homeEvent.ID.Hex(), http.StatusOK},
+		{"get without account", aliceAtHome, "GET", "/events/" + anonymousEvent.ID.Hex(), http.StatusOK},
+		{"get other account", aliceAtHome, "GET", "/events/" + cabinEvent.ID.Hex(), http.StatusNotFound},
+		{"file own", aliceAtHome, "GET", "/events/" + homeEvent.ID.Hex() + "/event.json", http.StatusOK},
+		{"file other account", aliceAtHome, "GET", "/events/" + cabinEvent.ID.Hex() + "/event.json", http.StatusNotFound},
+		{"animation other account", aliceAtHome, "GET", "/events/" + cabinEvent.ID.Hex() + "/animation.gif", http.StatusNotFound},
+		{"contact sheet other account", aliceAtHome, "GET", "/events/" + cabinEvent.ID.Hex() + "/contact-sheet.png", http.StatusNotFound},
+		{"patch other account", aliceAtHome, "PATCH", "/events/" + cabinEvent.ID.Hex(), http.StatusNotFound},
+		{"patch without account", aliceAtHome, "PATCH", "/events/" + anonymousEvent.ID.Hex(), http.StatusForbidden},
+		{"delete other account", aliceAtHome, "DELETE", "/events/" + cabinEvent.ID.Hex(), http.StatusNotFound},
+		{"delete without account", aliceAtHome, "DELETE", "/events/" + anonymousEvent.ID.Hex(), http.StatusForbidden},
+		{"delete not logged in", anonymous, "DELETE", "/events/" + homeEvent.ID.Hex(), http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		container := testEventsContainer(store, settings, tc.authState)
+		if status := testServe(container, tc.method, tc.url); status != tc.status {
+			t.Errorf("%s: %s %s: Expected %d, got %d", tc.name, tc.method, tc.url, tc.status, status)
+		}
+	}
+
+	if _, err := store.GetEvent(cabinEvent.ID); err != nil {
+		t.Errorf("Expected the cabin event to still exist, got %s", err)
+	}
+}
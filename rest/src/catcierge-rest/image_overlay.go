@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+)
+
+// overlayBackground Background of the overlay labels, so they can be read on any image.
+var overlayBackground = color.RGBA{0, 0, 0, 160}
+
+// FindEventMatch Returns the match of an event that has the given image path.
+func FindEventMatch(e *CatEvent, imagePath string) (*CatEventMatchV1, bool) {
+	p := cleanArchiveName(imagePath)
+
+	for i := range e.Data.Matches {
+		m := &e.Data.Matches[i]
+		if m.Path != "" && cleanArchiveName(m.Path) == p {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// OverlayCacheName Returns the file name a match image with an overlay is cached under.
+// A hash of the match is part of the name, since the match can change.
+func OverlayCacheName(name string, m *CatEventMatchV1, resize *ImageResizeOptions) string {
+	h := fnv.New32a()
+	fmt.Fprint(h, *m)
+
+	if resize != nil {
+		name = resize.CacheName(name)
+	}
+
+	return fmt.Sprintf("%s.overlay-%08x%s", name, h.Sum32(), filepath.Ext(name))
+}
+
+// DrawMatchOverlay Draws the metadata of a match onto its image: a border in the
+// color of the outcome, the result, direction and success at the top, the time
+// at the bottom and a flag if it has been marked as a false positive.
+func DrawMatchOverlay(img image.Image, m *CatEventMatchV1) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	small := w
+	if h < small {
+		small = h
+	}
+
+	// Grow the border and text with the image so it can be read on a thumbnail as well as full size.
+	border := small / 60
+	if border < 2 {
+		border = 2
+	}
+	scale := small / 240
+	if scale < 1 {
+		scale = 1
+	}
+
+	c := image.NewUniform(matchColor(m))
+	draw.Draw(dst, image.Rect(0, 0, w, border), c, image.ZP, draw.Src)
+	draw.Draw(dst, image.Rect(0, h-border, w, h), c, image.ZP, draw.Src)
+	draw.Draw(dst, image.Rect(0, 0, border, h), c, image.ZP, draw.Src)
+	draw.Draw(dst, image.Rect(w-border, 0, w, h), c, image.ZP, draw.Src)
+
+	success := "FAIL"
+	if m.Success != 0 {
+		success = "OK"
+	}
+	direction := m.Directon
+	if direction == "" {
+		direction = "unknown"
+	}
+
+	inner := w - 4*border
+	top := TruncateText(fmt.Sprintf("%.3f %s %s", m.Result, direction, success), inner, scale)
+	DrawLabel(dst, 2*border, 2*border, top, scale, matchColor(m), overlayBackground)
+
+	if !m.Time.IsZero() {
+		bottom := TruncateText(m.Time.Format("2006-01-02 15:04:05"), inner, scale)
+		y := h - 2*border - TextHeight(scale) - 2*scale
+		DrawLabel(dst, 2*border, y, bottom, scale, contactSheetText, overlayBackground)
+	}
+
+	if m.IsFalsePositive {
+		flag := "FALSE POSITIVE"
+		x := w - 2*border - TextWidth(flag, scale) - 2*scale
+		y := 2*border + TextHeight(scale) + 4*scale
+		if x < 2*border {
+			x = 2 * border
+		}
+		DrawLabel(dst, x, y, TruncateText(flag, inner, scale), scale, colorFalsePositive, overlayBackground)
+	}
+
+	return dst
+}
+
+// WriteMatchOverlayFile Draws the overlay onto a match image, optionally resized
+// first, and writes it to dst unless dst is already up to date.
+func WriteMatchOverlayFile(src string, dst string, m *CatEventMatchV1, resize *ImageResizeOptions) error {
+	if isCacheFresh(dst, src) {
+		return nil
+	}
+
+	img, err := decodeImageFile(src)
+	if err != nil {
+		return err
+	}
+
+	if resize != nil {
+		img = ResizeImage(img, resize)
+	}
+
+	return writeImageFile(dst, DrawMatchOverlay(img, m))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// Ways of fitting an image into the requested size.
+const (
+	FitContain = "contain" // Scale to fit inside the size, keeping the aspect ratio.
+	FitCover   = "cover"   // Scale to cover the size, keeping the aspect ratio, and crop the rest.
+	FitFill    = "fill"    // Stretch to exactly the size.
+)
+
+// MaxResizeDimension The largest width or height an image can be resized to.
+const MaxResizeDimension = 4096
+
+// MaxDecodePixels The most pixels an image can have to be decoded. The images are uploaded
+// with the events, so a small file claiming a huge size must not use up all the memory.
+const MaxDecodePixels = MaxResizeDimension * MaxResizeDimension
+
+// ImageTooLargeError Indicates that an image has more pixels than MaxDecodePixels.
+type ImageTooLargeError struct {
+	error
+}
+
+// DefaultThumbnailWidth The width of the thumbnails linked from events.
+const DefaultThumbnailWidth = 320
+
+// JPEGQuality The quality used when encoding resized JPEG images.
+const JPEGQuality = 85
+
+// ImageResizeOptions How an image should be resized. A zero width or
+// height means that it follows from the other using the aspect ratio.
+type ImageResizeOptions struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+// ThumbnailQuery The query string used for thumbnail URLs.
+func ThumbnailQuery() string {
+	return fmt.Sprintf("w=%d&fit=%s", DefaultThumbnailWidth, FitContain)
+}
+
+// parseQueryDimension Parses a width or height query parameter, 0 if not set.
+func parseQueryDimension(request *restful.Request, name string) (int, error) {
+	s := request.QueryParameter(name)
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := strconv.Atoi(s)
+	if err != nil || d <= 0 || d > MaxResizeDimension {
+		return 0, fmt.Errorf("Invalid size '%s' for '%s', expected 1 to %d", s, name, MaxResizeDimension)
+	}
+	return d, nil
+}
+
+// ParseImageResizeOptions Gets the resize options from the request query parameters.
+// Returns nil if the image should not be resized.
+func ParseImageResizeOptions(request *restful.Request) (*ImageResizeOptions, error) {
+	var err error
+	o := &ImageResizeOptions{Fit: request.QueryParameter("fit")}
+
+	if o.Width, err = parseQueryDimension(request, "w"); err != nil {
+		return nil, err
+	}
+
+	if o.Height, err = parseQueryDimension(request, "h"); err != nil {
+		return nil, err
+	}
+
+	if o.Width == 0 && o.Height == 0 {
+		if o.Fit != "" {
+			return nil, fmt.Errorf("'fit' needs a size given using 'w' and/or 'h'")
+		}
+		return nil, nil
+	}
+
+	switch o.Fit {
+	case "":
+		o.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+	default:
+		return nil, fmt.Errorf("Invalid fit '%s', expected one of: %s, %s, %s", o.Fit, FitContain, FitCover, FitFill)
+	}
+
+	return o, nil
+}
+
+// AddImageResizeRequestParams Sets the query parameters for resizing images.
+func AddImageResizeRequestParams(ws *restful.WebService) func(b *restful.RouteBuilder) {
+	return func(b *restful.RouteBuilder) {
+		b.Param(ws.QueryParameter("w", "Resize the image to this width").
+			DataType("int"))
+
+		b.Param(ws.QueryParameter("h", "Resize the image to this height").
+			DataType("int"))
+
+		b.Param(ws.QueryParameter("fit", fmt.Sprintf("How to fit the image into the size: %s (keep the aspect ratio), "+
+			"%s (keep the aspect ratio and crop) or %s (stretch)", FitContain, FitCover, FitFill)).
+			DataType("string").DefaultValue(FitContain))
+	}
+}
+
+// CacheName Returns the file name a resized variant of an image is cached under.
+func (o *ImageResizeOptions) CacheName(name string) string {
+	return fmt.Sprintf("%s.%dx%d-%s%s", name, o.Width, o.Height, o.Fit, filepath.Ext(name))
+}
+
+// targetRects Returns the size of the resized image, and the part of the source that is used.
+func (o *ImageResizeOptions) targetRects(src image.Rectangle) (int, int, image.Rectangle) {
+	sw, sh := src.Dx(), src.Dy()
+	w, h := o.Width, o.Height
+
+	// Only one side given, the other follows from the aspect ratio.
+	if w == 0 {
+		w = (sw*h + sh/2) / sh
+	}
+	if h == 0 {
+		h = (sh*w + sw/2) / sw
+	}
+
+	switch o.Fit {
+	case FitContain:
+		if sw*h > sh*w {
+			h = (sh*w + sw/2) / sw
+		} else {
+			w = (sw*h + sh/2) / sh
+		}
+
+		// Never make an image larger when keeping it inside a box.
+		if w > sw || h > sh {
+			w, h = sw, sh
+		}
+	case FitCover:
+		// Crop the source to the aspect ratio of the target, around the center.
+		cw, ch := sw, sh
+		if sw*h > sh*w {
+			cw = (sh*w + h/2) / h
+		} else {
+			ch = (sw*h + w/2) / w
+		}
+		x := src.Min.X + (sw-cw)/2
+		y := src.Min.Y + (sh-ch)/2
+		src = image.Rect(x, y, x+cw, y+ch)
+	}
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h, src
+}
+
+// scaleImage Scales part of an image to the given size. Each target pixel is the
+// average of the source pixels it covers, which gives smooth thumbnails.
+func scaleImage(img image.Image, src image.Rectangle, w int, h int) *image.RGBA {
+	// Work on premultiplied RGBA so transparent pixels don't bleed their color.
+	rgba := image.NewRGBA(image.Rect(0, 0, src.Dx(), src.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, src.Min, draw.Src)
+
+	sw, sh := src.Dx(), src.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		sy0 := y * sh / h
+		sy1 := (y + 1) * sh / h
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			sx0 := x * sw / w
+			sx1 := (x + 1) * sw / w
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				i := rgba.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(rgba.Pix[i])
+					g += uint32(rgba.Pix[i+1])
+					b += uint32(rgba.Pix[i+2])
+					a += uint32(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// ResizeImage Resizes an image using the options.
+func ResizeImage(img image.Image, o *ImageResizeOptions) image.Image {
+	w, h, src := o.targetRects(img.Bounds())
+	return scaleImage(img, src, w, h)
+}
+
+// isResizableImage Checks if we can resize an image based on its file extension.
+func isResizableImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// decodeImageFile Decodes a JPEG or PNG file. The size is read from the header
+// first, so that images with too many pixels are rejected before decoding them.
+func decodeImageFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxDecodePixels {
+		return nil, &ImageTooLargeError{fmt.Errorf("The image is %dx%d, which is more than the allowed %d pixels",
+			config.Width, config.Height, MaxDecodePixels)}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// writeCacheFile Writes a generated file using the given function. The file is
+// written to a temporary file first, so that a half written file is never
+// served while several requests create the same cached file.
+func writeCacheFile(name string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	err = write(tmpfile)
+
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+
+	return err
+}
+
+// writeImageFile Encodes an image as JPEG or PNG depending on the file extension.
+func writeImageFile(name string, img image.Image) error {
+	return writeCacheFile(name, func(w io.Writer) error {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".jpg", ".jpeg":
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: JPEGQuality})
+		}
+		return png.Encode(w, img)
+	})
+}
+
+// isCacheFresh Checks if a cached file exists and is newer than the files it was made from.
+func isCacheFresh(cached string, sources ...string) bool {
+	ci, err := os.Stat(cached)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range sources {
+		si, err := os.Stat(s)
+		if err != nil || si.ModTime().After(ci.ModTime()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ResizeImageFile Resizes an image file and writes it to dst, unless dst is
+// already an up to date resized version of it.
+func ResizeImageFile(src string, dst string, o *ImageResizeOptions) error {
+	if isCacheFresh(dst, src) {
+		return nil
+	}
+
+	img, err := decodeImageFile(src)
+	if err != nil {
+		return err
+	}
+
+	return writeImageFile(dst, ResizeImage(img, o))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// Kinds of event images.
+const (
+	ImageKindMatch = "match"
+	ImageKindStep  = "step"
+)
+
+// imageBatchSize How many events are fetched at a time when listing images.
+const imageBatchSize = 100
+
+// CatEventImage A match or step image from an event.
+type CatEventImage struct {
+	EventID         bson.ObjectId `json:"event_id"`
+	MatchID         string        `json:"match_id"`
+	Kind            string        `json:"kind"`           // match or step.
+	Step            string        `json:"step,omitempty"` // Step name, only for step images.
+	Direction       string        `json:"direction"`
+	Success         bool          `json:"success"`
+	IsFalsePositive bool          `json:"is_false_positive"`
+	Time            time.Time     `json:"time"`
+	Path            string        `json:"path"`
+	Ref             string        `json:"ref"`
+	Thumbnail       string        `json:"thumbnail"`
+}
+
+// CatEventImageListResponse A response returned when listing images. The events are only
+// gone through until the page is filled, so the count is the number of images up to and
+// including the page, and more tells if there are images after it.
+type CatEventImageListResponse struct {
+	ListResponseHeader
+	More  bool            `json:"more"`
+	Items []CatEventImage `json:"items"`
+}
+
+// ImageQuery Filters on the images themselves, the events are filtered using an EventQuery.
+type ImageQuery struct {
+	Kind    string
+	Steps   []string // Only step images with one of these step names.
+	Success *bool    // Only images from successful or failed matches.
+}
+
+// ParseImageQuery Gets the image filters from the request query parameters.
+func ParseImageQuery(request *restful.Request) (*ImageQuery, error) {
+	var err error
+	q := &ImageQuery{
+		Kind:  request.QueryParameter("kind"),
+		Steps: parseQueryList(request, "step")}
+
+	if q.Kind != "" && q.Kind != ImageKindMatch && q.Kind != ImageKindStep {
+		return nil, fmt.Errorf("Invalid kind '%s', expected %s or %s", q.Kind, ImageKindMatch, ImageKindStep)
+	}
+
+	if len(q.Steps) > 0 && q.Kind == ImageKindMatch {
+		return nil, fmt.Errorf("Can't filter on step names when only listing %s images", ImageKindMatch)
+	}
+
+	if q.Success, err = parseQueryBool(request, "success"); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Match Checks if an image matches all the filters in the query.
+func (q *ImageQuery) Match(img *CatEventImage) bool {
+	if q.Kind != "" && img.Kind != q.Kind {
+		return false
+	}
+	if q.Success != nil && img.Success != *q.Success {
+		return false
+	}
+
+	if len(q.Steps) > 0 {
+		if img.Kind != ImageKindStep {
+			return false
+		}
+		for _, s := range q.Steps {
+			if s == img.Step {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// EventImages Returns all the match and step images of an event.
+func EventImages(request *restful.Request, e *CatEvent) []CatEventImage {
+	var images []CatEventImage
+	eventURL := path.Join("/events", e.ID.Hex())
+
+	for _, m := range e.Data.Matches {
+		img := CatEventImage{
+			EventID:         e.ID,
+			MatchID:         m.ID,
+			Direction:       m.Directon,
+			Success:         m.Success != 0,
+			IsFalsePositive: m.IsFalsePositive,
+			Time:            m.Time.Time}
+
+		if m.Path != "" {
+			img.Kind = ImageKindMatch
+			img.Path = m.Path
+			img.Ref = ReverseURL(request.Request, path.Join(eventURL, m.Path))
+			img.Thumbnail = img.Ref + "?" + ThumbnailQuery()
+			images = append(images, img)
+		}
+
+		for _, s := range m.Steps {
+			if s.Path == "" {
+				continue
+			}
+			img.Kind = ImageKindStep
+			img.Step = s.Name
+			img.Path = s.Path
+			img.Ref = ReverseURL(request.Request, path.Join(eventURL, s.Path))
+			img.Thumbnail = img.Ref + "?" + ThumbnailQuery()
+			images = append(images, img)
+		}
+	}
+
+	return images
+}
+
+// ImagesResource A REST resource for browsing the images of all events.
+type ImagesResource struct {
+	CatciergeResource
+}
+
+// FromImagesContext returns the ImagesResource in ctx, if any.
+func FromImagesContext(ctx context.Context) (*ImagesResource, bool) {
+	im, ok := ctx.Value(imagesKey).(*ImagesResource)
+	return im, ok
+}
+
+// AddContext appends the ImagesResource to the request context.
+func (im *ImagesResource) AddContext(c *context.Context) context.Context {
+	return context.WithValue(*c, imagesKey, im)
+}
+
+// NewImagesResource Create a new ImagesResource instance.
+func NewImagesResource(store CatciergeStore, settings *CatSettings) *ImagesResource {
+	return &ImagesResource{CatciergeResource{store: store, settings: settings}}
+}
+
+// Register Registers the resource endpoints for an ImagesResource.
+func (im *ImagesResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.Path("/images").
+		Doc("Browse the match and step images of all events").
+		Produces(restful.MIME_JSON, restful.MIME_XML)
+
+	ws.Route(ws.GET("/").To(im.listImages).
+		Doc("Get a flat list of the match and step images of the events that can be seen, in the order of the events they belong to").
+		Do(AddListRequestParams(ws),
+			AddEventQueryRequestParams(ws),
+			AddImageQueryRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", CatEventImageListResponse{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(CatEventImageListResponse{}))
+
+	container.Add(ws)
+}
+
+// AddImageQueryRequestParams Sets the filter parameters for listing images.
+func AddImageQueryRequestParams(ws *restful.WebService) func(b *restful.RouteBuilder) {
+	return func(b *restful.RouteBuilder) {
+		b.Param(ws.QueryParameter("kind", fmt.Sprintf("Only %s or %s images", ImageKindMatch, ImageKindStep)).
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("step", "Only step images with one of these comma separated step names").
+			DataType("string"))
+
+		b.Param(ws.QueryParameter("success", "Only images from successful or failed matches").
+			DataType("boolean"))
+	}
+}
+
+func (im *ImagesResource) listImages(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	var l = CatEventImageListResponse{Items: []CatEventImage{}}
+	l.getListResponseParams(request)
+
+	eventQuery, err := ParseEventQuery(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	imageQuery, err := ParseImageQuery(request)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if eventQuery.Accounts, err = authState.VisibleAccounts(im.store); err != nil {
+		log.Printf("Failed to get the accounts of the user: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Images are not stored on their own, so go through the events in batches
+	// and page through the images they contain, until the page is filled.
+	eventQuery.Limit = imageBatchSize
+
+	for eventQuery.Offset = 0; !l.More; eventQuery.Offset += imageBatchSize {
+		events, err := im.store.ListEvents(eventQuery)
+		if err != nil {
+			log.Printf("Failed to list events for images: %s", err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list images")
+			return
+		}
+
+		for i := range events {
+			for _, img := range EventImages(request, &events[i]) {
+				if !imageQuery.Match(&img) {
+					continue
+				}
+
+				if l.Limit > 0 && l.Count >= l.Offset+l.Limit {
+					l.More = true
+					break
+				}
+
+				if l.Count >= l.Offset {
+					l.Items = append(l.Items, img)
+				}
+				l.Count++
+			}
+
+			if l.More {
+				break
+			}
+		}
+
+		if len(events) < imageBatchSize {
+			break
+		}
+	}
+
+	response.WriteEntity(l)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestBasicTokenAuthenticate(t *testing.T) {
+	store := NewMemoryStore()
+
+	user := &User{ID: bson.NewObjectId(), Name: "alice"}
+	account := &Account{ID: bson.NewObjectId(), Name: "Home", Users: []bson.ObjectId{user.ID}}
+	if err := store.InsertUser(user); err != nil {
+		t.Fatalf("Failed to insert user: %s", err)
+	}
+	if err := store.InsertAccount(account); err != nil {
+		t.Fatalf("Failed to insert account: %s", err)
+	}
+	if err := store.InsertToken(&AccessToken{ID: bson.NewObjectId(), Name: "test", Token: "secret",
+		UserID: user.ID, AccountID: account.ID}); err != nil {
+		t.Fatalf("Failed to insert token: %s", err)
+	}
+
+	credential := DeviceCredentialPrefix + "door"
+	device := newDevice(account.ID, "door", time.Now())
+	device.CredentialHash = HashDeviceCredential(credential)
+	if err := store.InsertDevice(device); err != nil {
+		t.Fatalf("Failed to insert device: %s", err)
+	}
+
+	// The handler says who the request is authenticated as.
+	users := NewUserResource(store, &CatSettings{})
+	container := restful.NewContainer()
+	container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		ctx := req.Request.Context()
+		req.Request = req.Request.WithContext(users.AddContext(&ctx))
+		chain.ProcessFilter(req, resp)
+	})
+	container.Filter(basicTokenAuthenticate)
+
+	ws := new(restful.WebService)
+	ws.Produces(restful.MIME_JSON)
+	whoami := func(req *restful.Request, resp *restful.Response) {
+		authState, ok := FromAuthStateContext(req.Request.Context())
+		switch {
+		case !ok:
+			resp.WriteHeader(http.StatusInternalServerError)
+		case !authState.IsAuthenticated:
+			resp.Write([]byte("anonymous"))
+		case authState.Device != nil:
+			resp.Write([]byte("device " + authState.Device.ID))
+		default:
+			resp.Write([]byte("user " + authState.User.Name))
+		}
+	}
+	ws.Route(ws.GET("/accounts").To(whoami))
+	ws.Route(ws.POST("/events").To(whoami))
+	container.Add(ws)
+
+	tests := []struct {
+		method        string
+		path          string
+		authorization string
+		status        int
+		body          string
+	}{
+		{"GET", "/accounts", "", http.StatusOK, "anonymous"},
+		{"GET", "/accounts", "Basic YWxpY2U6c2VjcmV0", http.StatusOK, "anonymous"},
+		{"GET", "/accounts", "token secret", http.StatusOK, "user alice"},
+		{"GET", "/accounts", "token  secret ", http.StatusOK, "user alice"},
+		{"GET", "/accounts", "token wrong", http.StatusUnauthorized, ""},
+		{"GET", "/accounts", "token " + DeviceCredentialPrefix + "wrong", http.StatusUnauthorized, ""},
+		{"POST", "/events", "token " + credential, http.StatusOK, "device door"},
+		{"GET", "/accounts", "token " + credential, http.StatusForbidden, ""},
+	}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		container.ServeHTTP(w, req)
+
+		if w.Code != tc.status || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("%s %s with %q: Expected %d %q, got %d %q", tc.method, tc.path, tc.authorization,
+				tc.status, tc.body, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// MemoryStore A CatciergeStore that keeps everything in memory.
+// Useful for tests and throwaway demo instances, nothing is persisted.
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	events   map[bson.ObjectId]*CatEvent
+	users    map[bson.ObjectId]*User
+	accounts map[bson.ObjectId]*Account
+	tokens   map[bson.ObjectId]*AccessToken
+	webhooks map[bson.ObjectId]*Webhook
+
+	deliveries map[bson.ObjectId][]WebhookDelivery // Webhook ID -> deliveries, oldest first.
+
+	devices     map[string]*Device
+	transitions map[string][]DeviceTransition // Device key -> transitions, oldest first.
+	commands    map[string][]*DeviceCommand   // Device key -> commands, oldest first.
+	pairing     map[string]*DevicePairingCode
+}
+
+// NewMemoryStore Creates a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		events:   make(map[bson.ObjectId]*CatEvent),
+		users:    make(map[bson.ObjectId]*User),
+		accounts: make(map[bson.ObjectId]*Account),
+		tokens:   make(map[bson.ObjectId]*AccessToken),
+		webhooks: make(map[bson.ObjectId]*Webhook),
+
+		deliveries: make(map[bson.ObjectId][]WebhookDelivery),
+
+		devices:     make(map[string]*Device),
+		transitions: make(map[string][]DeviceTransition),
+		commands:    make(map[string][]*DeviceCommand),
+		pairing:     make(map[string]*DevicePairingCode)}
+}
+
+// Close Does nothing for the MemoryStore.
+func (m *MemoryStore) Close() {
+}
+
+// deepCopy Copies src into dst by round tripping through BSON, so that
+// callers never share slices with what is kept in the store.
+func deepCopy(dst interface{}, src interface{}) error {
+	b, err := bson.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, dst)
+}
+
+// queryEvents Returns all events matching the query in sorted order. Must hold the lock.
+func (m *MemoryStore) queryEvents(query *EventQuery) []*CatEvent {
+	events := make([]*CatEvent, 0, len(m.events))
+	for _, e := range m.events {
+		if query.Match(e) {
+			events = append(events, e)
+		}
+	}
+
+	query.SortEvents(events)
+	return events
+}
+
+// CountEvents Counts the events matching the query filters.
+func (m *MemoryStore) CountEvents(query *EventQuery) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.queryEvents(query)), nil
+}
+
+// ListEvents Lists a page of events matching the query.
+func (m *MemoryStore) ListEvents(query *EventQuery) ([]CatEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.queryEvents(query)
+	start, end := pageBounds(len(all), query.Offset, query.Limit)
+
+	events := make([]CatEvent, end-start)
+	for i, e := range all[start:end] {
+		if err := deepCopy(&events[i], e); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// GetEvent Gets a single event.
+func (m *MemoryStore) GetEvent(id bson.ObjectId) (*CatEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	e, ok := m.events[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var event CatEvent
+	if err := deepCopy(&event, e); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// InsertEvent Inserts a new event.
+func (m *MemoryStore) InsertEvent(event *CatEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.events[event.ID]; ok {
+		return ErrDuplicate
+	}
+
+	var e CatEvent
+	if err := deepCopy(&e, event); err != nil {
+		return err
+	}
+	m.events[event.ID] = &e
+	return nil
+}
+
+// UpdateEvent Replaces an existing event.
+func (m *MemoryStore) UpdateEvent(event *CatEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.events[event.ID]; !ok {
+		return ErrNotFound
+	}
+
+	var e CatEvent
+	if err := deepCopy(&e, event); err != nil {
+		return err
+	}
+	m.events[event.ID] = &e
+	return nil
+}
+
+// DeleteEvent Deletes an event.
+func (m *MemoryStore) DeleteEvent(id bson.ObjectId) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.events[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.events, id)
+	return nil
+}
+
+// CountUsers Counts all users.
+func (m *MemoryStore) CountUsers() (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.users), nil
+}
+
+// ListUsers Lists a page of users ordered by ID.
+func (m *MemoryStore) ListUsers(offset int, limit int) ([]User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	start, end := pageBounds(len(users), offset, limit)
+	return users[start:end], nil
+}
+
+// GetUser Gets a single user.
+func (m *MemoryStore) GetUser(id bson.ObjectId) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	user := *u
+	return &user, nil
+}
+
+// InsertUser Inserts a new user.
+func (m *MemoryStore) InsertUser(user *User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.users[user.ID]; ok {
+		return ErrDuplicate
+	}
+
+	u := *user
+	m.users[user.ID] = &u
+	return nil
+}
+
+// CountAccounts Counts all accounts.
+func (m *MemoryStore) CountAccounts() (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.accounts), nil
+}
+
+// ListAccounts Lists a page of accounts ordered by ID.
+func (m *MemoryStore) ListAccounts(offset int, limit int) ([]Account, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	accounts := make([]Account, 0, len(m.accounts))
+	for _, a := range m.accounts {
+		var account Account
+		if err := deepCopy(&account, a); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+
+	start, end := pageBounds(len(accounts), offset, limit)
+	return accounts[start:end], nil
+}
+
+// GetAccount Gets a single account.
+func (m *MemoryStore) GetAccount(id bson.ObjectId) (*Account, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var account Account
+	if err := deepCopy(&account, a); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ListUserAccounts Lists the accounts a user is a member of, ordered by ID.
+func (m *MemoryStore) ListUserAccounts(userID bson.ObjectId) ([]Account, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	accounts := []Account{}
+	for _, a := range m.accounts {
+		for _, u := range a.Users {
+			if u != userID {
+				continue
+			}
+
+			var account Account
+			if err := deepCopy(&account, a); err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, account)
+			break
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+
+	return accounts, nil
+}
+
+// InsertAccount Inserts a new account.
+func (m *MemoryStore) InsertAccount(account *Account) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.accounts[account.ID]; ok {
+		return ErrDuplicate
+	}
+
+	var a Account
+	if err := deepCopy(&a, account); err != nil {
+		return err
+	}
+	m.accounts[account.ID] = &a
+	return nil
+}
+
+// CountTokens Counts all access tokens.
+func (m *MemoryStore) CountTokens() (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.tokens), nil
+}
+
+// ListTokens Lists a page of access tokens ordered by ID.
+func (m *MemoryStore) ListTokens(offset int, limit int) ([]AccessToken, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	tokens := make([]AccessToken, 0, len(m.tokens))
+	for _, t := range m.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	start, end := pageBounds(len(tokens), offset, limit)
+	return tokens[start:end], nil
+}
+
+// findToken Finds the first token matching the predicate. Must hold the lock.
+func (m *MemoryStore) findToken(match func(t *AccessToken) bool) (*AccessToken, error) {
+	for _, t := range m.tokens {
+		if match(t) {
+			token := *t
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetToken Gets an access token by its token string.
+func (m *MemoryStore) GetToken(token string) (*AccessToken, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.findToken(func(t *AccessToken) bool { return t.Token == token })
+}
+
+// GetTokenByName Gets an access token by its name.
+func (m *MemoryStore) GetTokenByName(name string) (*AccessToken, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.findToken(func(t *AccessToken) bool { return t.Name == name })
+}
+
+// InsertToken Inserts a new access token. Both the token string and name must be unique.
+func (m *MemoryStore) InsertToken(token *AccessToken) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.tokens[token.ID]; ok {
+		return ErrDuplicate
+	}
+
+	if _, err := m.findToken(func(t *AccessToken) bool {
+		return t.Token == token.Token || t.Name == token.Name
+	}); err == nil {
+		return ErrDuplicate
+	}
+
+	t := *token
+	m.tokens[token.ID] = &t
+	return nil
+}
+
+// queryWebhooks Returns the webhooks of an account ordered by ID. Must hold the lock.
+func (m *MemoryStore) queryWebhooks(accountID bson.ObjectId) []*Webhook {
+	webhooks := make([]*Webhook, 0, len(m.webhooks))
+	for _, w := range m.webhooks {
+		if w.AccountID == accountID {
+			webhooks = append(webhooks, w)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks
+}
+
+// CountWebhooks Counts the webhooks of an account.
+func (m *MemoryStore) CountWebhooks(accountID bson.ObjectId) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.queryWebhooks(accountID)), nil
+}
+
+// ListWebhooks Lists a page of the webhooks of an account ordered by ID.
+func (m *MemoryStore) ListWebhooks(accountID bson.ObjectId, offset int, limit int) ([]Webhook, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.queryWebhooks(accountID)
+	start, end := pageBounds(len(all), offset, limit)
+
+	webhooks := make([]Webhook, end-start)
+	for i, w := range all[start:end] {
+		if err := deepCopy(&webhooks[i], w); err != nil {
+			return nil, err
+		}
+	}
+	return webhooks, nil
+}
+
+// GetWebhook Gets a single webhook.
+func (m *MemoryStore) GetWebhook(id bson.ObjectId) (*Webhook, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	w, ok := m.webhooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var webhook Webhook
+	if err := deepCopy(&webhook, w); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// InsertWebhook Inserts a new webhook.
+func (m *MemoryStore) InsertWebhook(webhook *Webhook) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.webhooks[webhook.ID]; ok {
+		return ErrDuplicate
+	}
+
+	var w Webhook
+	if err := deepCopy(&w, webhook); err != nil {
+		return err
+	}
+	m.webhooks[webhook.ID] = &w
+	return nil
+}
+
+// UpdateWebhook Replaces an existing webhook.
+func (m *MemoryStore) UpdateWebhook(webhook *Webhook) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.webhooks[webhook.ID]; !ok {
+		return ErrNotFound
+	}
+
+	var w Webhook
+	if err := deepCopy(&w, webhook); err != nil {
+		return err
+	}
+	m.webhooks[webhook.ID] = &w
+	return nil
+}
+
+// DeleteWebhook Deletes a webhook and its delivery log.
+func (m *MemoryStore) DeleteWebhook(id bson.ObjectId) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.webhooks, id)
+	delete(m.deliveries, id)
+	return nil
+}
+
+// CountWebhookDeliveries Counts the logged deliveries of a webhook.
+func (m *MemoryStore) CountWebhookDeliveries(webhookID bson.ObjectId) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.deliveries[webhookID]), nil
+}
+
+// ListWebhookDeliveries Lists a page of the logged deliveries of a webhook, newest first.
+func (m *MemoryStore) ListWebhookDeliveries(webhookID bson.ObjectId, offset int, limit int) ([]WebhookDelivery, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.deliveries[webhookID]
+	start, end := pageBounds(len(all), offset, limit)
+
+	deliveries := make([]WebhookDelivery, 0, end-start)
+	for i := start; i < end; i++ {
+		deliveries = append(deliveries, all[len(all)-1-i])
+	}
+	return deliveries, nil
+}
+
+// InsertWebhookDelivery Logs a delivery of a webhook.
+func (m *MemoryStore) InsertWebhookDelivery(delivery *WebhookDelivery) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.webhooks[delivery.WebhookID]; !ok {
+		return ErrNotFound
+	}
+
+	m.deliveries[delivery.WebhookID] = append(m.deliveries[delivery.WebhookID], *delivery)
+	return nil
+}
+
+// queryDevices Returns the devices of an account, or of all accounts, ordered by ID. Must hold the lock.
+func (m *MemoryStore) queryDevices(accountID bson.ObjectId) []*Device {
+	devices := make([]*Device, 0, len(m.devices))
+	for _, d := range m.devices {
+		if accountID == "" || d.AccountID == accountID {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// CountDevices Counts the devices of an account.
+func (m *MemoryStore) CountDevices(accountID bson.ObjectId) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.queryDevices(accountID)), nil
+}
+
+// ListDevices Lists a page of the devices of an account ordered by ID.
+func (m *MemoryStore) ListDevices(accountID bson.ObjectId, offset int, limit int) ([]Device, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.queryDevices(accountID)
+	start, end := pageBounds(len(all), offset, limit)
+
+	devices := make([]Device, end-start)
+	for i, d := range all[start:end] {
+		if err := deepCopy(&devices[i], d); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+// GetDevice Gets a single device.
+func (m *MemoryStore) GetDevice(key string) (*Device, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	d, ok := m.devices[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var device Device
+	if err := deepCopy(&device, d); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// GetDeviceByCredential Gets the device that was issued a credential, by the hash of the credential.
+func (m *MemoryStore) GetDeviceByCredential(credentialHash string) (*Device, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, d := range m.devices {
+		if d.CredentialHash != "" && d.CredentialHash == credentialHash {
+			var device Device
+			if err := deepCopy(&device, d); err != nil {
+				return nil, err
+			}
+			return &device, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// InsertDevice Inserts a new device.
+func (m *MemoryStore) InsertDevice(device *Device) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.devices[device.Key]; ok {
+		return ErrDuplicate
+	}
+
+	var d Device
+	if err := deepCopy(&d, device); err != nil {
+		return err
+	}
+	m.devices[device.Key] = &d
+	return nil
+}
+
+// UpdateDevice Replaces an existing device.
+func (m *MemoryStore) UpdateDevice(device *Device) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.devices[device.Key]; !ok {
+		return ErrNotFound
+	}
+
+	var d Device
+	if err := deepCopy(&d, device); err != nil {
+		return err
+	}
+	m.devices[device.Key] = &d
+	return nil
+}
+
+// DeleteDevice Deletes a device, its logged transitions and its commands.
+func (m *MemoryStore) DeleteDevice(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.devices[key]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.devices, key)
+	delete(m.transitions, key)
+	delete(m.commands, key)
+	return nil
+}
+
+// CountDeviceTransitions Counts the logged transitions of a device.
+func (m *MemoryStore) CountDeviceTransitions(deviceKey string) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.transitions[deviceKey]), nil
+}
+
+// ListDeviceTransitions Lists a page of the logged transitions of a device, newest first.
+func (m *MemoryStore) ListDeviceTransitions(deviceKey string, offset int, limit int) ([]DeviceTransition, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.transitions[deviceKey]
+	start, end := pageBounds(len(all), offset, limit)
+
+	transitions := make([]DeviceTransition, 0, end-start)
+	for i := start; i < end; i++ {
+		transitions = append(transitions, all[len(all)-1-i])
+	}
+	return transitions, nil
+}
+
+// InsertDeviceTransition Logs a transition of a device.
+func (m *MemoryStore) InsertDeviceTransition(transition *DeviceTransition) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.devices[transition.DeviceKey]; !ok {
+		return ErrNotFound
+	}
+
+	m.transitions[transition.DeviceKey] = append(m.transitions[transition.DeviceKey], *transition)
+	return nil
+}
+
+// CountDeviceCommands Counts the commands of a device.
+func (m *MemoryStore) CountDeviceCommands(deviceKey string) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.commands[deviceKey]), nil
+}
+
+// ListDeviceCommands Lists a page of the commands of a device, newest first.
+func (m *MemoryStore) ListDeviceCommands(deviceKey string, offset int, limit int) ([]DeviceCommand, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	all := m.commands[deviceKey]
+	start, end := pageBounds(len(all), offset, limit)
+
+	commands := make([]DeviceCommand, end-start)
+	for i := start; i < end; i++ {
+		if err := deepCopy(&commands[i-start], all[len(all)-1-i]); err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+// ListOpenDeviceCommands Lists the commands of a device that are queued or delivered, oldest first.
+// An empty device key lists the open commands of all devices.
+func (m *MemoryStore) ListOpenDeviceCommands(deviceKey string) ([]DeviceCommand, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var all []*DeviceCommand
+	if deviceKey == "" {
+		for _, c := range m.commands {
+			all = append(all, c...)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	} else {
+		all = m.commands[deviceKey]
+	}
+
+	commands := []DeviceCommand{}
+	for _, c := range all {
+		if c.IsOpen() {
+			var command DeviceCommand
+			if err := deepCopy(&command, c); err != nil {
+				return nil, err
+			}
+			commands = append(commands, command)
+		}
+	}
+	return commands, nil
+}
+
+// findDeviceCommand Finds a command of a device. Must hold the lock.
+func (m *MemoryStore) findDeviceCommand(deviceKey string, id bson.ObjectId) (int, error) {
+	for i, c := range m.commands[deviceKey] {
+		if c.ID == id {
+			return i, nil
+		}
+	}
+	return -1, ErrNotFound
+}
+
+// GetDeviceCommand Gets a single command of a device.
+func (m *MemoryStore) GetDeviceCommand(deviceKey string, id bson.ObjectId) (*DeviceCommand, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	i, err := m.findDeviceCommand(deviceKey, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var command DeviceCommand
+	if err := deepCopy(&command, m.commands[deviceKey][i]); err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+// InsertDeviceCommand Queues a new command for a device.
+func (m *MemoryStore) InsertDeviceCommand(command *DeviceCommand) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.devices[command.DeviceKey]; !ok {
+		return ErrNotFound
+	}
+
+	if _, err := m.findDeviceCommand(command.DeviceKey, command.ID); err == nil {
+		return ErrDuplicate
+	}
+
+	var c DeviceCommand
+	if err := deepCopy(&c, command); err != nil {
+		return err
+	}
+	m.commands[command.DeviceKey] = append(m.commands[command.DeviceKey], &c)
+	return nil
+}
+
+// UpdateDeviceCommand Replaces an existing command.
+func (m *MemoryStore) UpdateDeviceCommand(command *DeviceCommand) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i, err := m.findDeviceCommand(command.DeviceKey, command.ID)
+	if err != nil {
+		return err
+	}
+
+	var c DeviceCommand
+	if err := deepCopy(&c, command); err != nil {
+		return err
+	}
+	m.commands[command.DeviceKey][i] = &c
+	return nil
+}
+
+// InsertPairingCode Inserts a new pairing code.
+func (m *MemoryStore) InsertPairingCode(code *DevicePairingCode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.pairing[code.Code]; ok {
+		return ErrDuplicate
+	}
+
+	c := *code
+	m.pairing[code.Code] = &c
+	return nil
+}
+
+// TakePairingCode Gets and deletes a pairing code.
+func (m *MemoryStore) TakePairingCode(code string) (*DevicePairingCode, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.pairing[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	delete(m.pairing, code)
+	return c, nil
+}
+
+// DeleteExpiredPairingCodes Deletes the pairing codes that have expired.
+func (m *MemoryStore) DeleteExpiredPairingCodes(now time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for code, c := range m.pairing {
+		if !now.Before(c.Expires) {
+			delete(m.pairing, code)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// MongoDatabase The name of the MongoDB database we store everything in.
+const MongoDatabase = "catcierge"
+
+// MongoStore A CatciergeStore backed by MongoDB.
+type MongoStore struct {
+	session *mgo.Session
+}
+
+// DialMongo Dials the MongoDB instance.
+func DialMongo(mongoURL string) *mgo.Session {
+	log.Printf("Attempting to dial %s", mongoURL)
+
+	session, err := mgo.Dial(mongoURL)
+	if err != nil {
+		log.Printf("Failed to dial MongoDB: %s", mongoURL)
+		panic(err)
+	}
+
+	return session
+}
+
+// NewMongoStore Creates a new MongoStore using the given session.
+func NewMongoStore(session *mgo.Session) *MongoStore {
+	m := &MongoStore{session: session}
+
+	s := session.Copy()
+	defer s.Close()
+
+	indexes := map[string][]string{
+		"tokens": {"token", "name"},
+	}
+
+	for collection, keys := range indexes {
+		for _, k := range keys {
+			index := mgo.Index{Key: []string{k}, Unique: true}
+			if err := s.DB(MongoDatabase).C(collection).EnsureIndex(index); err != nil {
+				log.Printf("Failed to ensure index on %s.%s: %s", collection, k, err)
+			}
+		}
+	}
+
+	return m
+}
+
+// Close Closes the MongoDB session.
+func (m *MongoStore) Close() {
+	m.session.Close()
+}
+
+// mongoError Translates MongoDB errors into the store errors.
+func mongoError(err error) error {
+	switch {
+	case err == mgo.ErrNotFound:
+		return ErrNotFound
+	case mgo.IsDup(err):
+		return ErrDuplicate
+	}
+	return err
+}
+
+// count Counts all documents in a collection.
+func (m *MongoStore) count(collection string) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C(collection).Count()
+	return count, mongoError(err)
+}
+
+// list Lists a page of documents in a collection.
+func (m *MongoStore) list(collection string, query interface{}, offset int, limit int, result interface{}, sort ...string) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	q := s.DB(MongoDatabase).C(collection).Find(query).Skip(offset).Limit(limit)
+	if len(sort) > 0 {
+		q = q.Sort(sort...)
+	}
+
+	return mongoError(q.All(result))
+}
+
+// findOne Finds a single document in a collection.
+func (m *MongoStore) findOne(collection string, query interface{}, result interface{}) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C(collection).Find(query).One(result))
+}
+
+// insert Inserts a document in a collection.
+func (m *MongoStore) insert(collection string, doc interface{}) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C(collection).Insert(doc))
+}
+
+// CountEvents Counts the events matching the query filters.
+func (m *MongoStore) CountEvents(query *EventQuery) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("events").Find(query.MongoQuery()).Count()
+	return count, mongoError(err)
+}
+
+// ListEvents Lists a page of events matching the query.
+func (m *MongoStore) ListEvents(query *EventQuery) ([]CatEvent, error) {
+	var events []CatEvent
+	err := m.list("events", query.MongoQuery(), query.Offset, query.Limit, &events, query.MongoSort()...)
+	return events, err
+}
+
+// GetEvent Gets a single event.
+func (m *MongoStore) GetEvent(id bson.ObjectId) (*CatEvent, error) {
+	var event CatEvent
+	if err := m.findOne("events", bson.M{"_id": id}, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// InsertEvent Inserts a new event.
+func (m *MongoStore) InsertEvent(event *CatEvent) error {
+	return m.insert("events", event)
+}
+
+// UpdateEvent Replaces an existing event.
+func (m *MongoStore) UpdateEvent(event *CatEvent) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C("events").UpdateId(event.ID, event))
+}
+
+// DeleteEvent Deletes an event.
+func (m *MongoStore) DeleteEvent(id bson.ObjectId) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C("events").RemoveId(id))
+}
+
+// CountUsers Counts all users.
+func (m *MongoStore) CountUsers() (int, error) {
+	return m.count("users")
+}
+
+// ListUsers Lists a page of users.
+func (m *MongoStore) ListUsers(offset int, limit int) ([]User, error) {
+	var users []User
+	err := m.list("users", nil, offset, limit, &users)
+	return users, err
+}
+
+// GetUser Gets a single user.
+func (m *MongoStore) GetUser(id bson.ObjectId) (*User, error) {
+	var user User
+	if err := m.findOne("users", bson.M{"_id": id}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// InsertUser Inserts a new user.
+func (m *MongoStore) InsertUser(user *User) error {
+	return m.insert("users", user)
+}
+
+// CountAccounts Counts all accounts.
+func (m *MongoStore) CountAccounts() (int, error) {
+	return m.count("accounts")
+}
+
+// ListAccounts Lists a page of accounts.
+func (m *MongoStore) ListAccounts(offset int, limit int) ([]Account, error) {
+	var accounts []Account
+	err := m.list("accounts", nil, offset, limit, &accounts)
+	return accounts, err
+}
+
+// GetAccount Gets a single account.
+func (m *MongoStore) GetAccount(id bson.ObjectId) (*Account, error) {
+	var account Account
+	if err := m.findOne("accounts", bson.M{"_id": id}, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ListUserAccounts Lists the accounts a user is a member of.
+func (m *MongoStore) ListUserAccounts(userID bson.ObjectId) ([]Account, error) {
+	var accounts []Account
+	err := m.list("accounts", bson.M{"users": userID}, 0, 0, &accounts, "_id")
+	return accounts, err
+}
+
+// InsertAccount Inserts a new account.
+func (m *MongoStore) InsertAccount(account *Account) error {
+	return m.insert("accounts", account)
+}
+
+// CountTokens Counts all access tokens.
+func (m *MongoStore) CountTokens() (int, error) {
+	return m.count("tokens")
+}
+
+// ListTokens Lists a page of access tokens.
+func (m *MongoStore) ListTokens(offset int, limit int) ([]AccessToken, error) {
+	var tokens []AccessToken
+	err := m.list("tokens", nil, offset, limit, &tokens)
+	return tokens, err
+}
+
+// GetToken Gets an access token by its token string.
+func (m *MongoStore) GetToken(token string) (*AccessToken, error) {
+	var t AccessToken
+	if err := m.findOne("tokens", bson.M{"token": token}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetTokenByName Gets an access token by its name.
+func (m *MongoStore) GetTokenByName(name string) (*AccessToken, error) {
+	var t AccessToken
+	if err := m.findOne("tokens", bson.M{"name": name}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// InsertToken Inserts a new access token.
+func (m *MongoStore) InsertToken(token *AccessToken) error {
+	return m.insert("tokens", token)
+}
+
+// accountQuery Returns the query for the items of an account, or of all accounts.
+func accountQuery(accountID bson.ObjectId) bson.M {
+	if accountID == "" {
+		return nil
+	}
+	return bson.M{"account_id": accountID}
+}
+
+// CountWebhooks Counts the webhooks of an account.
+func (m *MongoStore) CountWebhooks(accountID bson.ObjectId) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("webhooks").Find(bson.M{"account_id": accountID}).Count()
+	return count, mongoError(err)
+}
+
+// ListWebhooks Lists a page of the webhooks of an account.
+func (m *MongoStore) ListWebhooks(accountID bson.ObjectId, offset int, limit int) ([]Webhook, error) {
+	var webhooks []Webhook
+	err := m.list("webhooks", bson.M{"account_id": accountID}, offset, limit, &webhooks, "_id")
+	return webhooks, err
+}
+
+// GetWebhook Gets a single webhook.
+func (m *MongoStore) GetWebhook(id bson.ObjectId) (*Webhook, error) {
+	var webhook Webhook
+	if err := m.findOne("webhooks", bson.M{"_id": id}, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// InsertWebhook Inserts a new webhook.
+func (m *MongoStore) InsertWebhook(webhook *Webhook) error {
+	return m.insert("webhooks", webhook)
+}
+
+// UpdateWebhook Replaces an existing webhook.
+func (m *MongoStore) UpdateWebhook(webhook *Webhook) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C("webhooks").UpdateId(webhook.ID, webhook))
+}
+
+// DeleteWebhook Deletes a webhook and its delivery log.
+func (m *MongoStore) DeleteWebhook(id bson.ObjectId) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	if err := s.DB(MongoDatabase).C("webhooks").RemoveId(id); err != nil {
+		return mongoError(err)
+	}
+
+	_, err := s.DB(MongoDatabase).C("webhook_deliveries").RemoveAll(bson.M{"webhook_id": id})
+	return mongoError(err)
+}
+
+// CountWebhookDeliveries Counts the logged deliveries of a webhook.
+func (m *MongoStore) CountWebhookDeliveries(webhookID bson.ObjectId) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("webhook_deliveries").Find(bson.M{"webhook_id": webhookID}).Count()
+	return count, mongoError(err)
+}
+
+// ListWebhookDeliveries Lists a page of the logged deliveries of a webhook, newest first.
+func (m *MongoStore) ListWebhookDeliveries(webhookID bson.ObjectId, offset int, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := m.list("webhook_deliveries", bson.M{"webhook_id": webhookID}, offset, limit, &deliveries, "-_id")
+	return deliveries, err
+}
+
+// InsertWebhookDelivery Logs a delivery of a webhook.
+func (m *MongoStore) InsertWebhookDelivery(delivery *WebhookDelivery) error {
+	return m.insert("webhook_deliveries", delivery)
+}
+
+// CountDevices Counts the devices of an account.
+func (m *MongoStore) CountDevices(accountID bson.ObjectId) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("devices").Find(accountQuery(accountID)).Count()
+	return count, mongoError(err)
+}
+
+// ListDevices Lists a page of the devices of an account.
+func (m *MongoStore) ListDevices(accountID bson.ObjectId, offset int, limit int) ([]Device, error) {
+	var devices []Device
+	err := m.list("devices", accountQuery(accountID), offset, limit, &devices, "_id")
+	return devices, err
+}
+
+// GetDevice Gets a single device.
+func (m *MongoStore) GetDevice(key string) (*Device, error) {
+	var device Device
+	if err := m.findOne("devices", bson.M{"_id": key}, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// GetDeviceByCredential Gets the device that was issued a credential, by the hash of the credential.
+func (m *MongoStore) GetDeviceByCredential(credentialHash string) (*Device, error) {
+	var device Device
+	if err := m.findOne("devices", bson.M{"credential_hash": credentialHash}, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// InsertDevice Inserts a new device.
+func (m *MongoStore) InsertDevice(device *Device) error {
+	return m.insert("devices", device)
+}
+
+// UpdateDevice Replaces an existing device.
+func (m *MongoStore) UpdateDevice(device *Device) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C("devices").UpdateId(device.Key, device))
+}
+
+// DeleteDevice Deletes a device, its logged transitions and its commands.
+func (m *MongoStore) DeleteDevice(key string) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	if err := s.DB(MongoDatabase).C("devices").RemoveId(key); err != nil {
+		return mongoError(err)
+	}
+
+	for _, collection := range []string{"device_transitions", "device_commands"} {
+		if _, err := s.DB(MongoDatabase).C(collection).RemoveAll(bson.M{"device_key": key}); err != nil {
+			return mongoError(err)
+		}
+	}
+	return nil
+}
+
+// CountDeviceTransitions Counts the logged transitions of a device.
+func (m *MongoStore) CountDeviceTransitions(deviceKey string) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("device_transitions").Find(bson.M{"device_key": deviceKey}).Count()
+	return count, mongoError(err)
+}
+
+// ListDeviceTransitions Lists a page of the logged transitions of a device, newest first.
+func (m *MongoStore) ListDeviceTransitions(deviceKey string, offset int, limit int) ([]DeviceTransition, error) {
+	var transitions []DeviceTransition
+	err := m.list("device_transitions", bson.M{"device_key": deviceKey}, offset, limit, &transitions, "-_id")
+	return transitions, err
+}
+
+// InsertDeviceTransition Logs a transition of a device.
+func (m *MongoStore) InsertDeviceTransition(transition *DeviceTransition) error {
+	return m.insert("device_transitions", transition)
+}
+
+// CountDeviceCommands Counts the commands of a device.
+func (m *MongoStore) CountDeviceCommands(deviceKey string) (int, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	count, err := s.DB(MongoDatabase).C("device_commands").Find(bson.M{"device_key": deviceKey}).Count()
+	return count, mongoError(err)
+}
+
+// ListDeviceCommands Lists a page of the commands of a device, newest first.
+func (m *MongoStore) ListDeviceCommands(deviceKey string, offset int, limit int) ([]DeviceCommand, error) {
+	var commands []DeviceCommand
+	err := m.list("device_commands", bson.M{"device_key": deviceKey}, offset, limit, &commands, "-_id")
+	return commands, err
+}
+
+// ListOpenDeviceCommands Lists the commands of a device that are queued or delivered, oldest first.
+// An empty device key lists the open commands of all devices.
+func (m *MongoStore) ListOpenDeviceCommands(deviceKey string) ([]DeviceCommand, error) {
+	query := bson.M{"state": bson.M{"$in": []string{DeviceCommandQueued, DeviceCommandDelivered}}}
+	if deviceKey != "" {
+		query["device_key"] = deviceKey
+	}
+
+	var commands []DeviceCommand
+	err := m.list("device_commands", query, 0, 0, &commands, "_id")
+	return commands, err
+}
+
+// GetDeviceCommand Gets a single command of a device.
+func (m *MongoStore) GetDeviceCommand(deviceKey string, id bson.ObjectId) (*DeviceCommand, error) {
+	var command DeviceCommand
+	if err := m.findOne("device_commands", bson.M{"_id": id, "device_key": deviceKey}, &command); err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+// InsertDeviceCommand Queues a new command for a device.
+func (m *MongoStore) InsertDeviceCommand(command *DeviceCommand) error {
+	return m.insert("device_commands", command)
+}
+
+// UpdateDeviceCommand Replaces an existing command.
+func (m *MongoStore) UpdateDeviceCommand(command *DeviceCommand) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	return mongoError(s.DB(MongoDatabase).C("device_commands").UpdateId(command.ID, command))
+}
+
+// InsertPairingCode Inserts a new pairing code.
+func (m *MongoStore) InsertPairingCode(code *DevicePairingCode) error {
+	return m.insert("pairing_codes", code)
+}
+
+// TakePairingCode Gets and deletes a pairing code.
+func (m *MongoStore) TakePairingCode(code string) (*DevicePairingCode, error) {
+	s := m.session.Copy()
+	defer s.Close()
+
+	var c DevicePairingCode
+	if _, err := s.DB(MongoDatabase).C("pairing_codes").FindId(code).Apply(mgo.Change{Remove: true}, &c); err != nil {
+		return nil, mongoError(err)
+	}
+	return &c, nil
+}
+
+// DeleteExpiredPairingCodes Deletes the pairing codes that have expired.
+func (m *MongoStore) DeleteExpiredPairingCodes(now time.Time) error {
+	s := m.session.Copy()
+	defer s.Close()
+
+	_, err := s.DB(MongoDatabase).C("pairing_codes").RemoveAll(bson.M{"expires": bson.M{"$lte": now}})
+	return mongoError(err)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A small MQTT 3.1.1 client, only what is needed to publish to a broker.
+// Messages are published with QoS 0, the broker connection is kept alive
+// using pings and Done is closed when it is lost.
+
+// MQTT control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// DefaultMQTTKeepAlive How often the broker expects to hear from us.
+const DefaultMQTTKeepAlive = 60 * time.Second
+
+// mqttDialTimeout How long to wait for a broker to accept the connection.
+const mqttDialTimeout = 10 * time.Second
+
+// mqttWriteTimeout How long a packet can take to write before the connection is given up on.
+// Writes are serialized, so a stalled broker must not block the other writers for long.
+const mqttWriteTimeout = 10 * time.Second
+
+// mqttConnackErrors The reasons a broker refuses a connection, by CONNACK return code.
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// ErrMQTTClosed The connection to the MQTT broker has been closed.
+var ErrMQTTClosed = errors.New("MQTT connection closed")
+
+// MQTTOptions How to connect to an MQTT broker.
+type MQTTOptions struct {
+	ClientID    string
+	Username    string
+	Password    string
+	KeepAlive   time.Duration
+	WillTopic   string // Published by the broker if we disconnect without saying so, if set.
+	WillMessage []byte
+	WillRetain  bool
+}
+
+// MQTTClient A connection to an MQTT broker.
+type MQTTClient struct {
+	conn      net.Conn
+	mutex     sync.Mutex // Serializes writes.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialMQTT Connects to the broker at the given URL, such as tcp://localhost:1883.
+// Use ssl:// (or tls://, mqtts://) for TLS. A user name and password in the URL
+// are used to log in, unless given in the options.
+func DialMQTT(brokerURL string, o MQTTOptions) (*MQTTClient, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MQTT broker URL '%s': %s", brokerURL, err)
+	}
+
+	if u.User != nil && o.Username == "" {
+		o.Username = u.User.Username()
+		o.Password, _ = u.User.Password()
+	}
+
+	if o.KeepAlive == 0 {
+		o.KeepAlive = DefaultMQTTKeepAlive
+	}
+
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", mqttHostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", mqttHostPort(u, "8883"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("Unsupported MQTT broker URL scheme '%s', expected tcp or ssl", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MQTTClient{conn: conn, done: make(chan struct{})}
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	r := bufio.NewReader(conn)
+	if err := c.connect(r, &o); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read(r, o.KeepAlive)
+	go c.ping(o.KeepAlive)
+
+	return c, nil
+}
+
+// mqttHostPort Returns the host and port of the broker, using the default port if none is given.
+func mqttHostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// appendMQTTString Appends a length prefixed UTF-8 string (or binary data).
+func appendMQTTString(b []byte, s []byte) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// writePacket Writes a control packet with the given fixed header flags.
+func (c *MQTTClient) writePacket(packetType byte, flags byte, body []byte) error {
+	header := []byte{packetType<<4 | flags}
+
+	// The remaining length is encoded 7 bits at a time.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		header = append(header, b)
+		if n == 0 {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrMQTTClosed
+	default:
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	if _, err := c.conn.Write(append(header, body...)); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+// readMQTTPacket Reads a control packet, returning its type, flags and body.
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if i == 4 {
+			return 0, 0, nil, errors.New("Invalid MQTT packet length")
+		}
+		n += int(b&0x7f) * mul
+		mul *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0x0f, body, nil
+}
+
+// connect Sends CONNECT and waits for the broker to accept it.
+func (c *MQTTClient) connect(r *bufio.Reader, o *MQTTOptions) error {
+	flags := byte(0x02) // Clean session.
+	body := appendMQTTString(nil, []byte("MQTT"))
+	body = append(body, 4) // Protocol level 3.1.1.
+
+	payload := appendMQTTString(nil, []byte(o.ClientID))
+	if o.WillTopic != "" {
+		flags |= 0x04
+		if o.WillRetain {
+			flags |= 0x20
+		}
+		payload = appendMQTTString(payload, []byte(o.WillTopic))
+		payload = appendMQTTString(payload, o.WillMessage)
+	}
+	if o.Username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, []byte(o.Username))
+		if o.Password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, []byte(o.Password))
+		}
+	}
+
+	keepAlive := uint16(o.KeepAlive / time.Second)
+	body = append(body, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, payload...)
+
+	if err := c.writePacket(mqttConnect, 0, body); err != nil {
+		return err
+	}
+
+	packetType, _, ack, err := readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("Failed to read MQTT CONNACK: %s", err)
+	}
+	if packetType != mqttConnack || len(ack) != 2 {
+		return fmt.Errorf("Expected MQTT CONNACK, got packet type %d", packetType)
+	}
+	if ack[1] != 0 {
+		reason, ok := mqttConnackErrors[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return fmt.Errorf("MQTT broker refused the connection: %s", reason)
+	}
+
+	return nil
+}
+
+// read Reads packets from the broker until the connection is lost. We only ever
+// get ping responses since we don't subscribe to anything, or publish with QoS > 0.
+func (c *MQTTClient) read(r *bufio.Reader, keepAlive time.Duration) {
+	defer c.close()
+
+	for {
+		// The broker should answer our pings well within this time.
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+
+		if _, _, _, err := readMQTTPacket(r); err != nil {
+			return
+		}
+	}
+}
+
+// ping Keeps the connection alive.
+func (c *MQTTClient) ping(keepAlive time.Duration) {
+	t := time.NewTicker(keepAlive / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := c.writePacket(mqttPingreq, 0, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Publish Publishes a message with QoS 0. Retained messages are kept by the
+// broker and sent to new subscribers of the topic.
+func (c *MQTTClient) Publish(topic string, payload []byte, retain bool) error {
+	var flags byte
+	if retain {
+		flags = 0x01
+	}
+
+	body := appendMQTTString(make([]byte, 0, 2+len(topic)+len(payload)), []byte(topic))
+	return c.writePacket(mqttPublish, flags, append(body, payload...))
+}
+
+// Done Returns a channel that is closed when the connection is lost or closed.
+func (c *MQTTClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// close Closes the connection without telling the broker.
+func (c *MQTTClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Close Disconnects from the broker. The will message is not published.
+func (c *MQTTClient) Close() error {
+	err := c.writePacket(mqttDisconnect, 0, nil)
+	c.mutex.Lock()
+	c.close()
+	c.mutex.Unlock()
+
+	if err == ErrMQTTClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default MQTT topics, {device} is replaced with the ID of the device the event is from.
+const (
+	DefaultMQTTClientID          = "catcierge-rest"
+	DefaultMQTTStateTopic        = "catcierge/{device}/state"
+	DefaultMQTTDirectionTopic    = "catcierge/{device}/direction"
+	DefaultMQTTPreyTopic         = "catcierge/{device}/prey"
+	DefaultMQTTAvailabilityTopic = "catcierge/status"
+	DefaultMQTTDiscoveryPrefix   = "homeassistant"
+)
+
+// Payloads for the availability and prey topics, the Home Assistant defaults.
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+	mqttOn      = "ON"
+	mqttOff     = "OFF"
+)
+
+// MQTTEventState The state published when an event is created.
+type MQTTEventState struct {
+	EventID     string    `json:"event_id"`
+	State       string    `json:"state"`
+	Description string    `json:"description"`
+	Direction   string    `json:"direction"`
+	Success     bool      `json:"success"`
+	Prey        bool      `json:"prey"`
+	Time        time.Time `json:"time"`
+}
+
+// mqttDiscoveryDevice The device in a Home Assistant discovery config, used to group the sensors.
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// mqttDiscoveryConfig A Home Assistant MQTT discovery config for a sensor.
+type mqttDiscoveryConfig struct {
+	Name                string              `json:"name"`
+	UniqueID            string              `json:"unique_id"`
+	StateTopic          string              `json:"state_topic"`
+	ValueTemplate       string              `json:"value_template,omitempty"`
+	JSONAttributesTopic string              `json:"json_attributes_topic,omitempty"`
+	DeviceClass         string              `json:"device_class,omitempty"`
+	Icon                string              `json:"icon,omitempty"`
+	PayloadOn           string              `json:"payload_on,omitempty"`
+	PayloadOff          string              `json:"payload_off,omitempty"`
+	AvailabilityTopic   string              `json:"availability_topic"`
+	Device              mqttDiscoveryDevice `json:"device"`
+}
+
+// eventDeviceID Returns the ID of the device an event is from, used in the MQTT topics.
+// Events uploaded without a device are grouped per account, or "default" without one.
+func eventDeviceID(e *CatEvent) string {
+	if e.DeviceID != "" {
+		return e.DeviceID
+	}
+	if e.AccountID != "" {
+		return e.AccountID.Hex()
+	}
+	return "default"
+}
+
+// matchFoundPrey Checks if the matcher found prey in a match. The event has no prey flag,
+// but the haar matcher describes a failed match as "Prey detected" when that is why it
+// failed, unlike for example "No cat head detected". Matches marked as false positives don't count.
+func matchFoundPrey(m *CatEventMatchV1) bool {
+	if m.Success != 0 || m.IsFalsePositive {
+		return false
+	}
+
+	d := strings.ToLower(m.Description)
+	return strings.Contains(d, "prey detected") && !strings.Contains(d, "no prey")
+}
+
+// eventHasPrey Checks if the matcher found prey in any match of an event.
+func eventHasPrey(e *CatEvent) bool {
+	for i := range e.Data.Matches {
+		if matchFoundPrey(&e.Data.Matches[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewMQTTEventState Returns the state published for an event.
+func NewMQTTEventState(e *CatEvent) *MQTTEventState {
+	s := &MQTTEventState{
+		EventID:     e.ID.Hex(),
+		State:       e.Data.State,
+		Description: e.Data.Description,
+		Direction:   e.Data.MatchGroupDirection,
+		Success:     e.Data.MatchGroupSuccess != 0,
+		Prey:        eventHasPrey(e),
+		Time:        e.Data.Start.Time}
+
+	if s.Direction == "" {
+		s.Direction = "unknown"
+	}
+	if s.Time.IsZero() {
+		s.Time = e.Created
+	}
+	return s
+}
+
+// Delays before connecting to the MQTT broker again, doubled for each failed attempt.
+const (
+	mqttMinReconnectDelay = time.Second
+	mqttMaxReconnectDelay = time.Minute
+)
+
+// ErrMQTTNotConnected Publishing while the broker connection is down.
+var ErrMQTTNotConnected = errors.New("Not connected to the MQTT broker, the latest event of the device is published once connected")
+
+// MQTTPublisher Publishes created events to an MQTT broker, and announces
+// them as sensors using Home Assistant MQTT discovery. The connection is kept
+// in the background, so publishing never waits for a broker that is down.
+type MQTTPublisher struct {
+	settings  *CatSettings
+	mutex     sync.Mutex
+	client    *MQTTClient          // Nil while not connected.
+	announced map[string]bool      // Devices that discovery configs have been published for.
+	pending   map[string]*CatEvent // The latest event of each device that couldn't be published.
+	closed    bool
+	stop      chan struct{}
+}
+
+// NewMQTTPublisher Creates a new MQTTPublisher, call Start to connect.
+func NewMQTTPublisher(settings *CatSettings) *MQTTPublisher {
+	return &MQTTPublisher{
+		settings:  settings,
+		announced: make(map[string]bool),
+		pending:   make(map[string]*CatEvent),
+		stop:      make(chan struct{})}
+}
+
+// Start Connects to the broker in the background, connecting again whenever the connection is lost.
+func (p *MQTTPublisher) Start() {
+	go p.maintain()
+}
+
+// Listen Publishes all events created on the broker.
+func (p *MQTTPublisher) Listen(broker *EventBroker) {
+	broker.Listen(func(n EventNotification) {
+		if n.Type != EventCreated {
+			return
+		}
+		if err := p.PublishEvent(n.Event); err != nil {
+			log.Printf("Failed to publish event %s to MQTT: %s", n.Event.ID.Hex(), err)
+		}
+	})
+}
+
+// topic Returns a topic for a device.
+func (p *MQTTPublisher) topic(topic string, device string) string {
+	return strings.Replace(topic, "{device}", device, -1)
+}
+
+// dial Connects to the broker and publishes that we are online.
+func (p *MQTTPublisher) dial() (*MQTTClient, error) {
+	c, err := DialMQTT(p.settings.mqttURL, MQTTOptions{
+		ClientID:    p.settings.mqttClientID,
+		WillTopic:   p.settings.mqttAvailabilityTopic,
+		WillMessage: []byte(mqttOffline),
+		WillRetain:  true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Publish(p.settings.mqttAvailabilityTopic, []byte(mqttOnline), true); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// maintain Keeps the broker connection, waiting longer between each failed attempt
+// to connect. The events missed while disconnected are published once connected.
+func (p *MQTTPublisher) maintain() {
+	delay := mqttMinReconnectDelay
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		c, err := p.dial()
+		if err != nil {
+			log.Printf("Failed to connect to MQTT broker, retrying in %s: %s", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-p.stop:
+				return
+			}
+			if delay *= 2; delay > mqttMaxReconnectDelay {
+				delay = mqttMaxReconnectDelay
+			}
+			continue
+		}
+		delay = mqttMinReconnectDelay
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			c.Close()
+			return
+		}
+
+		// The broker may have lost the retained discovery configs while we were gone.
+		p.client = c
+		p.announced = make(map[string]bool)
+
+		pending := p.pending
+		p.pending = make(map[string]*CatEvent)
+		for device, e := range pending {
+			if err := p.publish(c, e); err != nil {
+				log.Printf("Failed to publish event %s to MQTT: %s", e.ID.Hex(), err)
+				p.pending[device] = e
+			}
+		}
+		p.mutex.Unlock()
+
+		select {
+		case <-c.Done():
+			log.Printf("Lost connection to MQTT broker, reconnecting")
+		case <-p.stop:
+			return
+		}
+
+		p.mutex.Lock()
+		if p.client == c {
+			p.client = nil
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// publishJSON Publishes a value encoded as JSON.
+func publishJSON(c *MQTTClient, topic string, v interface{}, retain bool) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Publish(topic, b, retain)
+}
+
+// announce Publishes the Home Assistant discovery configs for the sensors of a device.
+func (p *MQTTPublisher) announce(c *MQTTClient, device string) error {
+	id := "catcierge_" + device
+	dev := mqttDiscoveryDevice{
+		Identifiers:  []string{id},
+		Name:         "Catcierge " + device,
+		Manufacturer: "Catcierge",
+		Model:        "catcierge"}
+
+	stateTopic := p.topic(p.settings.mqttStateTopic, device)
+
+	configs := map[string]mqttDiscoveryConfig{
+		"sensor/" + id + "/state": {
+			Name:                "Catcierge last event",
+			StateTopic:          stateTopic,
+			ValueTemplate:       "{{ value_json.state }}",
+			JSONAttributesTopic: stateTopic,
+			Icon:                "mdi:cat"},
+		"sensor/" + id + "/time": {
+			Name:          "Catcierge last event time",
+			StateTopic:    stateTopic,
+			ValueTemplate: "{{ value_json.time }}",
+			DeviceClass:   "timestamp"},
+		"sensor/" + id + "/direction": {
+			Name:       "Catcierge last direction",
+			StateTopic: p.topic(p.settings.mqttDirectionTopic, device),
+			Icon:       "mdi:swap-horizontal"},
+		"binary_sensor/" + id + "/prey": {
+			Name:       "Catcierge prey detected",
+			StateTopic: p.topic(p.settings.mqttPreyTopic, device),
+			PayloadOn:  mqttOn,
+			PayloadOff: mqttOff,
+			Icon:       "mdi:rodent"},
+	}
+
+	for path, config := range configs {
+		config.UniqueID = strings.Replace(path[strings.Index(path, "/")+1:], "/", "_", -1)
+		config.AvailabilityTopic = p.settings.mqttAvailabilityTopic
+		config.Device = dev
+
+		topic := fmt.Sprintf("%s/%s/config", p.settings.mqttDiscoveryPrefix, path)
+		if err := publishJSON(c, topic, config, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishEvent Publishes the state, direction and prey of a created event to the
+// topics of its device. The values are retained so new subscribers get the latest.
+// Without a broker connection the event is kept and published once connected.
+func (p *MQTTPublisher) PublishEvent(e *CatEvent) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.client == nil {
+		p.pending[eventDeviceID(e)] = e
+		return ErrMQTTNotConnected
+	}
+
+	if err := p.publish(p.client, e); err != nil {
+		p.pending[eventDeviceID(e)] = e
+		return err
+	}
+	return nil
+}
+
+// publish Publishes an event, and the discovery configs of its device the first time. Must hold the lock.
+func (p *MQTTPublisher) publish(c *MQTTClient, e *CatEvent) error {
+	device := eventDeviceID(e)
+
+	if p.settings.mqttDiscoveryPrefix != "" && !p.announced[device] {
+		if err := p.announce(c, device); err != nil {
+			return err
+		}
+		p.announced[device] = true
+	}
+
+	state := NewMQTTEventState(e)
+	if err := publishJSON(c, p.topic(p.settings.mqttStateTopic, device), state, true); err != nil {
+		return err
+	}
+
+	if err := c.Publish(p.topic(p.settings.mqttDirectionTopic, device), []byte(state.Direction), true); err != nil {
+		return err
+	}
+
+	prey := mqttOff
+	if state.Prey {
+		prey = mqttOn
+	}
+	return c.Publish(p.topic(p.settings.mqttPreyTopic, device), []byte(prey), true)
+}
+
+// Close Disconnects from the broker, publishing that we are offline first.
+func (p *MQTTPublisher) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stop)
+
+	if p.client == nil {
+		return
+	}
+
+	p.client.Publish(p.settings.mqttAvailabilityTopic, []byte(mqttOffline), true)
+	p.client.Close()
+	p.client = nil
+}
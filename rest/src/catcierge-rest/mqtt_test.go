@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestReadMQTTPacket(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 321)
+
+	tests := []struct {
+		name       string
+		input      []byte
+		packetType byte
+		flags      byte
+		body       []byte
+		err        bool
+	}{
+		{"empty body", []byte{0xd0, 0x00}, mqttPingresp, 0, []byte{}, false},
+		{"body", []byte{0x32, 0x03, 'a', 'b', 'c'}, mqttPublish, 2, []byte("abc"), false},
+		{"two byte length", append([]byte{0x30, 0xc1, 0x02}, long...), mqttPublish, 0, long, false},
+		{"length too long", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, 0, nil, true},
+		{"truncated length", []byte{0x30, 0x80}, 0, 0, nil, true},
+		{"truncated body", []byte{0x30, 0x05, 'a'}, 0, 0, nil, true},
+		{"nothing", []byte{}, 0, 0, nil, true},
+	}
+
+	for _, tc := range tests {
+		packetType, flags, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tc.input)))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: Expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Failed to read packet: %s", tc.name, err)
+			continue
+		}
+		if packetType != tc.packetType || flags != tc.flags || !bytes.Equal(body, tc.body) {
+			t.Errorf("%s: Expected packet %d/%d with %d bytes, got %d/%d with %d bytes", tc.name,
+				tc.packetType, tc.flags, len(tc.body), packetType, flags, len(body))
+		}
+	}
+}
+
+func TestMQTTPacketRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384} {
+		server, conn := net.Pipe()
+		c := &MQTTClient{conn: conn, done: make(chan struct{})}
+		body := bytes.Repeat([]byte{'x'}, size)
+
+		go func() {
+			c.writePacket(mqttPublish, 0x01, body)
+			conn.Close()
+		}()
+
+		packetType, flags, got, err := readMQTTPacket(bufio.NewReader(server))
+		if err != nil {
+			t.Fatalf("Failed to read a packet of %d bytes: %s", size, err)
+		}
+		if packetType != mqttPublish || flags != 0x01 || !bytes.Equal(got, body) {
+			t.Errorf("Expected a publish packet of %d bytes, got %d/%d with %d bytes", size, packetType, flags, len(got))
+		}
+
+		io.Copy(ioutil.Discard, server)
+		server.Close()
+	}
+}
+
+func TestEventHasPrey(t *testing.T) {
+	tests := []struct {
+		name    string
+		matches []CatEventMatchV1
+		prey    bool
+	}{
+		{"no matches", nil, false},
+		{"passed", []CatEventMatchV1{{Success: 1, Description: "OK"}}, false},
+		{"prey", []CatEventMatchV1{{Success: 1}, {Success: 0, Description: "Prey detected"}}, true},
+		{"false positive", []CatEventMatchV1{{Success: 0, Description: "Prey detected", IsFalsePositive: true}}, false},
+		{"no prey", []CatEventMatchV1{{Success: 0, Description: "No prey detected, wrong direction"}}, false},
+		{"other failure", []CatEventMatchV1{{Success: 0, Description: "Cat head not found"}}, false},
+	}
+
+	for _, tc := range tests {
+		e := &CatEvent{}
+		e.Data.Matches = tc.matches
+		if prey := eventHasPrey(e); prey != tc.prey {
+			t.Errorf("%s: Expected prey %v, got %v", tc.name, tc.prey, prey)
+		}
+	}
+}
+
+func TestMQTTPublisherListen(t *testing.T) {
+	// Not connected, so the latest created event of each device is kept until connected.
+	p := NewMQTTPublisher(&CatSettings{})
+	broker := NewEventBroker()
+	p.Listen(broker)
+
+	var last *CatEvent
+	for i := 0; i < 3*eventStreamBuffer; i++ {
+		last = &CatEvent{ID: bson.NewObjectId(), DeviceID: "door"}
+		broker.Publish(EventCreated, last)
+	}
+	broker.Publish(EventUpdated, &CatEvent{ID: bson.NewObjectId(), DeviceID: "door"})
+	broker.Publish(EventCreated, &CatEvent{ID: bson.NewObjectId(), DeviceID: "window"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mutex.Lock()
+		door, window := p.pending["door"], p.pending["window"]
+		p.mutex.Unlock()
+
+		if window != nil {
+			if door == nil || door.ID != last.ID {
+				t.Errorf("Expected the last created event of the door to be pending, got %v", door)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the events to be published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
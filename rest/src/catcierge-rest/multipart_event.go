@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MIMEMultipartFormData The content type for events uploaded as separate form parts.
+const MIMEMultipartFormData = "multipart/form-data"
+
+// EventFormField The form field name for the event JSON part of a multipart upload.
+// A part with any other name is also used as the event JSON if its filename ends in .json.
+const EventFormField = "event"
+
+// multipartEventFile A file part that has been saved but not yet moved in place.
+type multipartEventFile struct {
+	name    string // The filename given for the part.
+	tmpPath string
+}
+
+// isEventJSONPart Checks if a form part is the event JSON.
+func isEventJSONPart(p *multipart.Part) bool {
+	return p.FormName() == EventFormField || strings.ToLower(path.Ext(p.FileName())) == ".json"
+}
+
+// multipartEventPath Maps the filename of a part onto a path referenced by the event JSON.
+// Most clients (and all browsers) only send the base name of a file, so a name
+// without a directory is matched against the base names of the referenced paths.
+func multipartEventPath(name string, referenced map[string]bool) (string, string) {
+	rel, _, problem := EventArchivePath(name, false, ".")
+	if problem != "" {
+		return "", problem
+	}
+
+	if referenced[rel] || strings.Contains(rel, "/") {
+		return rel, ""
+	}
+
+	var matches []string
+	for p := range referenced {
+		if path.Base(p) == rel {
+			matches = append(matches, p)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return rel, ""
+	case 1:
+		return matches[0], ""
+	}
+
+	return "", fmt.Sprintf("'%s' matches more than one file in the event JSON (%s), include the directory in the filename",
+		name, strings.Join(matches, ", "))
+}
+
+// UnpackMultipartEvent Saves a catcierge event uploaded as multipart/form-data, where
+// the event JSON and each of its images are sent as separate parts. The filename of
+// each image part is mapped onto the paths in the event JSON. The same validation and
+// limits as UnzipEvent apply, and nothing is written to dest unless the event is valid.
+func UnpackMultipartEvent(r *multipart.Reader, dest, versionHint string, limits *EventArchiveLimits) (*CatEventHeader, *CatEventDataV1, error) {
+	// The parts can come in any order, so they are saved aside until we have the event JSON.
+	partsDir, err := ioutil.TempDir(filepath.Dir(dest), eventStagingPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(partsDir)
+
+	var unpacked int64
+	var entries int
+	var content []byte
+	var jsonHint string
+	var parts []multipartEventFile
+	var problems []string
+
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, &CatArchiveError{[]string{fmt.Sprintf("Invalid multipart body: %s", err)}}
+		}
+
+		entries++
+		if err := limits.CheckEntryCount(entries); err != nil {
+			p.Close()
+			return nil, nil, err
+		}
+
+		name := p.FileName()
+
+		if isEventJSONPart(p) {
+			if content != nil {
+				p.Close()
+				return nil, nil, &CatJSONHeaderError{errors.New("More than one event JSON found in the upload")}
+			}
+
+			var jsonSize int64
+			content, err = ioutil.ReadAll(limits.NewEntryReader(p, EventFormField, -1, &jsonSize))
+			p.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			jsonHint = EventVersionFromContentType(p.Header.Get("Content-Type"))
+			continue
+		}
+
+		if name == "" {
+			log.Printf("Ignoring form field '%s' without a file in the event upload", p.FormName())
+			p.Close()
+			continue
+		}
+
+		if problem := limits.ExtensionProblem(name); problem != "" {
+			problems = append(problems, problem)
+			p.Close()
+			continue
+		}
+
+		tmpPath := filepath.Join(partsDir, strconv.Itoa(len(parts)))
+		f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			p.Close()
+			return nil, nil, err
+		}
+
+		_, err = io.Copy(f, limits.NewEntryReader(p, name, -1, &unpacked))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		p.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		parts = append(parts, multipartEventFile{name: name, tmpPath: tmpPath})
+	}
+
+	if content == nil {
+		return nil, nil, &CatJSONHeaderError{fmt.Errorf("No event JSON found in the upload, send it in the '%s' form field", EventFormField)}
+	}
+
+	// The version of the JSON part itself takes precedence over the one for the whole upload.
+	if jsonHint != "" {
+		versionHint = jsonHint
+	}
+
+	header, data, err := ParseEventJSON(content, versionHint)
+	if err != nil {
+		return header, nil, err
+	}
+
+	log.Printf("Event ID: %s\n", header.ID)
+
+	referenced := make(map[string]bool)
+	for _, m := range data.Matches {
+		if m.Path != "" {
+			referenced[cleanArchiveName(m.Path)] = true
+		}
+		for _, s := range m.Steps {
+			if s.Path != "" {
+				referenced[cleanArchiveName(s.Path)] = true
+			}
+		}
+	}
+
+	// Validate all parts before moving anything in place.
+	paths := make(map[int]string)
+	files := make(map[string]bool)
+	names := make(EventArchiveNames)
+
+	for i, part := range parts {
+		rel, problem := multipartEventPath(part.name, referenced)
+		if problem != "" {
+			problems = append(problems, problem)
+			continue
+		}
+
+		if files[rel] {
+			problems = append(problems, fmt.Sprintf("'%s' was uploaded more than once", rel))
+			continue
+		}
+
+		if paths[i], err = EventFilePath(dest, rel); err != nil {
+			problems = append(problems, fmt.Sprintf("'%s' points outside of the event directory", part.name))
+			continue
+		}
+
+		if problem := names.Add(part.name, rel, false); problem != "" {
+			delete(paths, i)
+			problems = append(problems, problem)
+			continue
+		}
+		files[rel] = true
+	}
+
+	problems = append(problems, ValidateEventFiles(data, files)...)
+
+	if len(problems) > 0 {
+		log.Printf("Invalid multipart upload for event %s: %s", header.ID, strings.Join(problems, "; "))
+		return header, nil, &CatArchiveError{problems}
+	}
+
+	os.MkdirAll(dest, 0755)
+
+	for i, part := range parts {
+		os.MkdirAll(filepath.Dir(paths[i]), 0755)
+		if err := os.Rename(part.tmpPath, paths[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return header, data, nil
+}
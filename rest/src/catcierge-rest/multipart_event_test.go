@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMultipartPart A part of a test multipart event upload.
+type testMultipartPart struct {
+	Field    string
+	FileName string
+	Body     string
+}
+
+// testMultipartEventParts Returns the parts of a valid multipart event upload,
+// where the step is sent with only its base name like a browser would.
+func testMultipartEventParts() []testMultipartPart {
+	return []testMultipartPart{
+		{EventFormField, "", testEventArchiveJSON},
+		{"file", "match1.png", "match"},
+		{"file", "step1.png", "step"},
+	}
+}
+
+func testUnpackMultipart(t *testing.T, parts []testMultipartPart) (string, *CatEventDataV1, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var err error
+		if p.FileName == "" {
+			err = mw.WriteField(p.Field, p.Body)
+		} else {
+			var w io.Writer
+			if w, err = mw.CreateFormFile(p.Field, p.FileName); err == nil {
+				_, err = w.Write([]byte(p.Body))
+			}
+		}
+		if err != nil {
+			t.Fatalf("Failed to write part %s: %s", p.Field, err)
+		}
+	}
+	mw.Close()
+
+	dir := testTempDir(t)
+	_, data, err := UnpackMultipartEvent(multipart.NewReader(&buf, mw.Boundary()), filepath.Join(dir, "out"), "",
+		NewEventArchiveLimits(DefaultMaxUnpackedEventSize, DefaultMaxEventEntries, DefaultMaxEventCompressionRatio, DefaultEventExtensions))
+	return dir, data, err
+}
+
+func TestUnpackMultipartEvent(t *testing.T) {
+	dir, data, err := testUnpackMultipart(t, testMultipartEventParts())
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Failed to unpack event: %s", err)
+	}
+
+	if data.ID != "abcdef0123456789" {
+		t.Errorf("Unexpected event data %+v", data)
+	}
+
+	for name, body := range map[string]string{"match1.png": "match", "steps/step1.png": "step"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "out", filepath.FromSlash(name)))
+		if err != nil || string(content) != body {
+			t.Errorf("%s: Expected %q, got %q, %v", name, body, content, err)
+		}
+	}
+}
+
+func TestUnpackMultipartEventInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		part    testMultipartPart
+		problem string
+	}{
+		{"duplicate", testMultipartPart{"file", "match1.png", "evil"}, "more than once"},
+		{"duplicate full path", testMultipartPart{"file", "steps/step1.png", "evil"}, "more than once"},
+		{"extension", testMultipartPart{"file", "evil.sh", "evil"}, "allowed extension"},
+	}
+
+	for _, tc := range tests {
+		dir, _, err := testUnpackMultipart(t, append(testMultipartEventParts(), tc.part))
+		defer os.RemoveAll(dir)
+
+		if problems := testArchiveProblems(t, err); !testHasProblem(problems, tc.problem) {
+			t.Errorf("%s: Expected a problem with %q, got %v", tc.name, tc.problem, problems)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected nothing to be unpacked", tc.name)
+		}
+	}
+}
+
+func TestUnpackMultipartEventEscape(t *testing.T) {
+	// Depending on the Go version the directories might already be stripped from
+	// the filename, either way nothing may be written outside of the event directory.
+	for _, name := range []string{"../evil.png", "../../evil.png", "/evil.png"} {
+		dir, _, err := testUnpackMultipart(t, append(testMultipartEventParts(), testMultipartPart{"file", name, "evil"}))
+		defer os.RemoveAll(dir)
+
+		if err != nil {
+			testArchiveProblems(t, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "evil.png")); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected nothing to be written outside of the event directory", name)
+		}
+	}
+}
+
+func TestUnpackMultipartEventMissingFile(t *testing.T) {
+	parts := testMultipartEventParts()
+	dir, _, err := testUnpackMultipart(t, parts[:2])
+	defer os.RemoveAll(dir)
+
+	if problems := testArchiveProblems(t, err); !testHasProblem(problems, "missing from the archive") {
+		t.Errorf("Expected the step to be missing, got %v", problems)
+	}
+}
+
+func TestUnpackMultipartEventJSON(t *testing.T) {
+	parts := testMultipartEventParts()
+
+	dir, _, err := testUnpackMultipart(t, parts[1:])
+	defer os.RemoveAll(dir)
+	if _, ok := err.(*CatJSONHeaderError); !ok {
+		t.Errorf("Expected a CatJSONHeaderError without event JSON, got %T: %v", err, err)
+	}
+
+	dir, _, err = testUnpackMultipart(t, append(parts, testMultipartPart{"other", "other.json", testEventArchiveJSON}))
+	defer os.RemoveAll(dir)
+	if _, ok := err.(*CatJSONHeaderError); !ok {
+		t.Errorf("Expected a CatJSONHeaderError with two event JSON parts, got %T: %v", err, err)
+	}
+}
+
+func TestMultipartEventPath(t *testing.T) {
+	referenced := map[string]bool{"match1.png": true, "a/step.png": true, "b/step.png": true}
+
+	tests := []struct {
+		name    string
+		rel     string
+		problem bool
+	}{
+		{"match1.png", "match1.png", false},
+		{"a/step.png", "a/step.png", false},
+		{"step.png", "", true},
+		{"other.png", "other.png", false},
+		{"../match1.png", "", true},
+		{"/tmp/match1.png", "", true},
+		{"a/../../match1.png", "", true},
+	}
+
+	for _, tc := range tests {
+		rel, problem := multipartEventPath(tc.name, referenced)
+		if rel != tc.rel || (problem != "") != tc.problem {
+			t.Errorf("%s: Expected (%q, problem %v), got (%q, %q)", tc.name, tc.rel, tc.problem, rel, problem)
+		}
+	}
+}
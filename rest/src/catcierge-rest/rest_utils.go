@@ -12,11 +12,26 @@ import (
 
 type key int // Used as a type for context keys.
 
+// Context keys, these must be unique for each value added to a context.
+const (
+	eventsKey key = iota
+	accountsKey
+	usersKey
+	accessTokenKey
+	authStateKey
+	settingsKey
+	uploadsKey
+	imagesKey
+	webhooksKey
+	devicesKey
+)
+
 // CatError represents an error reply for the REST API.
 type CatError struct {
-	HTTPStatusCode int    `json:"http_status_code"`
-	HTTPStatus     string `json:"http_status"`
-	Message        string `json:"message"`
+	HTTPStatusCode int      `json:"http_status_code"`
+	HTTPStatus     string   `json:"http_status"`
+	Message        string   `json:"message"`
+	Problems       []string `json:"problems,omitempty"` // A list of problems with the request, if any.
 }
 
 // ListResponseHeader Used for all list resource responses to return pagination
@@ -42,7 +57,7 @@ func ReverseURL(request *http.Request, fullPath string) string {
 	return revURL.String()
 }
 
-func (l ListResponseHeader) getListResponseParams(request *restful.Request) {
+func (l *ListResponseHeader) getListResponseParams(request *restful.Request) {
 
 	offset, err := strconv.Atoi(request.QueryParameter("offset"))
 	if err != nil {
@@ -62,15 +77,20 @@ func (l ListResponseHeader) getListResponseParams(request *restful.Request) {
 func AddListRequestParams(ws *restful.WebService) func(b *restful.RouteBuilder) {
 	return func(b *restful.RouteBuilder) {
 		b.Param(ws.QueryParameter("offset", "Offset into the list").
-			DataType("int").DefaultValue(string(DefaultPageOffset)))
+			DataType("int").DefaultValue(strconv.Itoa(DefaultPageOffset)))
 
 		b.Param(ws.QueryParameter("limit", "Number of items to return").
-			DataType("int").DefaultValue(string(DefaultPageLimit)))
+			DataType("int").DefaultValue(strconv.Itoa(DefaultPageLimit)))
 	}
 }
 
 // WriteCatciergeErrorString Writes an error message as a response.
 func WriteCatciergeErrorString(response *restful.Response, httpStatus int, message string) {
+	WriteCatciergeErrorProblems(response, httpStatus, message, nil)
+}
+
+// WriteCatciergeErrorProblems Writes an error message together with a list of problems as a response.
+func WriteCatciergeErrorProblems(response *restful.Response, httpStatus int, message string, problems []string) {
 	if message == "" {
 		message = http.StatusText(httpStatus)
 	}
@@ -81,7 +101,8 @@ func WriteCatciergeErrorString(response *restful.Response, httpStatus int, messa
 		&CatError{
 			HTTPStatusCode: httpStatus,
 			HTTPStatus:     http.StatusText(httpStatus),
-			Message:        message})
+			Message:        message,
+			Problems:       problems})
 }
 
 // ReturnsStatus Helper for specifying what HTTP statuses a restful.RouteBuilder returns.
@@ -99,10 +120,24 @@ func ReturnsError(httpStatus int) func(b *restful.RouteBuilder) {
 	return ReturnsStatus(httpStatus, "", CatError{})
 }
 
+// valuesContext A request context that also has the values of another context.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
 // GetWrappedContextHTTPHandler wraps a HTTP handler with a new one that appends a context to the request.
+// The request keeps its own context for cancellation, such as when the client disconnects.
 func GetWrappedContextHTTPHandler(handler http.Handler, ctx context.Context) http.Handler {
 	wrapped := func(w http.ResponseWriter, req *http.Request) {
-		handler.ServeHTTP(w, req.WithContext(ctx))
+		handler.ServeHTTP(w, req.WithContext(valuesContext{req.Context(), ctx}))
 	}
 	return http.HandlerFunc(wrapped)
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Storage backends that can be selected using --storage.
+const (
+	StorageMongo  = "mongo"
+	StorageBolt   = "bolt"
+	StorageMemory = "memory"
+)
+
+// ErrNotFound Returned by a CatciergeStore when the requested item does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate Returned by a CatciergeStore when inserting an item that already exists.
+var ErrDuplicate = errors.New("duplicate item")
+
+// EventStore Storage for cat events.
+type EventStore interface {
+	CountEvents(query *EventQuery) (int, error)
+	ListEvents(query *EventQuery) ([]CatEvent, error)
+	GetEvent(id bson.ObjectId) (*CatEvent, error)
+	InsertEvent(event *CatEvent) error
+	UpdateEvent(event *CatEvent) error
+	DeleteEvent(id bson.ObjectId) error
+}
+
+// UserStore Storage for users.
+type UserStore interface {
+	CountUsers() (int, error)
+	ListUsers(offset int, limit int) ([]User, error)
+	GetUser(id bson.ObjectId) (*User, error)
+	InsertUser(user *User) error
+}
+
+// AccountStore Storage for accounts.
+type AccountStore interface {
+	CountAccounts() (int, error)
+	ListAccounts(offset int, limit int) ([]Account, error)
+	GetAccount(id bson.ObjectId) (*Account, error)
+	ListUserAccounts(userID bson.ObjectId) ([]Account, error)
+	InsertAccount(account *Account) error
+}
+
+// TokenStore Storage for API access tokens.
+type TokenStore interface {
+	CountTokens() (int, error)
+	ListTokens(offset int, limit int) ([]AccessToken, error)
+	GetToken(token string) (*AccessToken, error)
+	GetTokenByName(name string) (*AccessToken, error)
+	InsertToken(token *AccessToken) error
+}
+
+// WebhookStore Storage for webhooks and their delivery logs. Webhooks are always
+// listed for a single account, deliveries are listed newest first and are deleted
+// together with their webhook.
+type WebhookStore interface {
+	CountWebhooks(accountID bson.ObjectId) (int, error)
+	ListWebhooks(accountID bson.ObjectId, offset int, limit int) ([]Webhook, error)
+	GetWebhook(id bson.ObjectId) (*Webhook, error)
+	InsertWebhook(webhook *Webhook) error
+	UpdateWebhook(webhook *Webhook) error
+	DeleteWebhook(id bson.ObjectId) error
+	CountWebhookDeliveries(webhookID bson.ObjectId) (int, error)
+	ListWebhookDeliveries(webhookID bson.ObjectId, offset int, limit int) ([]WebhookDelivery, error)
+	InsertWebhookDelivery(delivery *WebhookDelivery) error
+}
+
+// DeviceStore Storage for catcierge devices, the history of when they went offline and online,
+// their commands and the codes used to pair them. Devices are stored under their key, see DeviceKey,
+// and so are their transitions and commands. Listing devices for an empty account ID lists
+// the devices of all accounts. Transitions and commands are listed newest first and are deleted
+// together with their device, open commands are listed oldest first and for all devices if the
+// device key is empty. Taking a pairing code deletes it, so that it can only be used once.
+type DeviceStore interface {
+	CountDevices(accountID bson.ObjectId) (int, error)
+	ListDevices(accountID bson.ObjectId, offset int, limit int) ([]Device, error)
+	GetDevice(key string) (*Device, error)
+	GetDeviceByCredential(credentialHash string) (*Device, error)
+	InsertDevice(device *Device) error
+	UpdateDevice(device *Device) error
+	DeleteDevice(key string) error
+	CountDeviceTransitions(deviceKey string) (int, error)
+	ListDeviceTransitions(deviceKey string, offset int, limit int) ([]DeviceTransition, error)
+	InsertDeviceTransition(transition *DeviceTransition) error
+	CountDeviceCommands(deviceKey string) (int, error)
+	ListDeviceCommands(deviceKey string, offset int, limit int) ([]DeviceCommand, error)
+	ListOpenDeviceCommands(deviceKey string) ([]DeviceCommand, error)
+	GetDeviceCommand(deviceKey string, id bson.ObjectId) (*DeviceCommand, error)
+	InsertDeviceCommand(command *DeviceCommand) error
+	UpdateDeviceCommand(command *DeviceCommand) error
+	InsertPairingCode(code *DevicePairingCode) error
+	TakePairingCode(code string) (*DevicePairingCode, error)
+	DeleteExpiredPairingCodes(now time.Time) error
+}
+
+// CatciergeStore The storage backend used by all the REST resources.
+// Lookups that find nothing return ErrNotFound and inserts of
+// already existing items return ErrDuplicate.
+type CatciergeStore interface {
+	EventStore
+	UserStore
+	AccountStore
+	TokenStore
+	WebhookStore
+	DeviceStore
+	Close()
+}
+
+// OpenStore Opens the storage backend selected in the settings.
+func OpenStore(settings *CatSettings) (CatciergeStore, error) {
+	log.Printf("Using %s storage", settings.storage)
+
+	switch settings.storage {
+	case StorageMongo:
+		return NewMongoStore(DialMongo(settings.mongoURL)), nil
+	case StorageBolt:
+		store, err := NewBoltStore(settings.boltPath)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StorageMemory:
+		return NewMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown storage backend '%s'", settings.storage)
+}
+
+// pageBounds Returns the slice bounds for a page given the total item count.
+// A limit of 0 or less means no limit, the same as for MongoDB.
+func pageBounds(count int, offset int, limit int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > count {
+		offset = count
+	}
+
+	end := count
+	if limit > 0 && offset+limit < count {
+		end = offset + limit
+	}
+
+	return offset, end
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// testStores Runs a test against each store that doesn't need a server.
+func testStores(t *testing.T, test func(t *testing.T, store CatciergeStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "catcierge-store-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		store, err := NewBoltStore(filepath.Join(dir, "catcierge.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		test(t, store)
+	})
+}
+
+// testEvent Returns an event starting the given number of hours after a fixed time.
+func testEvent(hours int, direction string) *CatEvent {
+	e := &CatEvent{ID: bson.NewObjectId(), Tags: []string{}}
+	e.Data.Start.Time = time.Date(2017, 1, 1, hours, 0, 0, 0, time.UTC)
+	e.Data.MatchGroupDirection = direction
+	return e
+}
+
+func eventStarts(events []CatEvent) []int {
+	hours := []int{}
+	for _, e := range events {
+		hours = append(hours, e.Data.Start.Hour())
+	}
+	return hours
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreEvents(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		for _, e := range []*CatEvent{
+			testEvent(3, "in"), testEvent(1, "out"), testEvent(5, "in"),
+			testEvent(2, "in"), testEvent(4, "out")} {
+			if err := store.InsertEvent(e); err != nil {
+				t.Fatalf("Failed to insert event: %s", err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			query  EventQuery
+			count  int
+			starts []int
+		}{
+			{"default order", EventQuery{Sort: []string{"start"}}, 5, []int{1, 2, 3, 4, 5}},
+			{"descending", EventQuery{Sort: []string{"-start"}}, 5, []int{5, 4, 3, 2, 1}},
+			{"page", EventQuery{Sort: []string{"start"}, Offset: 1, Limit: 2}, 5, []int{2, 3}},
+			{"page past the end", EventQuery{Sort: []string{"start"}, Offset: 4, Limit: 2}, 5, []int{5}},
+			{"filtered", EventQuery{Sort: []string{"start"}, Direction: "in"}, 3, []int{2, 3, 5}},
+			{"filtered page", EventQuery{Sort: []string{"-start"}, Direction: "in", Offset: 1, Limit: 1}, 3, []int{3}},
+		}
+
+		for _, tc := range tests {
+			count, err := store.CountEvents(&tc.query)
+			if err != nil {
+				t.Fatalf("%s: Failed to count events: %s", tc.name, err)
+			}
+			if count != tc.count {
+				t.Errorf("%s: Expected count %d, got %d", tc.name, tc.count, count)
+			}
+
+			events, err := store.ListEvents(&tc.query)
+			if err != nil {
+				t.Fatalf("%s: Failed to list events: %s", tc.name, err)
+			}
+			if starts := eventStarts(events); !equalInts(starts, tc.starts) {
+				t.Errorf("%s: Expected events starting at %v, got %v", tc.name, tc.starts, starts)
+			}
+		}
+	})
+}
+
+func TestStoreEventChanges(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		e := testEvent(1, "in")
+		if err := store.InsertEvent(e); err != nil {
+			t.Fatalf("Failed to insert event: %s", err)
+		}
+		if err := store.InsertEvent(e); err != ErrDuplicate {
+			t.Errorf("Expected inserting the event twice to fail with %s, got %v", ErrDuplicate, err)
+		}
+
+		// Moving the start time must also move the event in the start order.
+		e.Name = "Renamed"
+		e.Data.Start.Time = e.Data.Start.Add(10 * time.Hour)
+		if err := store.UpdateEvent(e); err != nil {
+			t.Fatalf("Failed to update event: %s", err)
+		}
+
+		got, err := store.GetEvent(e.ID)
+		if err != nil {
+			t.Fatalf("Failed to get event: %s", err)
+		}
+		if got.Name != "Renamed" || !got.Data.Start.Equal(e.Data.Start.Time) {
+			t.Errorf("Expected the updated event, got name '%s' starting at %s", got.Name, got.Data.Start)
+		}
+
+		events, err := store.ListEvents(&EventQuery{Sort: []string{"start"}})
+		if err != nil || len(events) != 1 {
+			t.Fatalf("Expected the event to be listed once, got %d events: %v", len(events), err)
+		}
+
+		if err := store.DeleteEvent(e.ID); err != nil {
+			t.Fatalf("Failed to delete event: %s", err)
+		}
+		if _, err := store.GetEvent(e.ID); err != ErrNotFound {
+			t.Errorf("Expected %s after deleting the event, got %v", ErrNotFound, err)
+		}
+		if err := store.DeleteEvent(e.ID); err != ErrNotFound {
+			t.Errorf("Expected deleting the event twice to fail with %s, got %v", ErrNotFound, err)
+		}
+		if count, _ := store.CountEvents(&EventQuery{}); count != 0 {
+			t.Errorf("Expected no events after deleting, got %d", count)
+		}
+	})
+}
+
+func TestStoreUserAccounts(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		alice, bob := bson.NewObjectId(), bson.NewObjectId()
+		accounts := []Account{
+			{ID: bson.NewObjectId(), Name: "Home", Users: []bson.ObjectId{alice, bob}},
+			{ID: bson.NewObjectId(), Name: "Cabin", Users: []bson.ObjectId{alice}},
+		}
+		for i := range accounts {
+			if err := store.InsertAccount(&accounts[i]); err != nil {
+				t.Fatalf("Failed to insert account: %s", err)
+			}
+		}
+
+		tests := []struct {
+			user  bson.ObjectId
+			count int
+		}{
+			{alice, 2},
+			{bob, 1},
+			{bson.NewObjectId(), 0},
+		}
+
+		for _, tc := range tests {
+			got, err := store.ListUserAccounts(tc.user)
+			if err != nil {
+				t.Fatalf("Failed to list user accounts: %s", err)
+			}
+			if len(got) != tc.count {
+				t.Errorf("Expected user %s to be in %d accounts, got %d", tc.user.Hex(), tc.count, len(got))
+			}
+		}
+	})
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		home, cabin := bson.NewObjectId(), bson.NewObjectId()
+		webhooks := []Webhook{
+			{ID: bson.NewObjectId(), AccountID: home},
+			{ID: bson.NewObjectId(), AccountID: cabin},
+			{ID: bson.NewObjectId(), AccountID: home},
+		}
+		for i := range webhooks {
+			if err := store.InsertWebhook(&webhooks[i]); err != nil {
+				t.Fatalf("Failed to insert webhook: %s", err)
+			}
+		}
+
+		// Moving a webhook to another account must move it in the account index.
+		webhooks[1].AccountID = home
+		if err := store.UpdateWebhook(&webhooks[1]); err != nil {
+			t.Fatalf("Failed to update webhook: %s", err)
+		}
+		if err := store.DeleteWebhook(webhooks[0].ID); err != nil {
+			t.Fatalf("Failed to delete webhook: %s", err)
+		}
+
+		tests := []struct {
+			account bson.ObjectId
+			ids     []bson.ObjectId
+		}{
+			{home, []bson.ObjectId{webhooks[1].ID, webhooks[2].ID}},
+			{cabin, []bson.ObjectId{}},
+			{bson.NewObjectId(), []bson.ObjectId{}},
+		}
+
+		for _, tc := range tests {
+			got, err := store.ListWebhooks(tc.account, 0, 0)
+			if err != nil {
+				t.Fatalf("Failed to list webhooks: %s", err)
+			}
+			ids := []bson.ObjectId{}
+			for _, w := range got {
+				ids = append(ids, w.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("Expected webhooks %v for account '%s', got %v", tc.ids, tc.account.Hex(), ids)
+			}
+			if count, err := store.CountWebhooks(tc.account); err != nil || count != len(tc.ids) {
+				t.Errorf("Expected %d webhooks for account '%s', got %d: %v", len(tc.ids), tc.account.Hex(), count, err)
+			}
+		}
+	})
+}
+
+func TestStoreDevices(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		home, cabin := bson.NewObjectId(), bson.NewObjectId()
+
+		// Device IDs are chosen by the devices, so they only have to be unique within an account.
+		homeDoor := newDevice(home, "door", now)
+		cabinDoor := newDevice(cabin, "door", now)
+
+		for _, d := range []*Device{homeDoor, cabinDoor, newDevice(home, "window", now)} {
+			if err := store.InsertDevice(d); err != nil {
+				t.Fatalf("Failed to insert device %s: %s", d.Key, err)
+			}
+		}
+		if err := store.InsertDevice(newDevice(home, "door", now)); err != ErrDuplicate {
+			t.Errorf("Expected inserting a device twice to fail with %s, got %v", ErrDuplicate, err)
+		}
+
+		counts := []struct {
+			account bson.ObjectId
+			count   int
+		}{
+			{home, 2},
+			{cabin, 1},
+			{"", 3},
+		}
+		for _, tc := range counts {
+			if count, err := store.CountDevices(tc.account); err != nil || count != tc.count {
+				t.Errorf("Expected %d devices for account '%s', got %d: %v", tc.count, tc.account.Hex(), count, err)
+			}
+		}
+
+		for _, d := range []*Device{homeDoor, cabinDoor} {
+			got, err := store.GetDevice(d.Key)
+			if err != nil || got.AccountID != d.AccountID || got.ID != "door" {
+				t.Errorf("Expected to get %s, got %v: %v", d.Key, got, err)
+			}
+		}
+
+		command := DeviceCommand{ID: bson.NewObjectId(), DeviceKey: homeDoor.Key, DeviceID: homeDoor.ID,
+			Type: DeviceCommandLock, State: DeviceCommandQueued, Created: now}
+		if err := store.InsertDeviceCommand(&command); err != nil {
+			t.Fatalf("Failed to insert command: %s", err)
+		}
+		if count, _ := store.CountDeviceCommands(cabinDoor.Key); count != 0 {
+			t.Errorf("Expected the device with the same ID in another account to have no commands, got %d", count)
+		}
+
+		if err := store.DeleteDevice(homeDoor.Key); err != nil {
+			t.Fatalf("Failed to delete device: %s", err)
+		}
+		if _, err := store.GetDevice(homeDoor.Key); err != ErrNotFound {
+			t.Errorf("Expected %s after deleting the device, got %v", ErrNotFound, err)
+		}
+		if _, err := store.GetDevice(cabinDoor.Key); err != nil {
+			t.Errorf("Expected the device with the same ID in another account to remain, got %v", err)
+		}
+		if count, _ := store.CountDeviceCommands(homeDoor.Key); count != 0 {
+			t.Errorf("Expected the commands to be deleted with the device, got %d", count)
+		}
+	})
+}
+
+func TestStoreDeviceCredentials(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		homeDoor := newDevice(bson.NewObjectId(), "door", now)
+		homeDoor.CredentialHash = HashDeviceCredential("home")
+		if err := store.InsertDevice(homeDoor); err != nil {
+			t.Fatalf("Failed to insert device: %s", err)
+		}
+
+		got, err := store.GetDeviceByCredential(HashDeviceCredential("home"))
+		if err != nil || got.Key != homeDoor.Key {
+			t.Fatalf("Expected the credential to find %s, got %v: %v", homeDoor.Key, got, err)
+		}
+		if _, err := store.GetDeviceByCredential(HashDeviceCredential("other")); err != ErrNotFound {
+			t.Errorf("Expected an unknown credential to be %s, got %v", ErrNotFound, err)
+		}
+
+		// A new credential replaces the old one.
+		homeDoor.CredentialHash = HashDeviceCredential("new")
+		if err := store.UpdateDevice(homeDoor); err != nil {
+			t.Fatalf("Failed to update device: %s", err)
+		}
+		if _, err := store.GetDeviceByCredential(HashDeviceCredential("home")); err != ErrNotFound {
+			t.Errorf("Expected the old credential to be gone, got %v", err)
+		}
+		if got, err := store.GetDeviceByCredential(HashDeviceCredential("new")); err != nil || got.Key != homeDoor.Key {
+			t.Errorf("Expected the new credential to find %s, got %v: %v", homeDoor.Key, got, err)
+		}
+
+		if err := store.DeleteDevice(homeDoor.Key); err != nil {
+			t.Fatalf("Failed to delete device: %s", err)
+		}
+		if _, err := store.GetDeviceByCredential(HashDeviceCredential("new")); err != ErrNotFound {
+			t.Errorf("Expected the credential to be deleted with the device, got %v", err)
+		}
+	})
+}
+
+func TestStoreOpenDeviceCommands(t *testing.T) {
+	testStores(t, func(t *testing.T, store CatciergeStore) {
+		now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		door, window := newDevice(bson.NewObjectId(), "door", now), newDevice(bson.NewObjectId(), "window", now)
+		for _, d := range []*Device{door, window} {
+			if err := store.InsertDevice(d); err != nil {
+				t.Fatalf("Failed to insert device: %s", err)
+			}
+		}
+
+		// IDs are created in order, so this is also the order the commands were queued in.
+		commands := []DeviceCommand{
+			{ID: bson.NewObjectId(), DeviceKey: door.Key, State: DeviceCommandQueued},
+			{ID: bson.NewObjectId(), DeviceKey: window.Key, State: DeviceCommandQueued},
+			{ID: bson.NewObjectId(), DeviceKey: door.Key, State: DeviceCommandQueued},
+			{ID: bson.NewObjectId(), DeviceKey: window.Key, State: DeviceCommandQueued},
+		}
+		for i := range commands {
+			if err := store.InsertDeviceCommand(&commands[i]); err != nil {
+				t.Fatalf("Failed to insert command: %s", err)
+			}
+		}
+
+		commands[1].State = DeviceCommandDelivered
+		commands[2].State = DeviceCommandAcked
+		for _, i := range []int{1, 2} {
+			if err := store.UpdateDeviceCommand(&commands[i]); err != nil {
+				t.Fatalf("Failed to update command: %s", err)
+			}
+		}
+
+		open := func(deviceKey string) []bson.ObjectId {
+			got, err := store.ListOpenDeviceCommands(deviceKey)
+			if err != nil {
+				t.Fatalf("Failed to list open commands: %s", err)
+			}
+			ids := []bson.ObjectId{}
+			for _, c := range got {
+				ids = append(ids, c.ID)
+			}
+			return ids
+		}
+
+		tests := []struct {
+			name      string
+			deviceKey string
+			ids       []bson.ObjectId
+		}{
+			{"all", "", []bson.ObjectId{commands[0].ID, commands[1].ID, commands[3].ID}},
+			{"door", door.Key, []bson.ObjectId{commands[0].ID}},
+			{"window", window.Key, []bson.ObjectId{commands[1].ID, commands[3].ID}},
+		}
+		for _, tc := range tests {
+			if ids := open(tc.deviceKey); !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("%s: Expected open commands %v, got %v", tc.name, tc.ids, ids)
+			}
+		}
+
+		if err := store.DeleteDevice(window.Key); err != nil {
+			t.Fatalf("Failed to delete device: %s", err)
+		}
+		if ids := open(""); !reflect.DeepEqual(ids, []bson.ObjectId{commands[0].ID}) {
+			t.Errorf("Expected the commands of the deleted device to be gone, got %v", ids)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tarEntry What we need to know about a tar entry to validate it before extracting.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	mode     os.FileMode
+	path     string // Where it is extracted, empty if it is skipped.
+}
+
+// isDir Checks if the entry is a directory.
+func (e *tarEntry) isDir() bool {
+	return e.typeflag == tar.TypeDir
+}
+
+// typeProblem Checks that the entry is a plain file or directory. This goes by the
+// type in the header, the mode doesn't tell hard links apart from regular files.
+func (e *tarEntry) typeProblem() string {
+	switch e.typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+		return EventArchiveModeProblem(e.name, e.mode)
+	case tar.TypeSymlink:
+		return fmt.Sprintf("'%s' is a symlink, which is not allowed", e.name)
+	case tar.TypeLink:
+		return fmt.Sprintf("'%s' is a hard link, which is not allowed", e.name)
+	}
+	return fmt.Sprintf("'%s' is not a regular file or directory", e.name)
+}
+
+// openTarEvent Opens a tar archive, decompressing it if it is gzipped.
+// Call the returned function to close it.
+func openTarEvent(src string, gzipped bool) (*tar.Reader, func(), error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !gzipped {
+		return tar.NewReader(f), func() { f.Close() }, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, &CatArchiveError{[]string{fmt.Sprintf("Invalid gzip file: %s", err)}}
+	}
+
+	return tar.NewReader(gz), func() { gz.Close(); f.Close() }, nil
+}
+
+// nextTarEntry Returns the next entry of a tar archive, skipping global pax headers.
+func nextTarEntry(tr *tar.Reader) (*tar.Header, error) {
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err != io.EOF {
+				err = &CatArchiveError{[]string{fmt.Sprintf("Invalid tar file: %s", err)}}
+			}
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			return hdr, nil
+		}
+	}
+}
+
+// UntarEvent Unpacks a catcierge event tar archive, optionally gzipped. The event
+// JSON and path prefix are found the same way as in UnzipEvent, and the archive
+// goes through the same validation and limits before anything is written to dest.
+// Since a tar can only be read from start to end the archive is read twice.
+func UntarEvent(src, dest string, gzipped bool, versionHint string, limits *EventArchiveLimits) (*CatEventHeader, *CatEventDataV1, error) {
+	tr, closeTar, err := openTarEvent(src, gzipped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []tarEntry
+	var content []byte
+	var jsonName string
+	var declared int64
+
+	// Find the event JSON and list the entries. The declared sizes are checked
+	// here so that we don't decompress a huge entry just to skip over it.
+	for {
+		hdr, err := nextTarEntry(tr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeTar()
+			return nil, nil, err
+		}
+
+		entries = append(entries, tarEntry{name: hdr.Name, typeflag: hdr.Typeflag, mode: hdr.FileInfo().Mode()})
+		if err := limits.CheckEntryCount(len(entries)); err != nil {
+			closeTar()
+			return nil, nil, err
+		}
+
+		declared += hdr.Size
+		if limits.MaxUnpackedSize > 0 && declared > int64(limits.MaxUnpackedSize) {
+			closeTar()
+			return nil, nil, &CatArchiveTooLargeError{fmt.Errorf("The archive unpacks to more than the allowed %s", limits.MaxUnpackedSize)}
+		}
+
+		isFile := hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+		if content == nil && isFile && filepath.Ext(hdr.Name) == ".json" {
+			var jsonSize int64
+			jsonName = hdr.Name
+			if content, err = ioutil.ReadAll(limits.NewEntryReader(tr, hdr.Name, -1, &jsonSize)); err != nil {
+				closeTar()
+				return nil, nil, err
+			}
+		}
+	}
+	closeTar()
+
+	if content == nil {
+		return nil, nil, &CatJSONHeaderError{errors.New("No event JSON found in the tar file")}
+	}
+
+	pathPrefix, err := EventArchivePrefix(jsonName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Path prefix: %s\n", pathPrefix)
+
+	header, data, err := ParseEventJSON(content, versionHint)
+	if err != nil {
+		return header, nil, err
+	}
+
+	log.Printf("Event ID: %s\n", header.ID)
+
+	// Validate all entries before unpacking anything.
+	var problems []string
+	files := make(map[string]bool)
+	names := make(EventArchiveNames)
+
+	for i := range entries {
+		e := &entries[i]
+
+		if p := e.typeProblem(); p != "" {
+			problems = append(problems, p)
+			continue
+		}
+
+		rel, skip, p := EventArchivePath(e.name, e.isDir(), pathPrefix)
+		if p != "" {
+			problems = append(problems, p)
+			continue
+		}
+		if skip {
+			continue
+		}
+
+		if e.path, err = EventFilePath(dest, rel); err != nil {
+			problems = append(problems, fmt.Sprintf("'%s' points outside of the event directory", e.name))
+			continue
+		}
+
+		if p := names.Add(e.name, rel, e.isDir()); p != "" {
+			e.path = ""
+			problems = append(problems, p)
+			continue
+		}
+
+		if !e.isDir() {
+			if p := limits.ExtensionProblem(e.name); p != "" {
+				problems = append(problems, p)
+				continue
+			}
+			files[rel] = true
+		}
+	}
+
+	problems = append(problems, ValidateEventFiles(data, files)...)
+
+	if len(problems) > 0 {
+		log.Printf("Invalid archive for event %s: %s", header.ID, strings.Join(problems, "; "))
+		return header, nil, &CatArchiveError{problems}
+	}
+
+	// Unpack the files in a second pass.
+	tr, closeTar, err = openTarEvent(src, gzipped)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeTar()
+
+	os.MkdirAll(dest, 0755)
+
+	var unpacked int64
+
+	for i := range entries {
+		hdr, err := nextTarEntry(tr)
+		if err == io.EOF || (err == nil && hdr.Name != entries[i].name) {
+			return nil, nil, errors.New("The tar file changed while it was unpacked")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		path := entries[i].path
+		if path == "" {
+			continue
+		}
+
+		if entries[i].isDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		os.MkdirAll(filepath.Dir(path), 0755)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, EventFileMode)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = io.Copy(f, limits.NewEntryReader(tr, hdr.Name, -1, &unpacked))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return header, data, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTarEntry A tar header and the body to write after it.
+type testTarEntry struct {
+	hdr  *tar.Header
+	body string
+}
+
+// testTarEntries Converts archive entries into tar entries.
+func testTarEntries(entries []testArchiveEntry) []testTarEntry {
+	var tes []testTarEntry
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: int64(e.Mode.Perm()), Size: int64(len(e.Body)), Typeflag: tar.TypeReg}
+		if e.Mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if e.Mode&os.ModeSetuid != 0 {
+			hdr.Mode |= 04000
+		}
+		tes = append(tes, testTarEntry{hdr, e.Body})
+	}
+	return tes
+}
+
+// testWriteTar Writes a tar file, optionally gzipped, with the given entries to dir.
+func testWriteTar(t *testing.T, dir string, gzipped bool, entries []testTarEntry) string {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatalf("Failed to add %s to tar: %s", e.hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Failed to write %s to tar: %s", e.hdr.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar: %s", err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+
+	src := filepath.Join(dir, "event.tar")
+	if err := ioutil.WriteFile(src, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write tar: %s", err)
+	}
+	return src
+}
+
+func testUntar(t *testing.T, gzipped bool, entries []testTarEntry) (string, *CatEventDataV1, error) {
+	dir := testTempDir(t)
+	src := testWriteTar(t, dir, gzipped, entries)
+	_, data, err := UntarEvent(src, filepath.Join(dir, "out"), gzipped, "", NewEventArchiveLimits(DefaultMaxUnpackedEventSize,
+		DefaultMaxEventEntries, DefaultMaxEventCompressionRatio, DefaultEventExtensions))
+	return dir, data, err
+}
+
+func TestUntarEvent(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		for _, prefix := range []string{"", "home/catcierge/event/"} {
+			dir, data, err := testUntar(t, gzipped, testTarEntries(testEventArchiveEntries(prefix)))
+			defer os.RemoveAll(dir)
+			if err != nil {
+				t.Fatalf("%q gzipped %v: Failed to untar event: %s", prefix, gzipped, err)
+			}
+
+			if data.ID != "abcdef0123456789" || len(data.Matches) != 1 {
+				t.Errorf("%q gzipped %v: Unexpected event data %+v", prefix, gzipped, data)
+			}
+
+			body, err := ioutil.ReadFile(filepath.Join(dir, "out", "steps", "step1.png"))
+			if err != nil || string(body) != "step" {
+				t.Errorf("%q gzipped %v: Expected the step to be unpacked, got %q, %v", prefix, gzipped, body, err)
+			}
+		}
+	}
+}
+
+func TestUntarEventFileMode(t *testing.T) {
+	entries := testEventArchiveEntries("")
+	entries[1].Mode = os.ModeSetuid | 0777
+	entries[3].Mode = 0
+
+	dir, _, err := testUntar(t, false, testTarEntries(entries))
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Failed to untar event: %s", err)
+	}
+
+	for _, name := range []string{"match1.png", "steps/step1.png"} {
+		fi, err := os.Stat(filepath.Join(dir, "out", name))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %s", name, err)
+		}
+		if mode := fi.Mode(); mode&(os.ModeSetuid|0022) != 0 || mode&0400 == 0 {
+			t.Errorf("%s: Expected mode %s, got %s", name, EventFileMode, mode)
+		}
+	}
+}
+
+func TestUntarEventInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   testTarEntry
+		problem string
+	}{
+		{"parent directory", testTarEntry{&tar.Header{Name: "../evil.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "evil"}, "outside of the archive"},
+		{"absolute path", testTarEntry{&tar.Header{Name: "/tmp/evil.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "evil"}, "outside of the archive"},
+		{"symlink", testTarEntry{&tar.Header{Name: "evil.png", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777}, ""}, "symlink"},
+		{"hard link", testTarEntry{&tar.Header{Name: "evil.png", Typeflag: tar.TypeLink, Linkname: "/etc/passwd", Mode: 0644}, ""}, "hard link"},
+		{"device", testTarEntry{&tar.Header{Name: "evil.png", Typeflag: tar.TypeChar, Mode: 0644}, ""}, "not a regular file"},
+		{"fifo", testTarEntry{&tar.Header{Name: "evil.png", Typeflag: tar.TypeFifo, Mode: 0644}, ""}, "not a regular file"},
+		{"duplicate", testTarEntry{&tar.Header{Name: "match1.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "evil"}, "more than once"},
+		{"inside a file", testTarEntry{&tar.Header{Name: "match1.png/evil.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, "evil"}, "which is a file"},
+		{"extension", testTarEntry{&tar.Header{Name: "evil.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 4}, "evil"}, "allowed extension"},
+	}
+
+	for _, tc := range tests {
+		dir, _, err := testUntar(t, false, append(testTarEntries(testEventArchiveEntries("")), tc.entry))
+		defer os.RemoveAll(dir)
+
+		if problems := testArchiveProblems(t, err); !testHasProblem(problems, tc.problem) {
+			t.Errorf("%s: Expected a problem with %q, got %v", tc.name, tc.problem, problems)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected nothing to be unpacked", tc.name)
+		}
+	}
+}
+
+func TestUntarEventHardLinkJSON(t *testing.T) {
+	// A hard link named like the event JSON is neither used as the JSON nor unpacked.
+	entries := append([]testTarEntry{{&tar.Header{Name: "link.json", Typeflag: tar.TypeLink, Linkname: "/etc/passwd", Mode: 0644}, ""}},
+		testTarEntries(testEventArchiveEntries(""))...)
+
+	dir, _, err := testUntar(t, false, entries)
+	defer os.RemoveAll(dir)
+
+	if problems := testArchiveProblems(t, err); !testHasProblem(problems, "hard link") {
+		t.Errorf("Expected a problem with the hard link, got %v", problems)
+	}
+}
+
+func TestUntarEventLimits(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	entries := testEventArchiveEntries("")
+	entries[1].Body = string(bytes.Repeat([]byte{0}, int(MB)))
+	src := testWriteTar(t, dir, true, testTarEntries(entries))
+
+	if _, _, err := UntarEvent(src, filepath.Join(dir, "entries"), true, "", NewEventArchiveLimits(0, 3, 0, "")); err == nil {
+		t.Errorf("Expected too many entries to fail")
+	} else if _, ok := err.(*CatArchiveLimitError); !ok {
+		t.Errorf("Expected a CatArchiveLimitError for too many entries, got %T: %v", err, err)
+	}
+
+	if _, _, err := UntarEvent(src, filepath.Join(dir, "size"), true, "", NewEventArchiveLimits(MB/2, 0, 0, "")); err == nil {
+		t.Errorf("Expected a too large archive to fail")
+	} else if _, ok := err.(*CatArchiveTooLargeError); !ok {
+		t.Errorf("Expected a CatArchiveTooLargeError, got %T: %v", err, err)
+	}
+}
+
+func TestUntarEventCorrupt(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "bad.tar.gz")
+	if err := ioutil.WriteFile(src, []byte("not a gzip file"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	limits := NewEventArchiveLimits(0, 0, 0, "")
+	if _, _, err := UntarEvent(src, filepath.Join(dir, "bad"), true, "", limits); err != nil {
+		testArchiveProblems(t, err)
+	} else {
+		t.Errorf("Expected an invalid gzip file to fail")
+	}
+
+	// A tar that ends in the middle of an entry.
+	src = testWriteTar(t, dir, false, testTarEntries(testEventArchiveEntries("")))
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Failed to read tar: %s", err)
+	}
+	if err := ioutil.WriteFile(src, content[:1024+100], 0644); err != nil {
+		t.Fatalf("Failed to write tar: %s", err)
+	}
+
+	if _, _, err := UntarEvent(src, filepath.Join(dir, "truncated"), false, "", limits); err != nil {
+		testArchiveProblems(t, err)
+	} else {
+		t.Errorf("Expected a truncated tar file to fail")
+	}
+}
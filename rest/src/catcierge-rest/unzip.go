@@ -2,8 +2,10 @@ package main
 
 import (
 	"archive/zip"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -25,74 +27,55 @@ type CatJSONVersionError struct {
 	error
 }
 
-func isSupportedEventVersion(h *CatEventHeader) bool {
-	switch h.EventJSONVersion {
-	case "1.0":
-		return true
-	}
-
-	return false
-}
-
-// UnzipEvent Unzips a catcierge event ZIP file.
-func UnzipEvent(src, dest string) (*CatEventHeader, *CatEventDataV1, error) {
+// UnzipEvent Unzips a catcierge event ZIP file. The versionHint is the event JSON
+// version the uploader says it is sending (from the Content-Type), if any.
+// The archive is validated before anything is written to dest, and the limits
+// are enforced while unpacking.
+func UnzipEvent(src, dest, versionHint string, limits *EventArchiveLimits) (*CatEventHeader, *CatEventDataV1, error) {
 	r, err := zip.OpenReader(src)
 	if err != nil {
+		return nil, nil, &CatArchiveError{[]string{fmt.Sprintf("Invalid ZIP file: %s", err)}}
+	}
+	defer r.Close()
+
+	if err := limits.CheckEntryCount(len(r.File)); err != nil {
 		return nil, nil, err
 	}
-	defer func() {
-		if err := r.Close(); err != nil {
-			panic(err)
-		}
-	}()
+
+	var unpacked int64
 
 	os.MkdirAll(dest, 0755)
 
-	// Closure to address file descriptors issue with all the deferred .Close() methods
-	extractAndWriteFile := func(f *zip.File) error {
-		rc, err := f.Open()
-		if err != nil {
-			return err
+	// Closure to address file descriptors issue with all the deferred .Close() methods.
+	// The mode in the archive is ignored, it could be anything, such as setuid or 0000.
+	extractAndWriteFile := func(zf *zip.File, path string) error {
+		if zf.FileInfo().IsDir() {
+			return os.MkdirAll(path, 0755)
 		}
-		defer func() {
-			if err := rc.Close(); err != nil {
-				panic(err)
-			}
-		}()
 
-		path := filepath.Join(dest, f.Name)
+		rc, err := zf.Open()
+		if err != nil {
+			return &CatArchiveError{[]string{fmt.Sprintf("Failed to read '%s': %s", zf.Name, err)}}
+		}
+		defer rc.Close()
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(path), f.Mode())
-			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if err := f.Close(); err != nil {
-					panic(err)
-				}
-			}()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, EventFileMode)
+		if err != nil {
+			return err
+		}
 
-			_, err = io.Copy(f, rc)
-			if err != nil {
-				return err
-			}
+		_, err = io.Copy(f, limits.NewEntryReader(rc, zf.Name, int64(zf.CompressedSize64), &unpacked))
+		if cerr := f.Close(); err == nil {
+			err = cerr
 		}
-		return nil
+		return err
 	}
 
 	var pathPrefix string
 	var eventName string
-	var header CatEventHeader
-	var data CatEventDataV1
-
-	// TODO: Add known versions parsing
-	// TODO: Verify all files referenced in the json file exists at the correct paths.
-	// TODO: Based on content-type version  give error if what we try to parse does not match
-	// TODO: If content-type is zip, assume it is the latest version
+	var header *CatEventHeader
+	var data *CatEventDataV1
 
 	// Find the event JSON and set the prefix based on that.
 	// (Because some ZIP files have full paths in the zip)
@@ -100,57 +83,96 @@ func UnzipEvent(src, dest string) (*CatEventHeader, *CatEventDataV1, error) {
 		if filepath.Ext(f.Name) == ".json" {
 			// Get the filename without extension.
 			_, eventName = filepath.Split(strings.TrimSuffix(f.Name, filepath.Ext(f.Name)))
-			pathPrefix = filepath.Dir(f.Name)
+			if pathPrefix, err = EventArchivePrefix(f.Name); err != nil {
+				return nil, nil, err
+			}
 
 			log.Printf("Event ID: %s\n", eventName)
 			log.Printf("Path prefix: %s\n", pathPrefix)
 
-			// Decode the JSON.
 			rc, err := f.Open()
 			if err != nil {
-				return nil, nil, err
-			}
-			defer rc.Close()
-
-			// Start by decoding the header so we can get the version info.
-			err = json.NewDecoder(rc).Decode(&header)
-			if err != nil {
-				log.Printf("Failed to decode event header: %s", err)
-				return nil, nil, CatJSONHeaderError{err}
-			}
-
-			if !isSupportedEventVersion(&header) {
-				log.Printf("Unsupported version for event %s: %s", header.ID, header.Version)
-				return &header, nil, CatJSONVersionError{err}
+				return nil, nil, &CatArchiveError{[]string{fmt.Sprintf("Failed to read '%s': %s", f.Name, err)}}
 			}
-
-			// We can't seek in a zip file so we re-open it.
+			var jsonSize int64
+			content, err := ioutil.ReadAll(limits.NewEntryReader(rc, f.Name, int64(f.CompressedSize64), &jsonSize))
 			rc.Close()
-			rc, err = f.Open()
 			if err != nil {
 				return nil, nil, err
 			}
-			defer rc.Close()
 
-			// The version is supported to parse it.
-			// TODO: Add a map of parsers for different versions.
-			err = json.NewDecoder(rc).Decode(&data)
+			header, data, err = ParseEventJSON(content, versionHint)
 			if err != nil {
-				log.Printf("Failed to decode JSON (v%s) for event %s: %s", header.EventJSONVersion, header.ID, err)
-				return &header, nil, CatJSONError{err}
+				return header, nil, err
 			}
 			break
 		}
 	}
 
+	if data == nil {
+		return nil, nil, &CatJSONHeaderError{errors.New("No event JSON found in the ZIP file")}
+	}
+
+	// Validate all entries before unpacking anything.
+	var problems []string
+	paths := make(map[*zip.File]string)
+	files := make(map[string]bool)
+	names := make(EventArchiveNames)
+
+	for _, f := range r.File {
+		if p := EventArchiveModeProblem(f.Name, f.Mode()); p != "" {
+			problems = append(problems, p)
+			continue
+		}
+
+		rel, skip, p := EventArchivePath(f.Name, f.FileInfo().IsDir(), pathPrefix)
+		if p != "" {
+			problems = append(problems, p)
+			continue
+		}
+		if skip {
+			continue
+		}
+
+		if paths[f], err = EventFilePath(dest, rel); err != nil {
+			problems = append(problems, fmt.Sprintf("'%s' points outside of the event directory", f.Name))
+			continue
+		}
+
+		if p := names.Add(f.Name, rel, f.FileInfo().IsDir()); p != "" {
+			delete(paths, f)
+			problems = append(problems, p)
+			continue
+		}
+
+		if !f.FileInfo().IsDir() {
+			if p := limits.ExtensionProblem(f.Name); p != "" {
+				problems = append(problems, p)
+				continue
+			}
+			files[rel] = true
+		}
+	}
+
+	problems = append(problems, ValidateEventFiles(data, files)...)
+
+	if len(problems) > 0 {
+		log.Printf("Invalid archive for event %s: %s", header.ID, strings.Join(problems, "; "))
+		return header, nil, &CatArchiveError{problems}
+	}
+
 	// Unpack the files.
 	for _, f := range r.File {
-		f.Name = strings.TrimPrefix(f.Name, pathPrefix)
-		err := extractAndWriteFile(f)
+		path, ok := paths[f]
+		if !ok {
+			continue
+		}
+
+		err := extractAndWriteFile(f, path)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
-	return &header, &data, nil
+	return header, data, nil
 }
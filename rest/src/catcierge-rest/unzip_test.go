@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWriteZip Writes a ZIP file with the given entries to dir.
+func testWriteZip(t *testing.T, dir string, entries []testArchiveEntry) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		fh.SetMode(e.Mode)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("Failed to add %s to ZIP: %s", e.Name, err)
+		}
+		if _, err := w.Write([]byte(e.Body)); err != nil {
+			t.Fatalf("Failed to write %s to ZIP: %s", e.Name, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close ZIP: %s", err)
+	}
+
+	src := filepath.Join(dir, "event.zip")
+	if err := ioutil.WriteFile(src, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write ZIP: %s", err)
+	}
+	return src
+}
+
+func testUnzip(t *testing.T, entries []testArchiveEntry) (string, *CatEventDataV1, error) {
+	dir := testTempDir(t)
+	src := testWriteZip(t, dir, entries)
+	dest := filepath.Join(dir, "out")
+	_, data, err := UnzipEvent(src, dest, "", NewEventArchiveLimits(DefaultMaxUnpackedEventSize,
+		DefaultMaxEventEntries, DefaultMaxEventCompressionRatio, DefaultEventExtensions))
+	return dir, data, err
+}
+
+func TestUnzipEvent(t *testing.T) {
+	for _, prefix := range []string{"", "home/catcierge/event/"} {
+		dir, data, err := testUnzip(t, testEventArchiveEntries(prefix))
+		defer os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("%q: Failed to unzip event: %s", prefix, err)
+		}
+
+		if data.ID != "abcdef0123456789" || len(data.Matches) != 1 {
+			t.Errorf("%q: Unexpected event data %+v", prefix, data)
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, "out", "steps", "step1.png"))
+		if err != nil || string(body) != "step" {
+			t.Errorf("%q: Expected the step to be unpacked, got %q, %v", prefix, body, err)
+		}
+	}
+}
+
+func TestUnzipEventFileMode(t *testing.T) {
+	entries := testEventArchiveEntries("")
+	entries[1].Mode = os.ModeSetuid | 0777
+	entries[3].Mode = 0
+
+	dir, _, err := testUnzip(t, entries)
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Failed to unzip event: %s", err)
+	}
+
+	for _, name := range []string{"match1.png", "steps/step1.png"} {
+		fi, err := os.Stat(filepath.Join(dir, "out", name))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %s", name, err)
+		}
+		if mode := fi.Mode(); mode&(os.ModeSetuid|0022) != 0 || mode&0400 == 0 {
+			t.Errorf("%s: Expected mode %s, got %s", name, EventFileMode, mode)
+		}
+	}
+}
+
+func TestUnzipEventInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   testArchiveEntry
+		problem string
+	}{
+		{"parent directory", testArchiveEntry{"../evil.png", "evil", 0644}, "outside of the archive"},
+		{"nested parent directory", testArchiveEntry{"steps/../../evil.png", "evil", 0644}, "outside of the archive"},
+		{"absolute path", testArchiveEntry{"/tmp/evil.png", "evil", 0644}, "outside of the archive"},
+		{"symlink", testArchiveEntry{"evil.png", "/etc/passwd", os.ModeSymlink | 0777}, "symlink"},
+		{"duplicate", testArchiveEntry{"match1.png", "evil", 0644}, "more than once"},
+		{"inside a file", testArchiveEntry{"match1.png/evil.png", "evil", 0644}, "which is a file"},
+		{"extension", testArchiveEntry{"evil.sh", "evil", 0755}, "allowed extension"},
+	}
+
+	for _, tc := range tests {
+		entries := append(testEventArchiveEntries(""), tc.entry)
+		dir, _, err := testUnzip(t, entries)
+		defer os.RemoveAll(dir)
+
+		if problems := testArchiveProblems(t, err); !testHasProblem(problems, tc.problem) {
+			t.Errorf("%s: Expected a problem with %q, got %v", tc.name, tc.problem, problems)
+		}
+
+		// Nothing is unpacked from an invalid archive.
+		if _, err := os.Stat(filepath.Join(dir, "out", "match1.png")); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected nothing to be unpacked", tc.name)
+		}
+	}
+}
+
+func TestUnzipEventOutsidePrefix(t *testing.T) {
+	entries := append(testEventArchiveEntries("event/"), testArchiveEntry{"other/evil.png", "evil", 0644})
+	dir, _, err := testUnzip(t, entries)
+	defer os.RemoveAll(dir)
+
+	if problems := testArchiveProblems(t, err); !testHasProblem(problems, "outside of the event directory") {
+		t.Errorf("Expected a problem with the entry outside the prefix, got %v", problems)
+	}
+}
+
+func TestUnzipEventMissingFile(t *testing.T) {
+	entries := testEventArchiveEntries("")
+	entries = entries[:len(entries)-1]
+	dir, _, err := testUnzip(t, entries)
+	defer os.RemoveAll(dir)
+
+	if problems := testArchiveProblems(t, err); !testHasProblem(problems, "missing from the archive") {
+		t.Errorf("Expected the step to be missing, got %v", problems)
+	}
+}
+
+func TestUnzipEventCorrupt(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	limits := NewEventArchiveLimits(0, 0, 0, "")
+
+	// Not a ZIP file at all.
+	src := filepath.Join(dir, "bad.zip")
+	if err := ioutil.WriteFile(src, []byte("not a zip file"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if _, _, err := UnzipEvent(src, filepath.Join(dir, "bad"), "", limits); err != nil {
+		testArchiveProblems(t, err)
+	} else {
+		t.Errorf("Expected an invalid ZIP file to fail")
+	}
+
+	// Corrupt the data of an entry, which is only noticed when unpacking.
+	entries := testEventArchiveEntries("")
+	entries[1].Body = "match image data that is going to be corrupted"
+	src = testWriteZip(t, dir, entries)
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Failed to read ZIP: %s", err)
+	}
+
+	// Flip the bits of the entry's deflate stream, found after its local header.
+	i := bytes.Index(content, []byte("match1.png")) + len("match1.png")
+	for j := i; j < i+8 && j < len(content); j++ {
+		content[j] ^= 0xff
+	}
+	if err := ioutil.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to write ZIP: %s", err)
+	}
+
+	if _, _, err := UnzipEvent(src, filepath.Join(dir, "corrupt"), "", limits); err != nil {
+		if problems := testArchiveProblems(t, err); !testHasProblem(problems, "Failed to read 'match1.png'") {
+			t.Errorf("Expected reading the corrupt entry to fail, got %v", problems)
+		}
+	} else {
+		t.Errorf("Expected a corrupt ZIP entry to fail")
+	}
+}
+
+func TestUnzipEventLimits(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	entries := testEventArchiveEntries("")
+	entries[1].Body = string(bytes.Repeat([]byte{0}, int(MB)))
+	src := testWriteZip(t, dir, entries)
+
+	tests := []struct {
+		name   string
+		limits *EventArchiveLimits
+		check  func(err error) bool
+	}{
+		{"entries", NewEventArchiveLimits(0, 3, 0, ""), func(err error) bool {
+			_, ok := err.(*CatArchiveLimitError)
+			return ok
+		}},
+		{"compression ratio", NewEventArchiveLimits(0, 0, 100, ""), func(err error) bool {
+			_, ok := err.(*CatArchiveLimitError)
+			return ok
+		}},
+		{"size", NewEventArchiveLimits(MB/2, 0, 0, ""), func(err error) bool {
+			_, ok := err.(*CatArchiveTooLargeError)
+			return ok
+		}},
+		{"no limits", NewEventArchiveLimits(0, 0, 0, ""), func(err error) bool {
+			return err == nil
+		}},
+	}
+
+	for _, tc := range tests {
+		_, _, err := UnzipEvent(src, filepath.Join(dir, tc.name), "", tc.limits)
+		if !tc.check(err) {
+			t.Errorf("%s: Unexpected result %T: %v", tc.name, err, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// CatUploadTooLargeError Indicates that an uploaded file is larger than allowed.
+type CatUploadTooLargeError struct {
+	error
+}
+
+// SaveUpload Streams an upload into a new temporary file in tmpDir without keeping
+// it in memory. Fails with CatUploadTooLargeError as soon as more than maxSize
+// bytes have been read, so uploads without a Content-Length are limited as well.
+// Returns the path of the temporary file, which the caller must remove.
+func SaveUpload(r io.Reader, tmpDir string, prefix string, maxSize ByteSize) (string, ByteSize, error) {
+	tmpfile, err := ioutil.TempFile(tmpDir, prefix)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(tmpfile, io.LimitReader(r, int64(maxSize)+1))
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && ByteSize(n) > maxSize {
+		err = &CatUploadTooLargeError{fmt.Errorf("Max file size allowed %s", maxSize)}
+	}
+
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", ByteSize(n), err
+	}
+
+	return tmpfile.Name(), ByteSize(n), nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"labix.org/v2/mgo/bson"
+)
+
+// TusVersion The version of the tus resumable upload protocol we support (https://tus.io).
+const TusVersion = "1.0.0"
+
+// MIMEOffsetOctetStream The content type for upload chunks.
+const MIMEOffsetOctetStream = "application/offset+octet-stream"
+
+// DefaultUploadExpiry How long an incomplete upload is kept by default.
+const DefaultUploadExpiry = 24 * time.Hour
+
+// EventUpload The state of a resumable event archive upload.
+type EventUpload struct {
+	ID          string    `json:"id"`
+	Length      int64     `json:"length"`                 // Total size of the archive.
+	Offset      int64     `json:"offset"`                 // Number of bytes received so far.
+	VersionHint string    `json:"version_hint,omitempty"` // Event JSON version from the upload metadata.
+	DeviceID    string    `json:"device_id,omitempty"`    // The device uploading the event, from the upload metadata.
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+
+	AccountID bson.ObjectId `json:"account_id,omitempty"` // The account the upload was created in.
+	UserID    bson.ObjectId `json:"user_id,omitempty"`    // The user that created the upload, if not a device.
+}
+
+// IsOwnedBy Checks if an upload was created by the logged in account. A device can only
+// use its own uploads, and uploads created without an account can only be used by their user.
+func (u *EventUpload) IsOwnedBy(at *AuthenticationState) bool {
+	var accountID bson.ObjectId
+	if at.Account != nil {
+		accountID = at.Account.ID
+	}
+
+	if !at.IsAuthenticated || u.AccountID != accountID {
+		return false
+	}
+
+	if at.Device != nil && u.DeviceID != at.Device.ID {
+		return false
+	}
+
+	if u.AccountID == "" {
+		return at.User != nil && u.UserID == at.User.ID
+	}
+
+	return true
+}
+
+// UploadsResource Resumable uploads of event archives, for devices on flaky connections.
+// Uses the core tus 1.0 protocol with the creation, expiration and termination extensions.
+// When the last chunk is received the event is created just like POST /events.
+type UploadsResource struct {
+	CatciergeResource
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex // One lock per upload so chunks are appended in order.
+}
+
+// FromUploadsContext returns the UploadsResource in ctx, if any.
+func FromUploadsContext(ctx context.Context) (*UploadsResource, bool) {
+	up, ok := ctx.Value(uploadsKey).(*UploadsResource)
+	return up, ok
+}
+
+// AddContext appends the UploadsResource to the request context.
+func (up *UploadsResource) AddContext(c *context.Context) context.Context {
+	return context.WithValue(*c, uploadsKey, up)
+}
+
+// NewUploadsResource Create a new UploadsResource instance.
+func NewUploadsResource(store CatciergeStore, settings *CatSettings) *UploadsResource {
+	return &UploadsResource{
+		CatciergeResource: CatciergeResource{store: store, settings: settings},
+		locks:             make(map[string]*sync.Mutex)}
+}
+
+// Register Registers the resource endpoints for an UploadsResource.
+func (up *UploadsResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	uploadID := ws.PathParameter("upload-id", "identifier of the upload").DataType("string")
+
+	ws.Path("/uploads").
+		Doc("Resumable event uploads using the tus protocol (https://tus.io)").
+		Produces(restful.MIME_JSON, restful.MIME_XML)
+
+	ws.Route(ws.Method("OPTIONS").Path("").To(up.uploadOptions).
+		Doc("Get the supported tus version, extensions and max upload size").
+		Do(ReturnsStatus(http.StatusNoContent, "", nil)))
+
+	ws.Route(ws.POST("").To(up.createUpload).
+		Doc("Create a new upload, the total size of the event archive is given in the Upload-Length header").
+		Param(ws.HeaderParameter("Upload-Length", "Total size of the event archive in bytes").DataType("int")).
+		Param(ws.HeaderParameter("Upload-Metadata", "tus metadata, 'version' is used as the event JSON version and 'device' as the ID of the uploading device").DataType("string")).
+		Do(ReturnsStatus(http.StatusCreated, "", EventUpload{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusRequestEntityTooLarge),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(EventUpload{}))
+
+	ws.Route(ws.HEAD("/{upload-id}").To(up.headUpload).
+		Doc("Get the current offset of an upload in the Upload-Offset header, use this to resume").
+		Param(uploadID).
+		Do(ReturnsStatus(http.StatusOK, "", nil),
+			ReturnsError(http.StatusNotFound)))
+
+	ws.Route(ws.GET("/{upload-id}").To(up.getUpload).
+		Doc("Get the state of an upload").
+		Param(uploadID).
+		Do(ReturnsStatus(http.StatusOK, "", EventUpload{}),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(EventUpload{}))
+
+	ws.Route(ws.PATCH("/{upload-id}").To(up.patchUpload).
+		Doc("Append a chunk at the offset given in the Upload-Offset header. When the upload is complete the event is created and returned").
+		Param(uploadID).
+		Param(ws.HeaderParameter("Upload-Offset", "The offset the chunk starts at, must be the current offset").DataType("int")).
+		Consumes(MIMEOffsetOctetStream).
+		Do(ReturnsStatus(http.StatusNoContent, "The chunk was received, the upload is not complete yet", nil),
+			ReturnsStatus(http.StatusCreated, "The upload is complete and the event was created", CatEvent{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusConflict),
+			ReturnsError(http.StatusRequestEntityTooLarge),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.DELETE("/{upload-id}").To(up.deleteUpload).
+		Doc("Abort an upload").
+		Param(uploadID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusNotFound)))
+
+	container.Add(ws)
+}
+
+// uploadDir The directory incomplete uploads are kept in.
+func (up *UploadsResource) uploadDir() string {
+	return filepath.Join(up.settings.tmpPath, "catcierge-uploads")
+}
+
+// uploadPaths Returns the paths of the state and data files for an upload.
+func (up *UploadsResource) uploadPaths(id string) (string, string) {
+	base := filepath.Join(up.uploadDir(), id)
+	return base + ".json", base + ".data"
+}
+
+// lock Locks an upload, call the returned function to unlock it. Uploads that
+// don't exist are not found, so that no lock is kept for them.
+func (up *UploadsResource) lock(id string) (func(), error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+
+	statePath, _ := up.uploadPaths(id)
+	if _, err := os.Stat(statePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	up.mutex.Lock()
+	l, ok := up.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		up.locks[id] = l
+	}
+	up.mutex.Unlock()
+
+	l.Lock()
+	return l.Unlock, nil
+}
+
+// lockOwnUpload Locks and loads an upload of the logged in account, call the returned
+// function to unlock it. The uploads of others are not found.
+func (up *UploadsResource) lockOwnUpload(id string, authState *AuthenticationState) (*EventUpload, func(), error) {
+	unlock, err := up.lock(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := up.loadUpload(id)
+	if err == nil && !u.IsOwnedBy(authState) {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return u, unlock, nil
+}
+
+// loadUpload Loads the state of an upload. The offset is always the size of
+// the data file, so it is correct even if we crashed in the middle of a chunk.
+func (up *UploadsResource) loadUpload(id string) (*EventUpload, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+
+	statePath, dataPath := up.uploadPaths(id)
+
+	content, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var u EventUpload
+	if err := json.Unmarshal(content, &u); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+
+	if time.Now().After(u.Expires) {
+		up.removeUpload(id)
+		return nil, ErrNotFound
+	}
+
+	return &u, nil
+}
+
+// saveUpload Saves the state of an upload.
+func (up *UploadsResource) saveUpload(u *EventUpload) error {
+	content, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	statePath, _ := up.uploadPaths(u.ID)
+	return ioutil.WriteFile(statePath, content, 0600)
+}
+
+// removeUpload Removes the state and data of an upload.
+func (up *UploadsResource) removeUpload(id string) {
+	statePath, dataPath := up.uploadPaths(id)
+	os.Remove(statePath)
+	os.Remove(dataPath)
+
+	up.mutex.Lock()
+	delete(up.locks, id)
+	up.mutex.Unlock()
+}
+
+// RemoveExpired Removes all incomplete uploads that have expired.
+func (up *UploadsResource) RemoveExpired() {
+	entries, err := ioutil.ReadDir(up.uploadDir())
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		id := strings.TrimSuffix(e.Name(), ".json")
+		unlock, err := up.lock(id)
+		if err != nil {
+			continue
+		}
+		if _, err := up.loadUpload(id); err == ErrNotFound {
+			log.Printf("Removed expired upload %s", id)
+		}
+		unlock()
+	}
+}
+
+// StartExpiry Removes expired uploads periodically in the background.
+func (up *UploadsResource) StartExpiry(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			up.RemoveExpired()
+		}
+	}()
+}
+
+// parseUploadMetadata Parses the tus Upload-Metadata header, comma separated
+// pairs of a key and a base64 encoded value.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(kv) > 1 {
+			if b, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+				value = string(b)
+			}
+		}
+		metadata[kv[0]] = value
+	}
+
+	return metadata
+}
+
+// writeUploadHeaders Sets the tus headers describing an upload.
+func writeUploadHeaders(response *restful.Response, u *EventUpload) {
+	response.AddHeader("Tus-Resumable", TusVersion)
+	response.AddHeader("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	response.AddHeader("Upload-Length", strconv.FormatInt(u.Length, 10))
+	response.AddHeader("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	response.AddHeader("Cache-Control", "no-store")
+}
+
+// writeUploadError Writes the error for a failed upload lookup.
+func writeUploadError(response *restful.Response, id string, err error) {
+	if err == ErrNotFound {
+		WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Upload '%s' could not be found", id))
+		return
+	}
+
+	log.Printf("Failed to load upload %s: %s", id, err)
+	WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+}
+
+func (up *UploadsResource) uploadOptions(request *restful.Request, response *restful.Response) {
+	response.AddHeader("Tus-Resumable", TusVersion)
+	response.AddHeader("Tus-Version", TusVersion)
+	response.AddHeader("Tus-Max-Size", strconv.FormatInt(int64(up.settings.maxEventSize), 10))
+	response.AddHeader("Tus-Extension", "creation,expiration,termination")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (up *UploadsResource) createUpload(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	length, err := strconv.ParseInt(request.HeaderParameter("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, "A positive Upload-Length header is required")
+		return
+	}
+
+	if ByteSize(length) > up.settings.maxEventSize {
+		WriteCatciergeErrorString(response, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Max file size allowed %s but got %s", up.settings.maxEventSize, ByteSize(length)))
+		return
+	}
+
+	metadata := parseUploadMetadata(request.HeaderParameter("Upload-Metadata"))
+	deviceID, err := authState.EventDeviceID(metadata["device"])
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusForbidden, err.Error())
+		return
+	}
+
+	now := time.Now()
+	u := &EventUpload{
+		ID:          bson.NewObjectId().Hex(),
+		Length:      length,
+		VersionHint: metadata["version"],
+		DeviceID:    deviceID,
+		Created:     now,
+		Expires:     now.Add(up.settings.uploadExpiry)}
+
+	if authState.Account != nil {
+		u.AccountID = authState.Account.ID
+	}
+	if authState.User != nil {
+		u.UserID = authState.User.ID
+	}
+
+	if u.DeviceID != "" && !CheckEventDevice(response, u.DeviceID, u.AccountID) {
+		return
+	}
+
+	if err := os.MkdirAll(up.uploadDir(), 0700); err != nil {
+		log.Printf("Failed to create upload directory: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	_, dataPath := up.uploadPaths(u.ID)
+	if err := ioutil.WriteFile(dataPath, nil, 0600); err != nil {
+		log.Printf("Failed to create upload %s: %s", u.ID, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := up.saveUpload(u); err != nil {
+		log.Printf("Failed to save upload %s: %s", u.ID, err)
+		up.removeUpload(u.ID)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	log.Printf("Created upload %s of size %s", u.ID, ByteSize(length))
+
+	writeUploadHeaders(response, u)
+	response.AddHeader("Location", ReverseURL(request.Request, "/uploads/"+u.ID))
+	response.WriteHeaderAndEntity(http.StatusCreated, u)
+}
+
+func (up *UploadsResource) headUpload(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	id := request.PathParameter("upload-id")
+
+	u, unlock, err := up.lockOwnUpload(id, authState)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Printf("Failed to load upload %s: %s", id, err)
+		}
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	writeUploadHeaders(response, u)
+	response.WriteHeader(http.StatusOK)
+}
+
+func (up *UploadsResource) getUpload(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	id := request.PathParameter("upload-id")
+
+	u, unlock, err := up.lockOwnUpload(id, authState)
+	if err != nil {
+		writeUploadError(response, id, err)
+		return
+	}
+	defer unlock()
+
+	writeUploadHeaders(response, u)
+	response.WriteEntity(u)
+}
+
+func (up *UploadsResource) patchUpload(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	id := request.PathParameter("upload-id")
+
+	u, unlock, err := up.lockOwnUpload(id, authState)
+	if err != nil {
+		writeUploadError(response, id, err)
+		return
+	}
+	defer unlock()
+
+	offset, err := strconv.ParseInt(request.HeaderParameter("Upload-Offset"), 10, 64)
+	if err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, "An Upload-Offset header is required")
+		return
+	}
+
+	if offset != u.Offset {
+		writeUploadHeaders(response, u)
+		WriteCatciergeErrorString(response, http.StatusConflict,
+			fmt.Sprintf("Upload-Offset %d does not match the current offset %d", offset, u.Offset))
+		return
+	}
+
+	_, dataPath := up.uploadPaths(id)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Failed to open upload %s: %s", id, err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Whatever we get before a dropped connection is kept, so the device can resume from there.
+	remaining := u.Length - u.Offset
+	n, err := io.Copy(f, io.LimitReader(request.Request.Body, remaining+1))
+	if n > remaining {
+		f.Truncate(u.Offset)
+		f.Close()
+		writeUploadHeaders(response, u)
+		WriteCatciergeErrorString(response, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("The chunk goes past the Upload-Length %d", u.Length))
+		return
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	u.Offset += n
+
+	if err != nil {
+		log.Printf("Failed to receive chunk for upload %s at offset %d: %s", id, offset, err)
+		writeUploadHeaders(response, u)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeUploadHeaders(response, u)
+
+	if u.Offset < u.Length {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	log.Printf("Upload %s complete, creating event", id)
+	defer up.removeUpload(id)
+
+	events, ok := FromEventsContext(request.Request.Context())
+	if !ok {
+		log.Printf("Failed to get events resource from context for upload %s", id)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	events.createEventFromArchive(request, response, dataPath, "", u.VersionHint, u.DeviceID)
+}
+
+func (up *UploadsResource) deleteUpload(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForEvents(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	id := request.PathParameter("upload-id")
+
+	_, unlock, err := up.lockOwnUpload(id, authState)
+	if err != nil {
+		writeUploadError(response, id, err)
+		return
+	}
+	defer unlock()
+
+	up.removeUpload(id)
+	response.AddHeader("Tus-Resumable", TusVersion)
+	response.WriteHeader(http.StatusNoContent)
+}
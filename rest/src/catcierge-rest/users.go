@@ -6,7 +6,6 @@ import (
 	"context"
 	"net/http"
 
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 
 	restful "github.com/emicklei/go-restful"
@@ -33,8 +32,6 @@ type UserListResponse struct {
 	Items []User `json:"items"`
 }
 
-var usersKey key
-
 // FromUsersContext returns the CatEventResource in ctx, if any.
 func FromUsersContext(ctx context.Context) (*UsersResource, bool) {
 	ev, ok := ctx.Value(usersKey).(*UsersResource)
@@ -47,8 +44,8 @@ func (us *UsersResource) AddContext(c *context.Context) context.Context {
 }
 
 // NewUserResource create a new UsersResource
-func NewUserResource(session *mgo.Session, settings *CatSettings) *UsersResource {
-	return &UsersResource{CatciergeResource{session: session, settings: settings}}
+func NewUserResource(store CatciergeStore, settings *CatSettings) *UsersResource {
+	return &UsersResource{CatciergeResource{store: store, settings: settings}}
 }
 
 // Register UsersResource resource end points.
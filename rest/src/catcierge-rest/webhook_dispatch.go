@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"labix.org/v2/mgo/bson"
+)
+
+// Headers sent with each webhook delivery.
+const (
+	WebhookEventHeader     = "X-Catcierge-Event"
+	WebhookDeliveryHeader  = "X-Catcierge-Delivery"
+	WebhookSignatureHeader = "X-Catcierge-Signature"
+)
+
+// Defaults for delivering webhooks.
+const (
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookAttempts    = 5
+	DefaultWebhookRetryDelay  = 30 * time.Second
+	maxWebhookRetryDelay      = time.Hour
+	maxWebhookResponseReadLen = 64 * 1024
+)
+
+// WebhookPayload The JSON body POSTed to a webhook.
+type WebhookPayload struct {
+	Delivery string    `json:"delivery"` // The same for all attempts, so receivers can skip duplicates.
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Event    *CatEvent `json:"event,omitempty"`
+	Device   *Device   `json:"device,omitempty"`
+}
+
+// SignWebhookPayload Returns the signature of a payload, the hex encoded
+// HMAC-SHA256 of the body using the webhook secret, prefixed with "sha256=".
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrPrivateWebhookAddress A webhook pointing at the server itself or the network it is on.
+var ErrPrivateWebhookAddress = errors.New("Webhooks can't be delivered to loopback, link-local or private addresses")
+
+// privateWebhookNets The networks webhooks are not delivered to unless allowed, so that
+// a webhook can't be used to reach services that are not meant to be public.
+var privateWebhookNets = mustParseCIDRs(
+	"0.0.0.0/8",      // This network.
+	"10.0.0.0/8",     // Private.
+	"100.64.0.0/10",  // Carrier-grade NAT.
+	"127.0.0.0/8",    // Loopback.
+	"169.254.0.0/16", // Link-local, such as cloud metadata services.
+	"172.16.0.0/12",  // Private.
+	"192.168.0.0/16", // Private.
+	"224.0.0.0/4",    // Multicast.
+	"240.0.0.0/4",    // Reserved and broadcast.
+	"::/128",         // Unspecified.
+	"::1/128",        // Loopback.
+	"fc00::/7",       // Unique local.
+	"fe80::/10",      // Link-local.
+	"ff00::/8")       // Multicast.
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// IsPrivateWebhookIP Checks if an IP is loopback, link-local, private or otherwise not
+// public. IPv4 addresses mapped to IPv6 are checked as IPv4.
+func IsPrivateWebhookIP(ip net.IP) bool {
+	for _, n := range privateWebhookNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrivateWebhookHost Checks if the host of a webhook URL is an IP or name that is not
+// public. Other names are checked when they are resolved, since that can change.
+func IsPrivateWebhookHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return IsPrivateWebhookIP(ip)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// webhookDialContext Returns the dial function for delivering webhooks. Unless private
+// addresses are allowed, the host is resolved and every address is checked before
+// connecting, and the connection is made to the checked address so that the name
+// can't resolve to something else in between. This also covers redirects.
+func webhookDialContext(allowPrivate bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if allowPrivate {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("No addresses found for %s", host)
+		}
+
+		for _, a := range addrs {
+			if IsPrivateWebhookIP(a.IP) {
+				return nil, fmt.Errorf("%s resolves to %s: %s", host, a.IP, ErrPrivateWebhookAddress)
+			}
+		}
+
+		for _, a := range addrs {
+			var c net.Conn
+			if c, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port)); err == nil {
+				return c, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// WebhookDispatcher Delivers notifications to webhooks, retrying failed
+// deliveries with an exponential backoff and logging each attempt.
+type WebhookDispatcher struct {
+	store      WebhookStore
+	client     *http.Client
+	attempts   int
+	retryDelay time.Duration
+}
+
+// NewWebhookDispatcher Creates a new WebhookDispatcher.
+func NewWebhookDispatcher(store WebhookStore, settings *CatSettings) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store: store,
+		client: &http.Client{
+			Timeout: settings.webhookTimeout,
+			// No proxy from the environment, the addresses would be checked for the proxy instead.
+			Transport: &http.Transport{
+				DialContext:         webhookDialContext(settings.webhookAllowPrivate),
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second}},
+		attempts:   settings.webhookAttempts,
+		retryDelay: settings.webhookRetryDelay}
+}
+
+// Listen Notifies the webhooks about all events published by the broker.
+func (d *WebhookDispatcher) Listen(broker *EventBroker) {
+	broker.Listen(func(n EventNotification) {
+		d.Notify(n.Event.AccountID, &WebhookPayload{Type: n.Type, Event: n.Event})
+	})
+}
+
+// Notify Delivers a notification to the webhooks of an account that subscribe to its
+// type, the deliveries are made in the background. Nothing is delivered for events and
+// devices without an account, they don't belong to anyone that has webhooks.
+func (d *WebhookDispatcher) Notify(accountID bson.ObjectId, p *WebhookPayload) {
+	if accountID == "" {
+		return
+	}
+
+	if p.Time.IsZero() {
+		p.Time = time.Now().UTC()
+	}
+
+	go func() {
+		webhooks, err := d.store.ListWebhooks(accountID, 0, 0)
+		if err != nil {
+			log.Printf("Failed to list webhooks to notify about %s: %s", p.Type, err)
+			return
+		}
+
+		for _, w := range webhooks {
+			if !w.Subscribes(p.Type) {
+				continue
+			}
+
+			payload := *p
+			payload.Delivery = uuid.NewV4().String()
+			go d.deliver(w, &payload)
+		}
+	}()
+}
+
+// retryDelayFor Returns how long to wait after a failed attempt, doubling for each attempt.
+func (d *WebhookDispatcher) retryDelayFor(attempt int) time.Duration {
+	delay := d.retryDelay
+	for i := 1; i < attempt && delay < maxWebhookRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxWebhookRetryDelay {
+		delay = maxWebhookRetryDelay
+	}
+	return delay
+}
+
+// deliver Delivers a payload to a webhook until it succeeds or runs out of attempts.
+func (d *WebhookDispatcher) deliver(w Webhook, p *WebhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Failed to encode %s payload for webhook %s: %s", p.Type, w.ID.Hex(), err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		delivery := d.post(&w, p, body)
+		delivery.Attempt = attempt
+		delivery.Retry = !delivery.Success && attempt < d.attempts
+
+		if err := d.store.InsertWebhookDelivery(delivery); err != nil {
+			if err == ErrNotFound {
+				return // The webhook was deleted.
+			}
+			log.Printf("Failed to log delivery of webhook %s: %s", w.ID.Hex(), err)
+		}
+
+		if !delivery.Retry {
+			if !delivery.Success {
+				log.Printf("Giving up delivering %s to webhook %s after %d attempts", p.Delivery, w.ID.Hex(), attempt)
+			}
+			return
+		}
+
+		time.Sleep(d.retryDelayFor(attempt))
+
+		// Use the latest settings, and stop if the webhook was deleted or deactivated in the meantime.
+		current, err := d.store.GetWebhook(w.ID)
+		if err != nil || !current.Subscribes(p.Type) {
+			return
+		}
+		w = *current
+	}
+}
+
+// post Makes a single attempt at POSTing a payload to a webhook.
+func (d *WebhookDispatcher) post(w *Webhook, p *WebhookPayload, body []byte) *WebhookDelivery {
+	delivery := &WebhookDelivery{
+		ID:        bson.NewObjectId(),
+		WebhookID: w.ID,
+		Delivery:  p.Delivery,
+		Type:      p.Type,
+		Time:      time.Now().UTC().Truncate(time.Millisecond)}
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "catcierge-rest")
+	req.Header.Set(WebhookEventHeader, p.Type)
+	req.Header.Set(WebhookDeliveryHeader, p.Delivery)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(w.Secret, body))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	delivery.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer resp.Body.Close()
+
+	// Read some of the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxWebhookResponseReadLen))
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Success {
+		delivery.Error = "Unexpected response " + resp.Status
+	}
+
+	return delivery
+}
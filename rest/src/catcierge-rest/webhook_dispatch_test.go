@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	// Known HMAC-SHA256 test vectors from RFC 4231 and the Wikipedia HMAC article.
+	tests := []struct {
+		secret    string
+		body      string
+		signature string
+	}{
+		{"Jefe", "what do ya want for nothing?",
+			"sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"key", "The quick brown fox jumps over the lazy dog",
+			"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	}
+
+	for _, tc := range tests {
+		if signature := SignWebhookPayload(tc.secret, []byte(tc.body)); signature != tc.signature {
+			t.Errorf("Expected signature %s for '%s', got %s", tc.signature, tc.body, signature)
+		}
+	}
+}
+
+func TestIsPrivateWebhookHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"localhost", true},
+		{"LocalHost.", true},
+		{"cat.localhost", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+		{"example.com", false},
+		{"localhost.example.com", false},
+	}
+
+	for _, tc := range tests {
+		if private := IsPrivateWebhookHost(tc.host); private != tc.private {
+			t.Errorf("%s: Expected private %v, got %v", tc.host, tc.private, private)
+		}
+	}
+}
+
+func TestWebhookDispatcherPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The test server is on loopback, which is only reachable when allowed.
+	for _, allowPrivate := range []bool{false, true} {
+		d := NewWebhookDispatcher(NewMemoryStore(), &CatSettings{webhookTimeout: 5 * time.Second, webhookAllowPrivate: allowPrivate})
+		w := &Webhook{ID: bson.NewObjectId(), URL: server.URL}
+
+		delivery := d.post(w, &WebhookPayload{Type: EventCreated}, []byte("{}"))
+		if delivery.Success != allowPrivate {
+			t.Errorf("Allow private %v: Expected success %v, got %+v", allowPrivate, allowPrivate, delivery)
+		}
+		if !allowPrivate && !strings.Contains(delivery.Error, ErrPrivateWebhookAddress.Error()) {
+			t.Errorf("Expected the delivery to fail because of the private address, got %q", delivery.Error)
+		}
+	}
+
+	// Names are checked once they are resolved.
+	dial := webhookDialContext(false)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if _, err := dial(context.Background(), "tcp", net.JoinHostPort("localhost", port)); err == nil || !strings.Contains(err.Error(), ErrPrivateWebhookAddress.Error()) {
+		t.Errorf("Expected dialing localhost to fail, got %v", err)
+	}
+}
+
+func TestWebhookDispatcherListen(t *testing.T) {
+	type received struct {
+		eventType string
+		signature string
+		body      []byte
+	}
+	ch := make(chan received, 1000)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ch <- received{r.Header.Get(WebhookEventHeader), r.Header.Get(WebhookSignatureHeader), body}
+	}))
+	defer server.Close()
+
+	store := NewMemoryStore()
+	account := bson.NewObjectId()
+	webhook := &Webhook{ID: bson.NewObjectId(), AccountID: account, URL: server.URL,
+		Events: []string{EventCreated}, Secret: "secret", Active: true}
+	if err := store.InsertWebhook(webhook); err != nil {
+		t.Fatalf("Failed to insert webhook: %s", err)
+	}
+
+	d := NewWebhookDispatcher(store, &CatSettings{webhookTimeout: 5 * time.Second, webhookAttempts: 1, webhookAllowPrivate: true})
+	broker := NewEventBroker()
+	d.Listen(broker)
+
+	// More events than a stream subscriber can fall behind, none of them may be dropped.
+	const count = 2 * eventStreamBuffer
+	for i := 0; i < count; i++ {
+		e := testEvent(1, "in")
+		e.AccountID = account
+		broker.Publish(EventCreated, e)
+	}
+	broker.Publish(EventUpdated, &CatEvent{ID: bson.NewObjectId(), AccountID: account})
+	broker.Publish(EventCreated, &CatEvent{ID: bson.NewObjectId(), AccountID: bson.NewObjectId()})
+
+	for i := 0; i < count; i++ {
+		select {
+		case r := <-ch:
+			if r.eventType != EventCreated {
+				t.Errorf("Expected a %s notification, got %s", EventCreated, r.eventType)
+			}
+			if r.signature != SignWebhookPayload("secret", r.body) {
+				t.Errorf("Invalid signature %s", r.signature)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Only got %d of %d notifications", i, count)
+		}
+	}
+
+	select {
+	case r := <-ch:
+		t.Errorf("Expected no more notifications, got %s", r.eventType)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
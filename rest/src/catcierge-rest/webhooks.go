@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/satori/go.uuid"
+	"labix.org/v2/mgo/bson"
+)
+
+// WebhookEventTypes The event types a webhook can subscribe to.
+var WebhookEventTypes = []string{EventCreated, EventUpdated, EventDeleted, DeviceOffline, DeviceOnline}
+
+// Webhook A URL that an account wants notifications POSTed to.
+type Webhook struct {
+	ID        bson.ObjectId `json:"id" bson:"_id"`
+	AccountID bson.ObjectId `json:"account_id" bson:"account_id"`
+	URL       string        `json:"url" bson:"url"`
+	Events    []string      `json:"events" bson:"events"`           // The event types to notify about.
+	Secret    string        `json:"secret,omitempty" bson:"secret"` // Used to sign the payloads, only shown when created.
+	Active    bool          `json:"active" bson:"active"`
+	Created   time.Time     `json:"created" bson:"created"`
+}
+
+// Subscribes Checks if the webhook wants notifications about an event type.
+func (w *Webhook) Subscribes(eventType string) bool {
+	if !w.Active {
+		return false
+	}
+
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookRequest The body used to create or change a webhook.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"` // Generated when creating a webhook if not given, kept when changing one.
+	Active *bool    `json:"active,omitempty"` // Defaults to true.
+}
+
+// Validate Returns a list of problems with the request, if any. Unless allowPrivate
+// is set, URLs with a loopback, link-local or private host are not valid.
+func (r *WebhookRequest) Validate(allowPrivate bool) []string {
+	var problems []string
+
+	u, err := url.Parse(r.URL)
+	if r.URL == "" {
+		problems = append(problems, "Missing 'url'")
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("Invalid 'url' '%s', expected an absolute http or https URL", r.URL))
+	} else if !allowPrivate && IsPrivateWebhookHost(u.Hostname()) {
+		problems = append(problems, fmt.Sprintf("Invalid 'url' '%s': %s", r.URL, ErrPrivateWebhookAddress))
+	}
+
+	if len(r.Events) == 0 {
+		problems = append(problems, fmt.Sprintf("Missing 'events', expected one or more of: %s",
+			strings.Join(WebhookEventTypes, ", ")))
+	}
+
+	for _, t := range r.Events {
+		valid := false
+		for _, v := range WebhookEventTypes {
+			valid = valid || t == v
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("Invalid event type '%s', expected one of: %s",
+				t, strings.Join(WebhookEventTypes, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// WebhookDelivery A logged attempt to deliver a notification to a webhook.
+type WebhookDelivery struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	WebhookID  bson.ObjectId `json:"webhook_id" bson:"webhook_id"`
+	Delivery   string        `json:"delivery" bson:"delivery"` // The same for all attempts to deliver a notification.
+	Type       string        `json:"type" bson:"type"`
+	Attempt    int           `json:"attempt" bson:"attempt"`
+	Time       time.Time     `json:"time" bson:"time"`
+	Duration   int64         `json:"duration_ms" bson:"duration_ms"`
+	StatusCode int           `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty" bson:"error,omitempty"`
+	Success    bool          `json:"success" bson:"success"`
+	Retry      bool          `json:"retry" bson:"retry"` // If another attempt will be made.
+}
+
+// WebhookListResponse A response returned when listing webhooks.
+type WebhookListResponse struct {
+	ListResponseHeader
+	Items []Webhook `json:"items"`
+}
+
+// WebhookDeliveryListResponse A response returned when listing the deliveries of a webhook.
+type WebhookDeliveryListResponse struct {
+	ListResponseHeader
+	Items []WebhookDelivery `json:"items"`
+}
+
+// WebhooksResource Webhooks that get notified about events.
+type WebhooksResource struct {
+	CatciergeResource
+	dispatcher *WebhookDispatcher
+}
+
+// FromWebhooksContext returns the WebhooksResource in ctx, if any.
+func FromWebhooksContext(ctx context.Context) (*WebhooksResource, bool) {
+	wh, ok := ctx.Value(webhooksKey).(*WebhooksResource)
+	return wh, ok
+}
+
+// AddContext add WebhooksResource to the context.
+func (wh *WebhooksResource) AddContext(c *context.Context) context.Context {
+	return context.WithValue(*c, webhooksKey, wh)
+}
+
+// NewWebhooksResource create a new WebhooksResource
+func NewWebhooksResource(store CatciergeStore, settings *CatSettings) *WebhooksResource {
+	return &WebhooksResource{
+		CatciergeResource: CatciergeResource{store: store, settings: settings},
+		dispatcher:        NewWebhookDispatcher(store, settings)}
+}
+
+// StartDispatcher Starts delivering the events published by the broker to the webhooks.
+func (wh *WebhooksResource) StartDispatcher(broker *EventBroker) {
+	wh.dispatcher.Listen(broker)
+}
+
+// Register WebhooksResource resource end points.
+func (wh WebhooksResource) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	webhookID := ws.PathParameter("webhook-id", "Webhook ID").DataType("string")
+
+	ws.Path("/webhooks").
+		Doc("Manage webhooks, URLs that are sent a signed POST when events are created, updated or deleted, or a device goes offline or comes back online. "+
+			"The "+WebhookSignatureHeader+" header has the HMAC-SHA256 of the body using the webhook secret").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON, restful.MIME_XML)
+
+	ws.Route(ws.GET("/").To(wh.listWebhooks).
+		Doc("List the webhooks of the account").
+		Do(AddListRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", WebhookListResponse{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(WebhookListResponse{}))
+
+	ws.Route(ws.POST("").To(wh.createWebhook).
+		Doc("Create a webhook, the response is the only time the secret is shown").
+		Reads(WebhookRequest{}).
+		Do(ReturnsStatus(http.StatusCreated, "", Webhook{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{webhook-id}").To(wh.getWebhook).
+		Doc("Get a webhook").
+		Param(webhookID).
+		Do(ReturnsStatus(http.StatusOK, "", Webhook{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(Webhook{}))
+
+	ws.Route(ws.PUT("/{webhook-id}").To(wh.updateWebhook).
+		Doc("Change a webhook, the secret is kept unless a new one is given").
+		Param(webhookID).
+		Reads(WebhookRequest{}).
+		Do(ReturnsStatus(http.StatusOK, "", Webhook{}),
+			ReturnsError(http.StatusBadRequest),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.DELETE("/{webhook-id}").To(wh.deleteWebhook).
+		Doc("Delete a webhook and its delivery log").
+		Param(webhookID).
+		Do(ReturnsStatus(http.StatusNoContent, "", nil),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)))
+
+	ws.Route(ws.GET("/{webhook-id}/deliveries").To(wh.listWebhookDeliveries).
+		Doc("List the delivery attempts of a webhook, newest first").
+		Param(webhookID).
+		Do(AddListRequestParams(ws),
+			ReturnsStatus(http.StatusOK, "", WebhookDeliveryListResponse{}),
+			ReturnsError(http.StatusUnauthorized),
+			ReturnsError(http.StatusNotFound),
+			ReturnsError(http.StatusInternalServerError)).
+		Writes(WebhookDeliveryListResponse{}))
+
+	container.Add(ws)
+}
+
+// IsAuthorizedForWebhooks Checks if the request has the correct authorization to handle webhooks.
+func IsAuthorizedForWebhooks(request *restful.Request, response *restful.Response) (*AuthenticationState, error) {
+	authState, ok := FromAuthStateContext(request.Request.Context())
+	if !ok {
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return nil, errors.New("Failed to get authentication state from request context")
+	}
+
+	if !authState.IsAuthenticated {
+		WriteCatciergeErrorString(response, http.StatusUnauthorized,
+			"You must be logged in to manage webhooks")
+		return authState, errors.New("Unauthenticated user")
+	}
+
+	if authState.Account == nil {
+		WriteCatciergeErrorString(response, http.StatusUnauthorized,
+			"You must be logged in to an account to manage webhooks")
+		return authState, errors.New("User not member of any account")
+	}
+
+	return authState, nil
+}
+
+// getRequestWebhook Gets the webhook given by the webhook-id path parameter, writing
+// an error response if it can't be found. Webhooks of other accounts are not found.
+func (wh *WebhooksResource) getRequestWebhook(request *restful.Request, response *restful.Response, authState *AuthenticationState) (*Webhook, bool) {
+	id := request.PathParameter("webhook-id")
+	if !bson.IsObjectIdHex(id) {
+		WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Webhook '%s' could not be found", id))
+		return nil, false
+	}
+
+	webhook, err := wh.store.GetWebhook(bson.ObjectIdHex(id))
+	if err == nil && webhook.AccountID != authState.Account.ID {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Webhook '%s' could not be found", id))
+		} else {
+			log.Printf("Failed to get webhook %s: %s", id, err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return nil, false
+	}
+
+	return webhook, true
+}
+
+// readWebhookRequest Reads and validates the webhook in the request body, writing an error response if invalid.
+func (wh *WebhooksResource) readWebhookRequest(request *restful.Request, response *restful.Response) (*WebhookRequest, bool) {
+	var r WebhookRequest
+	if err := request.ReadEntity(&r); err != nil {
+		WriteCatciergeErrorString(response, http.StatusBadRequest, fmt.Sprintf("Invalid webhook: %s", err))
+		return nil, false
+	}
+
+	if problems := r.Validate(wh.settings.webhookAllowPrivate); len(problems) > 0 {
+		WriteCatciergeErrorProblems(response, http.StatusBadRequest, "Invalid webhook", problems)
+		return nil, false
+	}
+
+	return &r, true
+}
+
+func (wh *WebhooksResource) listWebhooks(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	var l = WebhookListResponse{}
+	l.getListResponseParams(request)
+
+	if l.Count, err = wh.store.CountWebhooks(authState.Account.ID); err != nil {
+		log.Printf("Failed to count webhooks: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to get webhook count")
+		return
+	}
+
+	if l.Items, err = wh.store.ListWebhooks(authState.Account.ID, l.Offset, l.Limit); err != nil {
+		log.Printf("Failed to list webhooks: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list webhooks")
+		return
+	}
+
+	for i := range l.Items {
+		l.Items[i].Secret = ""
+	}
+
+	response.WriteEntity(l)
+}
+
+func (wh *WebhooksResource) createWebhook(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	r, ok := wh.readWebhookRequest(request, response)
+	if !ok {
+		return
+	}
+
+	webhook := Webhook{
+		ID:        bson.NewObjectId(),
+		AccountID: authState.Account.ID,
+		URL:       r.URL,
+		Events:    r.Events,
+		Secret:    r.Secret,
+		Active:    r.Active == nil || *r.Active,
+		Created:   time.Now().UTC().Truncate(time.Millisecond)}
+
+	if webhook.Secret == "" {
+		webhook.Secret = uuid.NewV4().String()
+	}
+
+	if err := wh.store.InsertWebhook(&webhook); err != nil {
+		log.Printf("Failed to insert webhook: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		return
+	}
+
+	log.Printf("Created webhook %s for %s\n", webhook.ID.Hex(), webhook.URL)
+	response.WriteHeaderAndEntity(http.StatusCreated, webhook)
+}
+
+func (wh *WebhooksResource) getWebhook(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	webhook, ok := wh.getRequestWebhook(request, response, authState)
+	if !ok {
+		return
+	}
+
+	webhook.Secret = ""
+	response.WriteEntity(webhook)
+}
+
+func (wh *WebhooksResource) updateWebhook(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	webhook, ok := wh.getRequestWebhook(request, response, authState)
+	if !ok {
+		return
+	}
+
+	r, ok := wh.readWebhookRequest(request, response)
+	if !ok {
+		return
+	}
+
+	webhook.URL = r.URL
+	webhook.Events = r.Events
+	if r.Secret != "" {
+		webhook.Secret = r.Secret
+	}
+	if r.Active != nil {
+		webhook.Active = *r.Active
+	}
+
+	if err := wh.store.UpdateWebhook(webhook); err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Webhook '%s' could not be found", webhook.ID.Hex()))
+		} else {
+			log.Printf("Failed to update webhook %s: %s", webhook.ID.Hex(), err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	webhook.Secret = ""
+	response.WriteEntity(webhook)
+}
+
+func (wh *WebhooksResource) deleteWebhook(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	webhook, ok := wh.getRequestWebhook(request, response, authState)
+	if !ok {
+		return
+	}
+
+	if err := wh.store.DeleteWebhook(webhook.ID); err != nil {
+		if err == ErrNotFound {
+			WriteCatciergeErrorString(response, http.StatusNotFound, fmt.Sprintf("Webhook '%s' could not be found", webhook.ID.Hex()))
+		} else {
+			log.Printf("Failed to delete webhook %s: %s", webhook.ID.Hex(), err)
+			WriteCatciergeErrorString(response, http.StatusInternalServerError, "")
+		}
+		return
+	}
+
+	log.Printf("Deleted webhook %s\n", webhook.ID.Hex())
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (wh *WebhooksResource) listWebhookDeliveries(request *restful.Request, response *restful.Response) {
+	authState, err := IsAuthorizedForWebhooks(request, response)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+
+	webhook, ok := wh.getRequestWebhook(request, response, authState)
+	if !ok {
+		return
+	}
+
+	var l = WebhookDeliveryListResponse{}
+	l.getListResponseParams(request)
+
+	if l.Count, err = wh.store.CountWebhookDeliveries(webhook.ID); err != nil {
+		log.Printf("Failed to count webhook deliveries: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to get delivery count")
+		return
+	}
+
+	if l.Items, err = wh.store.ListWebhookDeliveries(webhook.ID, l.Offset, l.Limit); err != nil {
+		log.Printf("Failed to list webhook deliveries: %s", err)
+		WriteCatciergeErrorString(response, http.StatusInternalServerError, "Failed to list deliveries")
+		return
+	}
+
+	response.WriteEntity(l)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWebhookRequestValidate(t *testing.T) {
+	tests := []struct {
+		url          string
+		events       []string
+		allowPrivate bool
+		problem      string
+	}{
+		{"https://example.com/hook", []string{EventCreated}, false, ""},
+		{"http://example.com:8080/hook", []string{EventCreated, DeviceOffline}, false, ""},
+		{"", []string{EventCreated}, false, "Missing 'url'"},
+		{"ftp://example.com/hook", []string{EventCreated}, false, "expected an absolute http or https URL"},
+		{"/hook", []string{EventCreated}, false, "expected an absolute http or https URL"},
+		{"https://example.com/hook", nil, false, "Missing 'events'"},
+		{"https://example.com/hook", []string{"exploded"}, false, "Invalid event type 'exploded'"},
+		{"http://127.0.0.1:8080/hook", []string{EventCreated}, false, "private addresses"},
+		{"http://localhost/hook", []string{EventCreated}, false, "private addresses"},
+		{"http://[::1]/hook", []string{EventCreated}, false, "private addresses"},
+		{"http://169.254.169.254/latest/meta-data", []string{EventCreated}, false, "private addresses"},
+		{"http://192.168.1.10/hook", []string{EventCreated}, false, "private addresses"},
+		{"http://192.168.1.10/hook", []string{EventCreated}, true, ""},
+		{"http://localhost/hook", []string{EventCreated}, true, ""},
+	}
+
+	for _, tc := range tests {
+		r := &WebhookRequest{URL: tc.url, Events: tc.events}
+		problems := r.Validate(tc.allowPrivate)
+
+		if tc.problem == "" {
+			if len(problems) != 0 {
+				t.Errorf("%s: Expected no problems, got %v", tc.url, problems)
+			}
+		} else if len(problems) != 1 || !strings.Contains(problems[0], tc.problem) {
+			t.Errorf("%s: Expected a problem with %q, got %v", tc.url, tc.problem, problems)
+		}
+	}
+}